@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/bones/server/common"
+	aws "github.com/bones/server/handlers/aws"
+	circleci "github.com/bones/server/handlers/circleci"
+	github "github.com/bones/server/handlers/github"
+	"github.com/gorilla/mux"
+	"net/http"
+	"os"
+)
+
+// Action is a day-2 change a skeleton offers to the projects generated from
+// it, such as adding a database or a worker:
+//
+//	actions:
+//	  - name: add-worker
+//	    description: Add a background worker
+//	    inputs:
+//	      - name: WORKER_NAME
+//	        required: true
+//	    steps:
+//	      - name: Worker code
+//	        handler: github
+//	        path: /actions/worker
+//	      - name: Worker infra
+//	        handler: aws
+//
+// Steps work like generate steps, on the existing project, and render the
+// skeleton files at path with the action's data: github commits them to the
+// project repo, aws and circleci commit their configuration together with
+// the data vars and apply it.
+type Action struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description,omitempty"`
+	Inputs      []common.Input `json:"inputs,omitempty"`
+	Steps       []GenerateStep `json:"-"`
+}
+
+type ActionRequest struct {
+	Data common.Data `json:"data"`
+}
+
+// pinProjectSkeleton pins ctx to the skeleton commit project was generated
+// from, when it is known, so that actions see the skeleton as it was then.
+func pinProjectSkeleton(ctx context.Context, project *Project, projectType ProjectType) context.Context {
+	runsLock.Lock()
+	sha := project.SkeletonRef
+	runsLock.Unlock()
+
+	if sha == "" {
+		return ctx
+	}
+
+	return github.PinSkeleton(ctx, projectType.Repo, sha)
+}
+
+// projectSkeleton reads the manifest of project's skeleton.
+func projectSkeleton(project *Project, projectType ProjectType) (SkeletonYaml, error) {
+	ctx := pinProjectSkeleton(projectContext(project, nil), project, projectType)
+
+	skeletonDir, err := github.CheckoutSkeleton(ctx, projectType.Repo, projectType.Path)
+	if err != nil {
+		return SkeletonYaml{}, err
+	}
+	defer os.RemoveAll(skeletonDir)
+
+	return readSkeletonYaml(skeletonDir + projectType.Path)
+}
+
+func processActionSteps(ctx context.Context, action string, step GenerateStep, project *Project, projectType ProjectType, data common.Data) error {
+	fmt.Printf("Running step: %s (%s)\n", step.Name, action)
+
+	switch step.Handler {
+	case "approval":
+		// Nothing to do yet: the plans of the following step wait for sign-off.
+		return nil
+	case "github":
+		return github.UpdateRepo(ctx, project.Repo, projectType.Repo, projectType.Path+step.Path, data, "Run action "+action)
+	case "aws":
+		return aws.ApplyActionInfra(ctx, project.Name, project.Repo, projectType.Repo, projectType.Path+step.Path, data, projectEnvironment(project, ""), "Run action "+action)
+	case "circleci":
+		return circleci.ApplyActionProject(ctx, project.Name, project.Repo, projectType.Repo, projectType.Path+step.Path, data, projectEnvironment(project, ""), "Run action "+action)
+	}
+
+	return nil
+}
+
+func runAction(ctx context.Context, run *Run, project *Project, projectType ProjectType, action Action, data common.Data) error {
+	var steps []skeletonStep
+	for _, s := range action.Steps {
+		s := s
+		steps = append(steps, skeletonStep{
+			Name: s.Name, Handler: s.Handler, When: s.When, ForEach: s.ForEach, DependsOn: s.DependsOn,
+			run: func(ctx context.Context) error {
+				return processActionSteps(ctx, action.Name, s, project, projectType, data)
+			},
+		})
+	}
+
+	err := runSteps(ctx, run, data, steps, false)
+	keepOutputs(ctx, project)
+
+	return err
+}
+
+func returnProjectActions(w http.ResponseWriter, r *http.Request) {
+	project, ok := lookupProject(mux.Vars(r)["id"])
+	if !ok {
+		http.Error(w, "Project Not Found", http.StatusNotFound)
+		return
+	}
+
+	projectType, ok := lookupProjectType(project.Type)
+	if !ok {
+		http.Error(w, "Project Type Not Found", http.StatusNotFound)
+		return
+	}
+
+	skeleton, err := projectSkeleton(project, projectType)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	actions := skeleton.Actions
+	if actions == nil {
+		actions = []Action{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(actions)
+}
+
+// runProjectAction runs one of the actions of the project's skeleton with
+// the project's data, overridden by the data of the request.
+func runProjectAction(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	project, ok := lookupProject(vars["id"])
+	if !ok {
+		http.Error(w, "Project Not Found", http.StatusNotFound)
+		return
+	}
+
+	projectType, ok := lookupProjectType(project.Type)
+	if !ok {
+		http.Error(w, "Project Type Not Found", http.StatusNotFound)
+		return
+	}
+
+	var actionRequest ActionRequest
+	err := json.NewDecoder(r.Body).Decode(&actionRequest)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	skeleton, err := projectSkeleton(project, projectType)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var action *Action
+	for i := range skeleton.Actions {
+		if skeleton.Actions[i].Name == vars["name"] {
+			action = &skeleton.Actions[i]
+		}
+	}
+
+	if action == nil {
+		http.Error(w, "Action Not Found", http.StatusNotFound)
+		return
+	}
+
+	runsLock.Lock()
+	data := make(common.Data)
+	for key, value := range project.Data {
+		data[key] = value
+	}
+	runsLock.Unlock()
+
+	for key, value := range actionRequest.Data {
+		data[key] = value
+	}
+
+	err = common.ApplyInputs(action.Inputs, data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	runsLock.Lock()
+	run := startRun(project, "action:"+action.Name)
+	if run != nil {
+		project.LastRun = run.Id
+	}
+	runsLock.Unlock()
+
+	if run == nil {
+		http.Error(w, "Project has a run in progress", http.StatusConflict)
+		return
+	}
+
+	// Templates rendered by the action see its data, not only the project's.
+	tc := templateContext(project, projectType)
+	tc.Data = data
+
+	ctx := common.WithTemplateContext(projectContext(project, run), tc)
+	ctx = pinProjectSkeleton(ctx, project, projectType)
+
+	go func() {
+		run.finish(runAction(ctx, run, project, projectType, *action, data))
+	}()
+
+	runsLock.Lock()
+	defer runsLock.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(run)
+}
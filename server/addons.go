@@ -0,0 +1,344 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/bones/server/common"
+	aws "github.com/bones/server/handlers/aws"
+	github "github.com/bones/server/handlers/github"
+	"github.com/gorilla/mux"
+	"net/http"
+	"os"
+)
+
+// ProjectAddon is an add-on type applied to a project. Its data is the
+// project's, overridden by the data given when it was applied.
+type ProjectAddon struct {
+	Type        string      `json:"type"`
+	Data        common.Data `json:"data"`
+	SkeletonRef string      `json:"skeletonRef,omitempty"`
+	PullRequest string      `json:"pullRequest,omitempty"`
+	LastRun     string      `json:"lastRun,omitempty"`
+
+	// InfraPullRequests propose the infrastructure the add-on's aws steps
+	// applied, one per step and for_each item.
+	InfraPullRequests []string `json:"infraPullRequests,omitempty"`
+}
+
+type AddonApplyRequest struct {
+	Type string      `json:"type"`
+	Data common.Data `json:"data"`
+}
+
+// addonHandlers are the step handlers an add-on skeleton may use. An
+// add-on's github step opens a pull request on the project repo with the
+// add-on's files, and its aws step applies the add-on's infrastructure,
+// which is kept in its own states and proposed to the project repo under
+// addons/<type>/ in a pull request of its own.
+var addonHandlers = map[string]bool{
+	"approval": true,
+	"github":   true,
+	"aws":      true,
+}
+
+func processAddonSteps(ctx context.Context, step GenerateStep, project *Project, addonType ProjectType, addon *ProjectAddon) error {
+	fmt.Printf("Running step: %s (%s)\n", step.Name, addonType.Slug)
+
+	switch step.Handler {
+	case "approval":
+		// Nothing to do yet: the plans of the following step wait for sign-off.
+		return nil
+	case "github":
+		pullRequest, err := github.OpenPullRequest(ctx, project.Repo, "bones/addon-"+addonType.Slug, addonType.Repo, addonType.Path, addon.Data, "Add "+addonType.Name)
+
+		runsLock.Lock()
+		addon.PullRequest = pullRequest
+		runsLock.Unlock()
+
+		return err
+	case "aws":
+		branch := "bones/addon-" + addonType.Slug + "-infra"
+		if each, ok := common.EachFromContext(ctx); ok {
+			branch += "-" + each.Key
+		}
+
+		pullRequest, err := aws.CreateAddonInfra(ctx, project.Name, project.Repo, branch, addonType.Repo, addonType.Path, addon.Data, "Add "+addonType.Name+" infrastructure")
+
+		if pullRequest != "" {
+			runsLock.Lock()
+			addon.InfraPullRequests = append(addon.InfraPullRequests, pullRequest)
+			runsLock.Unlock()
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// applyAddon runs the generate steps of the add-on type's skeleton against
+// project. Templates see the project with its stored outputs, and the
+// add-on type as .type.
+func applyAddon(run *Run, project *Project, addonType ProjectType, addon *ProjectAddon) error {
+	sha, err := github.ResolveHead(addonType.Repo)
+	if err != nil {
+		return err
+	}
+
+	runsLock.Lock()
+	addon.SkeletonRef = sha
+	runsLock.Unlock()
+
+	tc := templateContext(project, addonType)
+	tc.Data = addon.Data
+
+	ctx := common.WithTemplateContext(projectContext(project, run), tc)
+	ctx = common.WithTerraformBinary(ctx, addonType.Terraform)
+	ctx = common.WithAddon(ctx, addonType.Slug)
+	ctx = github.PinSkeleton(ctx, addonType.Repo, sha)
+
+	skeletonDir, err := github.CheckoutSkeleton(ctx, addonType.Repo, addonType.Path)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(skeletonDir)
+
+	skeleton, err := readSkeletonYaml(skeletonDir + addonType.Path)
+	if err != nil {
+		return err
+	}
+
+	runsLock.Lock()
+	err = common.ApplyInputs(skeleton.Inputs, addon.Data)
+	runsLock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	var steps []skeletonStep
+	for _, s := range skeleton.Generate.Steps {
+		if !addonHandlers[s.Handler] {
+			return fmt.Errorf("step %s: add-ons can't use the %s handler", s.Name, s.Handler)
+		}
+
+		s := s
+		steps = append(steps, skeletonStep{
+			Name: s.Name, Handler: s.Handler, When: s.When, ForEach: s.ForEach, DependsOn: s.DependsOn,
+			run: func(ctx context.Context) error {
+				return processAddonSteps(ctx, s, project, addonType, addon)
+			},
+		})
+	}
+
+	err = runSteps(ctx, run, addon.Data, steps, false)
+	keepOutputs(ctx, project)
+
+	return err
+}
+
+// destroyAddon destroys the states the add-on slug applied to project, last
+// applied first, and removes the add-on from the project. Templates see what
+// they saw when the add-on was applied, so that configuration whose pull
+// request isn't merged can be rendered again.
+func destroyAddon(ctx context.Context, run *Run, project *Project, slug string) error {
+	runsLock.Lock()
+	addon := &ProjectAddon{Type: slug}
+	for _, a := range project.Addons {
+		if a.Type == slug {
+			addon = a
+		}
+	}
+	runsLock.Unlock()
+
+	addonType, ok := lookupProjectType(slug)
+	if ok {
+		tc := templateContext(project, addonType)
+		tc.Data = addon.Data
+
+		ctx = common.WithTemplateContext(ctx, tc)
+		ctx = common.WithTerraformBinary(ctx, addonType.Terraform)
+		if addon.SkeletonRef != "" {
+			ctx = github.PinSkeleton(ctx, addonType.Repo, addon.SkeletonRef)
+		}
+	}
+
+	runsLock.Lock()
+	var states []ProjectState
+	for _, state := range project.States {
+		if state.Addon == slug {
+			states = append([]ProjectState{state}, states...)
+		}
+	}
+	runsLock.Unlock()
+
+	for _, state := range states {
+		state := state
+		err := run.runStep(ctx, state.Key, state.Handler, false, func(ctx context.Context) error {
+			return destroyState(ctx, project, addonType, addon, state)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	runsLock.Lock()
+	addons := []*ProjectAddon{}
+	for _, addon := range project.Addons {
+		if addon.Type != slug {
+			addons = append(addons, addon)
+		}
+	}
+	project.Addons = addons
+	runsLock.Unlock()
+
+	return nil
+}
+
+// destroyState destroys one of the states addon applied to project with the
+// handler that applied it.
+func destroyState(ctx context.Context, project *Project, addonType ProjectType, addon *ProjectAddon, state ProjectState) error {
+	env := projectEnvironment(project, state.Environment)
+	ctx = state.context(ctx)
+
+	switch state.Handler {
+	case "aws":
+		return aws.DestroyAddonInfra(ctx, project.Name, project.Repo, addonType.Repo, addonType.Path, addon.Data, env)
+	}
+
+	return fmt.Errorf("handler %s does not support destroying a state", state.Handler)
+}
+
+func returnProjectAddons(w http.ResponseWriter, r *http.Request) {
+	project, ok := lookupProject(mux.Vars(r)["id"])
+	if !ok {
+		http.Error(w, "Project Not Found", http.StatusNotFound)
+		return
+	}
+
+	runsLock.Lock()
+	defer runsLock.Unlock()
+
+	addons := project.Addons
+	if addons == nil {
+		addons = []*ProjectAddon{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(addons)
+}
+
+// applyProjectAddon applies an add-on type to an existing project.
+func applyProjectAddon(w http.ResponseWriter, r *http.Request) {
+	project, ok := lookupProject(mux.Vars(r)["id"])
+	if !ok {
+		http.Error(w, "Project Not Found", http.StatusNotFound)
+		return
+	}
+
+	var addonRequest AddonApplyRequest
+	err := json.NewDecoder(r.Body).Decode(&addonRequest)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	addonType, ok := lookupProjectType(addonRequest.Type)
+	if !ok {
+		http.Error(w, "Project Type Not Found", http.StatusNotFound)
+		return
+	}
+
+	if !addonType.Addon {
+		http.Error(w, "Project Type is not an add-on", http.StatusBadRequest)
+		return
+	}
+
+	runsLock.Lock()
+	applied := false
+	for _, addon := range project.Addons {
+		applied = applied || addon.Type == addonType.Slug
+	}
+
+	if applied {
+		runsLock.Unlock()
+		http.Error(w, "Add-on already applied", http.StatusConflict)
+		return
+	}
+
+	run := startRun(project, "addon:"+addonType.Slug)
+	if run == nil {
+		runsLock.Unlock()
+		http.Error(w, "Project has a run in progress", http.StatusConflict)
+		return
+	}
+
+	addon := &ProjectAddon{Type: addonType.Slug, Data: make(common.Data), LastRun: run.Id}
+	for key, value := range project.Data {
+		addon.Data[key] = value
+	}
+	for key, value := range addonRequest.Data {
+		addon.Data[key] = value
+	}
+
+	project.LastRun = run.Id
+	project.Addons = append(project.Addons, addon)
+	runsLock.Unlock()
+
+	go func() {
+		run.finish(applyAddon(run, project, addonType, addon))
+	}()
+
+	runsLock.Lock()
+	defer runsLock.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(addon)
+}
+
+// removeProjectAddon destroys the infrastructure an add-on applied to a
+// project and removes the add-on from it. Files its pull requests added to
+// the repo are left for the project's owners to remove.
+func removeProjectAddon(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	project, ok := lookupProject(vars["id"])
+	if !ok {
+		http.Error(w, "Project Not Found", http.StatusNotFound)
+		return
+	}
+
+	runsLock.Lock()
+	var addon *ProjectAddon
+	for _, a := range project.Addons {
+		if a.Type == vars["type"] {
+			addon = a
+		}
+	}
+
+	if addon == nil {
+		runsLock.Unlock()
+		http.Error(w, "Add-on Not Found", http.StatusNotFound)
+		return
+	}
+
+	run := startRun(project, "remove-addon:"+addon.Type)
+	if run == nil {
+		runsLock.Unlock()
+		http.Error(w, "Project has a run in progress", http.StatusConflict)
+		return
+	}
+	project.LastRun = run.Id
+	addon.LastRun = run.Id
+	runsLock.Unlock()
+
+	go func() {
+		run.finish(destroyAddon(projectContext(project, run), run, project, addon.Type))
+	}()
+
+	runsLock.Lock()
+	defer runsLock.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(addon)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	_ "embed"
+	"github.com/gorilla/mux"
+	"net/http"
+)
+
+// openAPI describes the /v1 API. TestOpenAPIContract checks it against the
+// handlers, so change both together.
+//
+//go:embed openapi.json
+var openAPI []byte
+
+// route is a route of the API. An empty Method matches any method.
+type route struct {
+	Method  string
+	Path    string
+	Handler http.HandlerFunc
+}
+
+// apiRoutes are served under /v1 and, for older clients, without a prefix.
+var apiRoutes = []route{
+	{"GET", "/project", returnAllProjects},
+	{"POST", "/project", createNewProject},
+	{"GET", "/project/{id}", returnSingleProject},
+	{"PATCH", "/project/{id}", updateProject},
+	{"DELETE", "/project/{id}", deleteSingleProject},
+
+	{"GET", "/project/{id}/runs", returnProjectRuns},
+	{"GET", "/project/{id}/runs/{run}", returnProjectRun},
+	{"POST", "/project/{id}/runs/{run}/approve", approveProjectRun},
+	{"POST", "/project/{id}/runs/{run}/reject", rejectProjectRun},
+	{"POST", "/project/{id}/runs/{run}/cancel", cancelProjectRun},
+	{"GET", "/project/{id}/runs/{run}/log", returnProjectRunLog},
+
+	{"GET", "/project/{id}/environments", returnProjectEnvironments},
+	{"POST", "/project/{id}/environments", createProjectEnvironment},
+	{"DELETE", "/project/{id}/environments/{env}", deleteProjectEnvironment},
+
+	{"GET", "/project/{id}/actions", returnProjectActions},
+	{"POST", "/project/{id}/actions/{name}", runProjectAction},
+
+	{"GET", "/project/{id}/addons", returnProjectAddons},
+	{"POST", "/project/{id}/addons", applyProjectAddon},
+	{"DELETE", "/project/{id}/addons/{type}", removeProjectAddon},
+
+	{"GET", "/project/{id}/resources", returnProjectResources},
+	{"GET", "/resources", searchResources},
+
+	{"GET", "/project/{id}/drift", returnProjectDrift},
+	{"POST", "/project/{id}/drift/reconcile", reconcileProjectDrift},
+
+	{"GET", "/type", returnAllProjectTypes},
+	{"POST", "/type", createNewProjectType},
+	{"POST", "/type/validate", validateSkeleton},
+	{"GET", "/type/{slug}", returnSingleProjectType},
+	{"GET", "/type/{slug}/inputs", returnProjectTypeInputs},
+	{"DELETE", "/type/{slug}", deleteSingleProjectType},
+}
+
+// legacyRoutes are only served without a prefix. The DELETE routes take the
+// id or slug in the request body; /v1 has them in the path instead.
+var legacyRoutes = []route{
+	{"", "/", returnHealth},
+	{"DELETE", "/project", deleteProject},
+	{"DELETE", "/type", deleteProjectType},
+	{"GET", "/metrics", returnMetrics},
+}
+
+func newRouter() *mux.Router {
+	router := mux.NewRouter().StrictSlash(true)
+
+	v1 := router.PathPrefix("/v1").Subrouter()
+	v1.HandleFunc("/openapi.json", returnOpenAPI).Methods("GET")
+	for _, route := range apiRoutes {
+		v1.HandleFunc(route.Path, route.Handler).Methods(route.Method)
+	}
+
+	for _, route := range append(legacyRoutes, apiRoutes...) {
+		r := router.HandleFunc(route.Path, route.Handler)
+		if route.Method != "" {
+			r.Methods(route.Method)
+		}
+	}
+
+	return router
+}
+
+func returnOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPI)
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/bones/server/common"
+	"github.com/gorilla/mux"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// validate checks value, decoded from JSON, against an OpenAPI schema. It
+// knows the subset of OpenAPI the spec uses, and rejects properties the
+// schema doesn't list unless it allows additional ones.
+func validate(spec map[string]interface{}, schema map[string]interface{}, value interface{}, at string) error {
+	if ref, ok := schema["$ref"].(string); ok {
+		name := strings.TrimPrefix(ref, "#/components/schemas/")
+		schemas := spec["components"].(map[string]interface{})["schemas"].(map[string]interface{})
+		target, ok := schemas[name].(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s: unknown schema %s", at, ref)
+		}
+		return validate(spec, target, value, at)
+	}
+
+	if value == nil {
+		if schema["nullable"] == true || schema["type"] == nil {
+			return nil
+		}
+		return fmt.Errorf("%s: null is not a %v", at, schema["type"])
+	}
+
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, allowed := range enum {
+			found = found || allowed == value
+		}
+		if !found {
+			return fmt.Errorf("%s: %v is not one of %v", at, value, enum)
+		}
+	}
+
+	switch schema["type"] {
+	case "string":
+		if _, ok := value.(string); !ok {
+			return fmt.Errorf("%s: %v is not a string", at, value)
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return fmt.Errorf("%s: %v is not a boolean", at, value)
+		}
+	case "integer", "number":
+		if _, ok := value.(float64); !ok {
+			return fmt.Errorf("%s: %v is not a number", at, value)
+		}
+	case "array":
+		list, ok := value.([]interface{})
+		if !ok {
+			return fmt.Errorf("%s: %v is not an array", at, value)
+		}
+		for i, item := range list {
+			err := validate(spec, schema["items"].(map[string]interface{}), item, fmt.Sprintf("%s[%d]", at, i))
+			if err != nil {
+				return err
+			}
+		}
+	case "object":
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s: %v is not an object", at, value)
+		}
+
+		required, _ := schema["required"].([]interface{})
+		for _, name := range required {
+			if _, ok := object[name.(string)]; !ok {
+				return fmt.Errorf("%s: missing %s", at, name)
+			}
+		}
+
+		properties, _ := schema["properties"].(map[string]interface{})
+		for name, property := range object {
+			propertySchema, ok := properties[name].(map[string]interface{})
+			if !ok {
+				switch additional := schema["additionalProperties"].(type) {
+				case bool:
+					if additional {
+						continue
+					}
+				case map[string]interface{}:
+					propertySchema = additional
+				}
+			}
+			if propertySchema == nil {
+				return fmt.Errorf("%s: %s is not in the spec", at, name)
+			}
+
+			err := validate(spec, propertySchema, property, at+"."+name)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// waitForRuns waits until every run of the test has finished. Tests that
+// call it start with resetState.
+func waitForRuns(t *testing.T) {
+	for i := 0; i < 200; i++ {
+		runsLock.Lock()
+		running := false
+		for _, run := range Runs {
+			running = running || run.Finished == nil
+		}
+		runsLock.Unlock()
+
+		if !running {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	t.Fatalf("expected runs to finish")
+}
+
+func TestOpenAPIContract(t *testing.T) {
+
+	resetState(t)
+
+	t.Setenv("GITHUB", "{}")
+
+	var spec map[string]interface{}
+	err := json.Unmarshal(openAPI, &spec)
+	if err != nil {
+		t.Fatalf("expected error to be nil got %v", err)
+	}
+	paths := spec["paths"].(map[string]interface{})
+
+	skeleton := skeletonRepo(t, map[string]string{
+		"app/.skeleton/skeleton.yaml": `inputs:
+  - name: REPLICAS
+    type: number
+actions:
+  - name: noop
+    description: Does nothing
+`,
+	})
+	projectRepo := skeletonRepo(t, map[string]string{".skeleton/skeleton.yaml": "generate:\n  steps: []\n"})
+	addon := skeletonRepo(t, map[string]string{"redis/.skeleton/skeleton.yaml": "inputs: []\n"})
+
+	ProjectTypes["contract-type"] = ProjectType{Slug: "contract-type", Name: "Contract", Repo: skeleton, Path: "/app", CreatedAt: time.Now()}
+	ProjectTypes["contract-addon"] = ProjectType{Slug: "contract-addon", Name: "Contract Addon", Repo: addon, Path: "/redis", Addon: true}
+	defer delete(ProjectTypes, "contract-type")
+	defer delete(ProjectTypes, "contract-addon")
+
+	Projects["contract-project"] = &Project{
+		Id: "contract-project", Name: "Contract", Type: "contract-type", Repo: projectRepo,
+		Data:      common.Data{"REPLICAS": 1.0},
+		CreatedAt: time.Now(), UpdatedAt: time.Now(),
+		Resources: []common.Resource{{StateKey: "contract/infra/aws-ecs", Address: "aws_ecs_service.app", Type: "aws_ecs_service", Name: "app", Provider: "aws"}},
+	}
+	defer delete(Projects, "contract-project")
+
+	done := newRun(Projects["contract-project"], "generate")
+	done.finish(nil)
+
+	cases := []struct {
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{"GET", "/v1/openapi.json", "", 200},
+		{"GET", "/v1/project?type=contract-type&sort=-updated", "", 200},
+		{"POST", "/v1/project", `{"type": "contract-type", "name": "Contract New", "data": {"REPLICAS": 2}}`, 200},
+		{"GET", "/v1/project/contract-project", "", 200},
+		{"PATCH", "/v1/project/contract-project", `{"desc": "changed", "data": {"REPLICAS": 3}, "labels": {"tier": "1"}}`, 200},
+		{"GET", "/v1/project/contract-project/runs", "", 200},
+		{"GET", "/v1/project/contract-project/runs/" + done.Id, "", 200},
+		{"POST", "/v1/project/contract-project/runs/" + done.Id + "/approve", "", 409},
+		{"POST", "/v1/project/contract-project/runs/" + done.Id + "/reject", "", 409},
+		{"POST", "/v1/project/contract-project/runs/" + done.Id + "/cancel", "", 409},
+		{"GET", "/v1/project/contract-project/runs/" + done.Id + "/log", "", 200},
+		{"GET", "/v1/project/contract-project/environments", "", 200},
+		{"POST", "/v1/project/contract-project/environments", `{"name": "staging", "vars": {"size": "small"}}`, 200},
+		{"DELETE", "/v1/project/contract-project/environments/staging", "", 200},
+		{"GET", "/v1/project/contract-project/actions", "", 200},
+		{"POST", "/v1/project/contract-project/actions/noop", `{"data": {}}`, 200},
+		{"GET", "/v1/project/contract-project/addons", "", 200},
+		{"POST", "/v1/project/contract-project/addons", `{"type": "contract-addon"}`, 200},
+		{"DELETE", "/v1/project/contract-project/addons/contract-addon", "", 200},
+		{"GET", "/v1/project/contract-project/resources?type=aws_ecs_service", "", 200},
+		{"GET", "/v1/resources?name=app", "", 200},
+		{"GET", "/v1/project/contract-project/drift", "", 200},
+		{"POST", "/v1/project/contract-project/drift/reconcile", "", 409},
+		{"GET", "/v1/type?name=Contract", "", 200},
+		{"POST", "/v1/type", `{"name": "Contract Extra", "repo": "https://example.com/extra", "path": "/"}`, 200},
+		{"POST", "/v1/type/validate", `{"repo": "` + skeleton + `", "path": "/app"}`, 200},
+		{"GET", "/v1/type/contract-type", "", 200},
+		{"GET", "/v1/type/contract-type/inputs", "", 200},
+		{"DELETE", "/v1/type/contract-extra", "", 200},
+		{"DELETE", "/v1/project/contract-project", "", 200},
+	}
+
+	router := newRouter()
+	covered := make(map[string]bool)
+
+	for _, c := range cases {
+		name := c.method + " " + c.path
+
+		req := httptest.NewRequest(c.method, c.path, strings.NewReader(c.body))
+
+		var match mux.RouteMatch
+		if !router.Match(req, &match) {
+			t.Errorf("%s: no route", name)
+			continue
+		}
+		template, _ := match.Route.GetPathTemplate()
+		template = strings.TrimPrefix(template, "/v1")
+
+		operation, ok := paths[template].(map[string]interface{})[strings.ToLower(c.method)].(map[string]interface{})
+		if !ok {
+			t.Errorf("%s: %s %s is not in the spec", name, c.method, template)
+			continue
+		}
+		covered[c.method+" "+template] = true
+
+		if c.body != "" {
+			var body interface{}
+			json.Unmarshal([]byte(c.body), &body)
+
+			requestBody, ok := operation["requestBody"].(map[string]interface{})
+			if !ok {
+				t.Errorf("%s: the spec has no request body", name)
+			} else {
+				schema := requestBody["content"].(map[string]interface{})["application/json"].(map[string]interface{})["schema"].(map[string]interface{})
+				if err := validate(spec, schema, body, "request"); err != nil {
+					t.Errorf("%s: %v", name, err)
+				}
+			}
+		}
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		waitForRuns(t)
+
+		res := w.Result()
+		if res.StatusCode != c.status {
+			t.Errorf("%s: expected status %v got %v: %s", name, c.status, res.StatusCode, w.Body.String())
+			continue
+		}
+
+		response, ok := operation["responses"].(map[string]interface{})[fmt.Sprint(res.StatusCode)].(map[string]interface{})
+		if !ok {
+			t.Errorf("%s: status %v is not in the spec", name, res.StatusCode)
+			continue
+		}
+
+		contentType := strings.Split(res.Header.Get("Content-Type"), ";")[0]
+		content, ok := response["content"].(map[string]interface{})[contentType].(map[string]interface{})
+		if !ok {
+			t.Errorf("%s: content type %s is not in the spec", name, contentType)
+			continue
+		}
+
+		if contentType == "application/json" {
+			var body interface{}
+			err := json.NewDecoder(res.Body).Decode(&body)
+			if err != nil {
+				t.Errorf("%s: expected error to be nil got %v", name, err)
+				continue
+			}
+
+			if err := validate(spec, content["schema"].(map[string]interface{}), body, "response"); err != nil {
+				t.Errorf("%s: %v", name, err)
+			}
+		}
+	}
+
+	for id, project := range Projects {
+		if project.Type == "contract-type" {
+			delete(Projects, id)
+		}
+	}
+
+	var routes []string
+	router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		template, _ := route.GetPathTemplate()
+		methods, _ := route.GetMethods()
+		if strings.HasPrefix(template, "/v1/") {
+			for _, method := range methods {
+				routes = append(routes, method+" "+strings.TrimPrefix(template, "/v1"))
+			}
+		}
+		return nil
+	})
+
+	for path, item := range paths {
+		for method := range item.(map[string]interface{}) {
+			routes = append(routes, strings.ToUpper(method)+" "+path)
+		}
+	}
+
+	sort.Strings(routes)
+	for _, route := range routes {
+		if !covered[route] {
+			t.Errorf("%s: expected the contract test to cover every route and spec operation", route)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+// Package client calls the /v1 bones API.
+//
+//	c := client.New("http://localhost:8080")
+//	project, err := c.GetProject(ctx, id)
+//	if errors.Is(err, client.ErrNotFound) {
+//		...
+//	}
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const apiPrefix = "/v1"
+
+// Client calls the bones server at BaseURL, e.g. http://localhost:8080.
+//
+// GET requests that fail with a network error, or with a 429, 502, 503 or
+// 504, are retried up to Retries times, waiting Backoff before the first
+// retry and twice as long before each following one. Requests that change
+// something are never retried, since the server may have acted on them.
+type Client struct {
+	BaseURL    string
+	HTTPClient *http.Client
+	Retries    int
+	Backoff    time.Duration
+}
+
+func New(baseURL string) *Client {
+	return &Client{
+		BaseURL:    strings.TrimSuffix(baseURL, "/"),
+		HTTPClient: http.DefaultClient,
+		Retries:    3,
+		Backoff:    200 * time.Millisecond,
+	}
+}
+
+// retryable reports whether a GET that got status may succeed if sent again.
+func retryable(status int) bool {
+	switch status {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+
+	return false
+}
+
+// send makes a request to the API, retrying it as described on Client. A
+// response with a status other than 2xx is returned as an *Error; otherwise
+// the caller closes the response body.
+func (c *Client) send(ctx context.Context, method string, path string, query url.Values, body interface{}) (*http.Response, error) {
+	var payload []byte
+	if body != nil {
+		var err error
+		payload, err = json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	target := c.BaseURL + apiPrefix + path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	wait := c.Backoff
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, method, target, bytes.NewReader(payload))
+		if err != nil {
+			return nil, err
+		}
+		if body != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+
+		res, err := httpClient.Do(req)
+
+		retry := method == http.MethodGet && attempt < c.Retries && ctx.Err() == nil
+		if err == nil {
+			retry = retry && retryable(res.StatusCode)
+		}
+
+		if !retry {
+			if err != nil {
+				return nil, err
+			}
+			if res.StatusCode < 200 || res.StatusCode > 299 {
+				defer res.Body.Close()
+				return nil, responseError(res)
+			}
+			return res, nil
+		}
+
+		if res != nil {
+			io.Copy(io.Discard, res.Body)
+			res.Body.Close()
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+		wait *= 2
+	}
+}
+
+// do makes a request to the API and decodes its JSON response into out,
+// unless out is nil.
+func (c *Client) do(ctx context.Context, method string, path string, query url.Values, body interface{}, out interface{}) error {
+	res, err := c.send(ctx, method, path, query, body)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if out == nil {
+		return nil
+	}
+
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+// escape joins path segments, escaping each one.
+func escape(segments ...string) string {
+	var path strings.Builder
+	for _, segment := range segments {
+		path.WriteString("/" + url.PathEscape(segment))
+	}
+
+	return path.String()
+}
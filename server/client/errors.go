@@ -0,0 +1,52 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// The errors an *Error matches with errors.Is, one per status the server
+// answers with.
+var (
+	ErrBadRequest = errors.New("bad request")
+	ErrNotFound   = errors.New("not found")
+	ErrConflict   = errors.New("conflict")
+	ErrServer     = errors.New("server error")
+)
+
+// Error is a response of the API with a status other than 2xx. Message is the
+// text the server answered with, e.g. "Project has a run in progress".
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("bones: %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// Is matches the sentinel error of e's status: a missing project or type is
+// ErrNotFound, a project with a run in progress ErrConflict, and so on.
+func (e *Error) Is(target error) bool {
+	switch target {
+	case ErrBadRequest:
+		return e.StatusCode == http.StatusBadRequest
+	case ErrNotFound:
+		return e.StatusCode == http.StatusNotFound
+	case ErrConflict:
+		return e.StatusCode == http.StatusConflict
+	case ErrServer:
+		return e.StatusCode >= 500
+	}
+
+	return false
+}
+
+func responseError(res *http.Response) error {
+	message, _ := io.ReadAll(io.LimitReader(res.Body, 64*1024))
+
+	return &Error{StatusCode: res.StatusCode, Message: strings.TrimSpace(string(message))}
+}
@@ -0,0 +1,3 @@
+module bones/server/client
+
+go 1.18
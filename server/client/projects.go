@@ -0,0 +1,189 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// ListOptions sorts and pages a listing. Sort is created (the default),
+// updated or name, with a leading - for descending order. Cursor is the Next
+// of the previous page.
+type ListOptions struct {
+	Sort   string
+	Limit  int
+	Cursor string
+}
+
+func (o ListOptions) query() url.Values {
+	query := url.Values{}
+	if o.Sort != "" {
+		query.Set("sort", o.Sort)
+	}
+	if o.Limit > 0 {
+		query.Set("limit", strconv.Itoa(o.Limit))
+	}
+	if o.Cursor != "" {
+		query.Set("cursor", o.Cursor)
+	}
+
+	return query
+}
+
+// ProjectFilter selects the projects of a listing. Status is that of the
+// project's last run, Name a prefix of its name, and each of Labels either
+// key=value or a bare key that only needs to be set.
+type ProjectFilter struct {
+	ListOptions
+	Type   string
+	Owner  string
+	Status RunStatus
+	Name   string
+	Labels []string
+}
+
+// ProjectTypeFilter selects the project types of a listing. Name is a prefix
+// of their name; Addon, when set, selects add-on or regular types only.
+type ProjectTypeFilter struct {
+	ListOptions
+	Name  string
+	Addon *bool
+}
+
+func (c *Client) ListProjects(ctx context.Context, filter ProjectFilter) (*ProjectList, error) {
+	query := filter.query()
+	for key, value := range map[string]string{"type": filter.Type, "owner": filter.Owner, "status": string(filter.Status), "name": filter.Name} {
+		if value != "" {
+			query.Set(key, value)
+		}
+	}
+	for _, label := range filter.Labels {
+		query.Add("label", label)
+	}
+
+	var list ProjectList
+	err := c.do(ctx, http.MethodGet, "/project", query, nil, &list)
+	if err != nil {
+		return nil, err
+	}
+
+	return &list, nil
+}
+
+func (c *Client) GetProject(ctx context.Context, id string) (*Project, error) {
+	var project Project
+	err := c.do(ctx, http.MethodGet, escape("project", id), nil, nil, &project)
+	if err != nil {
+		return nil, err
+	}
+
+	return &project, nil
+}
+
+// CreateProject creates a project and starts its generate run, whose id is
+// the returned project's LastRun.
+func (c *Client) CreateProject(ctx context.Context, request ProjectCreateRequest) (*Project, error) {
+	var project Project
+	err := c.do(ctx, http.MethodPost, "/project", nil, request, &project)
+	if err != nil {
+		return nil, err
+	}
+
+	return &project, nil
+}
+
+// UpdateProject changes a project. A change of its data starts an update
+// run, whose id is the returned project's LastRun.
+func (c *Client) UpdateProject(ctx context.Context, id string, request ProjectUpdateRequest) (*Project, error) {
+	var project Project
+	err := c.do(ctx, http.MethodPatch, escape("project", id), nil, request, &project)
+	if err != nil {
+		return nil, err
+	}
+
+	return &project, nil
+}
+
+// DeleteProject starts destroying a project's infrastructure and removes it.
+func (c *Client) DeleteProject(ctx context.Context, id string) (*Project, error) {
+	var project Project
+	err := c.do(ctx, http.MethodDelete, escape("project", id), nil, nil, &project)
+	if err != nil {
+		return nil, err
+	}
+
+	return &project, nil
+}
+
+func (c *Client) ListProjectTypes(ctx context.Context, filter ProjectTypeFilter) (*ProjectTypeList, error) {
+	query := filter.query()
+	if filter.Name != "" {
+		query.Set("name", filter.Name)
+	}
+	if filter.Addon != nil {
+		query.Set("addon", strconv.FormatBool(*filter.Addon))
+	}
+
+	var list ProjectTypeList
+	err := c.do(ctx, http.MethodGet, "/type", query, nil, &list)
+	if err != nil {
+		return nil, err
+	}
+
+	return &list, nil
+}
+
+func (c *Client) GetProjectType(ctx context.Context, slug string) (*ProjectType, error) {
+	var projectType ProjectType
+	err := c.do(ctx, http.MethodGet, escape("type", slug), nil, nil, &projectType)
+	if err != nil {
+		return nil, err
+	}
+
+	return &projectType, nil
+}
+
+func (c *Client) CreateProjectType(ctx context.Context, request ProjectTypeCreateRequest) (*ProjectType, error) {
+	var projectType ProjectType
+	err := c.do(ctx, http.MethodPost, "/type", nil, request, &projectType)
+	if err != nil {
+		return nil, err
+	}
+
+	return &projectType, nil
+}
+
+// ValidateSkeleton checks a skeleton before it is added as a project type.
+// Problems found are in the result; an error means it couldn't be checked.
+func (c *Client) ValidateSkeleton(ctx context.Context, request SkeletonValidateRequest) (*SkeletonValidation, error) {
+	var validation SkeletonValidation
+	err := c.do(ctx, http.MethodPost, "/type/validate", nil, request, &validation)
+	if err != nil {
+		return nil, err
+	}
+
+	return &validation, nil
+}
+
+func (c *Client) DeleteProjectType(ctx context.Context, slug string) (*ProjectType, error) {
+	var projectType ProjectType
+	err := c.do(ctx, http.MethodDelete, escape("type", slug), nil, nil, &projectType)
+	if err != nil {
+		return nil, err
+	}
+
+	return &projectType, nil
+}
+
+// ListProjectTypeInputs returns the inputs a project of the type takes, as
+// declared by the skeleton at the head of its repo.
+func (c *Client) ListProjectTypeInputs(ctx context.Context, slug string) ([]*Input, error) {
+	var inputs []*Input
+	err := c.do(ctx, http.MethodGet, escape("type", slug, "inputs"), nil, nil, &inputs)
+	if err != nil {
+		return nil, err
+	}
+
+	return inputs, nil
+}
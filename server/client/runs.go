@@ -0,0 +1,104 @@
+package client
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+func (c *Client) ListRuns(ctx context.Context, projectId string) ([]*Run, error) {
+	var runs []*Run
+	err := c.do(ctx, http.MethodGet, escape("project", projectId, "runs"), nil, nil, &runs)
+	if err != nil {
+		return nil, err
+	}
+
+	return runs, nil
+}
+
+func (c *Client) GetRun(ctx context.Context, projectId string, runId string) (*Run, error) {
+	var run Run
+	err := c.do(ctx, http.MethodGet, escape("project", projectId, "runs", runId), nil, nil, &run)
+	if err != nil {
+		return nil, err
+	}
+
+	return &run, nil
+}
+
+func (c *Client) decideRun(ctx context.Context, projectId string, runId string, decision string) (*Run, error) {
+	var run Run
+	err := c.do(ctx, http.MethodPost, escape("project", projectId, "runs", runId, decision), nil, nil, &run)
+	if err != nil {
+		return nil, err
+	}
+
+	return &run, nil
+}
+
+// ApproveRun applies the plan a run is waiting on. A run that isn't awaiting
+// approval is ErrConflict.
+func (c *Client) ApproveRun(ctx context.Context, projectId string, runId string) (*Run, error) {
+	return c.decideRun(ctx, projectId, runId, "approve")
+}
+
+// RejectRun discards the plan a run is waiting on, failing the run.
+func (c *Client) RejectRun(ctx context.Context, projectId string, runId string) (*Run, error) {
+	return c.decideRun(ctx, projectId, runId, "reject")
+}
+
+// CancelRun stops a run that hasn't finished.
+func (c *Client) CancelRun(ctx context.Context, projectId string, runId string) (*Run, error) {
+	return c.decideRun(ctx, projectId, runId, "cancel")
+}
+
+// RunLog returns a run's output from byte offset on, with the run's status.
+// To tail a run, call it again with offset advanced by the length of the
+// output until the status is Done.
+func (c *Client) RunLog(ctx context.Context, projectId string, runId string, offset int) ([]byte, RunStatus, error) {
+	query := url.Values{"offset": {strconv.Itoa(offset)}}
+
+	res, err := c.send(ctx, http.MethodGet, escape("project", projectId, "runs", runId, "log"), query, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	defer res.Body.Close()
+
+	output, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return output, RunStatus(res.Header.Get("X-Run-Status")), nil
+}
+
+func (c *Client) ListActions(ctx context.Context, projectId string) ([]*Action, error) {
+	var actions []*Action
+	err := c.do(ctx, http.MethodGet, escape("project", projectId, "actions"), nil, nil, &actions)
+	if err != nil {
+		return nil, err
+	}
+
+	return actions, nil
+}
+
+// RunAction starts a day-2 action of a project's skeleton with data for its
+// inputs.
+func (c *Client) RunAction(ctx context.Context, projectId string, name string, data Data) (*Run, error) {
+	request := struct {
+		Data Data `json:"data"`
+	}{data}
+	if data == nil {
+		request.Data = Data{}
+	}
+
+	var run Run
+	err := c.do(ctx, http.MethodPost, escape("project", projectId, "actions", name), nil, request, &run)
+	if err != nil {
+		return nil, err
+	}
+
+	return &run, nil
+}
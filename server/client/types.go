@@ -0,0 +1,219 @@
+package client
+
+import (
+	"time"
+)
+
+// Data is the data of a project, keyed by input name. Values are typed as in
+// JSON: strings, float64 numbers, bools, lists and maps.
+type Data map[string]interface{}
+
+type Project struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+	Type string `json:"type"`
+	Desc string `json:"desc"`
+	Repo string `json:"repo"`
+	Data Data   `json:"data"`
+
+	Owners       []string                `json:"owners,omitempty"`
+	Labels       map[string]string       `json:"labels,omitempty"`
+	CreatedAt    time.Time               `json:"createdAt"`
+	UpdatedAt    time.Time               `json:"updatedAt"`
+	SkeletonRef  string                  `json:"skeletonRef,omitempty"`
+	LastRun      string                  `json:"lastRun,omitempty"`
+	States       []ProjectState          `json:"states,omitempty"`
+	Resources    []Resource              `json:"resources,omitempty"`
+	Drift        *ProjectDrift           `json:"drift,omitempty"`
+	Environments map[string]*Environment `json:"environments,omitempty"`
+	Outputs      map[string]interface{}  `json:"outputs,omitempty"`
+	Addons       []*ProjectAddon         `json:"addons,omitempty"`
+}
+
+type ProjectState struct {
+	Handler     string      `json:"handler"`
+	Key         string      `json:"key"`
+	Environment string      `json:"environment,omitempty"`
+	Each        string      `json:"each,omitempty"`
+	EachValue   interface{} `json:"each_value,omitempty"`
+	EachIndex   int         `json:"each_index,omitempty"`
+	Addon       string      `json:"addon,omitempty"`
+	Gated       bool        `json:"gated,omitempty"`
+}
+
+type ProjectList struct {
+	Items []*Project `json:"items"`
+	Next  string     `json:"next,omitempty"`
+}
+
+type ProjectCreateRequest struct {
+	Type   string            `json:"type"`
+	Name   string            `json:"name"`
+	Desc   string            `json:"desc,omitempty"`
+	Data   Data              `json:"data,omitempty"`
+	Owners []string          `json:"owners,omitempty"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// ProjectUpdateRequest changes the fields that are set. Data is merged into
+// the project's data, and a nil value removes its key.
+type ProjectUpdateRequest struct {
+	Desc   *string            `json:"desc,omitempty"`
+	Data   Data               `json:"data,omitempty"`
+	Owners *[]string          `json:"owners,omitempty"`
+	Labels *map[string]string `json:"labels,omitempty"`
+}
+
+type ProjectType struct {
+	Slug string `json:"slug"`
+	Name string `json:"name"`
+	Desc string `json:"desc"`
+	Repo string `json:"repo"`
+	Path string `json:"path"`
+
+	Addon     bool            `json:"addon,omitempty"`
+	Terraform TerraformBinary `json:"terraform"`
+	CreatedAt time.Time       `json:"createdAt"`
+}
+
+type ProjectTypeList struct {
+	Items []*ProjectType `json:"items"`
+	Next  string         `json:"next,omitempty"`
+}
+
+type ProjectTypeCreateRequest struct {
+	Name string `json:"name"`
+	Desc string `json:"desc,omitempty"`
+	Repo string `json:"repo"`
+	Path string `json:"path"`
+
+	Addon     bool            `json:"addon,omitempty"`
+	Terraform TerraformBinary `json:"terraform"`
+}
+
+type SkeletonValidateRequest struct {
+	Repo  string `json:"repo"`
+	Path  string `json:"path,omitempty"`
+	Ref   string `json:"ref,omitempty"`
+	Addon bool   `json:"addon,omitempty"`
+}
+
+type SkeletonValidation struct {
+	Valid    bool      `json:"valid"`
+	Problems []Problem `json:"problems"`
+}
+
+// Problem is something wrong with a skeleton. Line and Column are 0 when the
+// position isn't known.
+type Problem struct {
+	File    string `json:"file"`
+	Line    int    `json:"line,omitempty"`
+	Column  int    `json:"column,omitempty"`
+	Message string `json:"message"`
+}
+
+type TerraformBinary struct {
+	Tool    string `json:"tool,omitempty"`
+	Version string `json:"version,omitempty"`
+	Path    string `json:"path,omitempty"`
+}
+
+type RunStatus string
+
+const (
+	RunRunning          RunStatus = "running"
+	RunAwaitingApproval RunStatus = "awaiting_approval"
+	RunSucceeded        RunStatus = "succeeded"
+	RunFailed           RunStatus = "failed"
+	RunRejected         RunStatus = "rejected"
+	RunCancelled        RunStatus = "cancelled"
+	RunSkipped          RunStatus = "skipped"
+)
+
+// Done reports whether a run with status s has finished, as opposed to
+// running or waiting for approval.
+func (s RunStatus) Done() bool {
+	return s != RunRunning && s != RunAwaitingApproval
+}
+
+type Run struct {
+	Id        string     `json:"id"`
+	ProjectId string     `json:"project"`
+	Action    string     `json:"action"`
+	Status    RunStatus  `json:"status"`
+	Steps     []*RunStep `json:"steps"`
+	Approval  *Approval  `json:"approval,omitempty"`
+	Error     string     `json:"error,omitempty"`
+	Started   time.Time  `json:"started"`
+	Finished  *time.Time `json:"finished,omitempty"`
+}
+
+type RunStep struct {
+	Name    string    `json:"name"`
+	Handler string    `json:"handler"`
+	Status  RunStatus `json:"status"`
+	Error   string    `json:"error,omitempty"`
+	Reason  string    `json:"reason,omitempty"`
+}
+
+// Approval is the plan a run waits on, as the changes it makes.
+type Approval struct {
+	Step     string   `json:"step"`
+	StateKey string   `json:"stateKey"`
+	Changes  []string `json:"changes"`
+	Decision string   `json:"decision,omitempty"`
+}
+
+type Action struct {
+	Name        string  `json:"name"`
+	Description string  `json:"description,omitempty"`
+	Inputs      []Input `json:"inputs,omitempty"`
+}
+
+type Input struct {
+	Name        string      `json:"name"`
+	Type        string      `json:"type,omitempty"`
+	Description string      `json:"description,omitempty"`
+	Required    bool        `json:"required,omitempty"`
+	Default     interface{} `json:"default,omitempty"`
+}
+
+type Environment struct {
+	Name    string            `json:"name"`
+	Vars    map[string]string `json:"vars"`
+	LastRun string            `json:"lastRun,omitempty"`
+}
+
+type ProjectAddon struct {
+	Type        string `json:"type"`
+	Data        Data   `json:"data"`
+	SkeletonRef string `json:"skeletonRef,omitempty"`
+	PullRequest string `json:"pullRequest,omitempty"`
+	LastRun     string `json:"lastRun,omitempty"`
+
+	InfraPullRequests []string `json:"infraPullRequests,omitempty"`
+}
+
+type Resource struct {
+	StateKey string `json:"stateKey"`
+	Address  string `json:"address"`
+	Type     string `json:"type"`
+	Name     string `json:"name"`
+	Provider string `json:"provider"`
+	Id       string `json:"id,omitempty"`
+	Arn      string `json:"arn,omitempty"`
+}
+
+type Drift struct {
+	StateKey string    `json:"stateKey"`
+	Drifted  bool      `json:"drifted"`
+	Changes  []string  `json:"changes,omitempty"`
+	Checked  time.Time `json:"checked"`
+	Error    string    `json:"error,omitempty"`
+}
+
+type ProjectDrift struct {
+	Checked time.Time `json:"checked"`
+	Drifted bool      `json:"drifted"`
+	States  []*Drift  `json:"states"`
+}
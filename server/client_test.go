@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/bones/server/client"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestClient(t *testing.T) {
+
+	resetState(t)
+
+	t.Setenv("GITHUB", "{}")
+
+	server := httptest.NewServer(newRouter())
+	defer server.Close()
+
+	c := client.New(server.URL)
+	ctx := context.Background()
+
+	skeleton := skeletonRepo(t, map[string]string{
+		"app/.skeleton/skeleton.yaml": `inputs:
+  - name: REPLICAS
+    type: number
+actions:
+  - name: noop
+    description: Does nothing
+`,
+	})
+
+	projectType, err := c.CreateProjectType(ctx, client.ProjectTypeCreateRequest{Name: "Client Type", Repo: skeleton, Path: "/app"})
+	if err != nil {
+		t.Fatalf("expected error to be nil got %v", err)
+	}
+	defer delete(ProjectTypes, projectType.Slug)
+
+	if projectType.Slug != "client-type" {
+		t.Errorf("expected client-type got %v", projectType.Slug)
+	}
+
+	types, err := c.ListProjectTypes(ctx, client.ProjectTypeFilter{Name: "Client"})
+	if err != nil || len(types.Items) != 1 || types.Items[0].Slug != "client-type" {
+		t.Errorf("expected client-type to be listed got %v %v", types, err)
+	}
+
+	inputs, err := c.ListProjectTypeInputs(ctx, "client-type")
+	if err != nil || len(inputs) != 1 || inputs[0].Name != "REPLICAS" || inputs[0].Type != "number" {
+		t.Errorf("expected the REPLICAS input got %v %v", inputs, err)
+	}
+
+	validation, err := c.ValidateSkeleton(ctx, client.SkeletonValidateRequest{Repo: skeleton, Path: "/app"})
+	if err != nil || !validation.Valid || len(validation.Problems) != 0 {
+		t.Errorf("expected the skeleton to be valid got %v %v", validation, err)
+	}
+
+	_, err = c.CreateProject(ctx, client.ProjectCreateRequest{Type: "missing-type", Name: "Client"})
+	if !errors.Is(err, client.ErrNotFound) {
+		t.Errorf("expected ErrNotFound got %v", err)
+	}
+
+	var clientErr *client.Error
+	if !errors.As(err, &clientErr) || clientErr.StatusCode != http.StatusNotFound || clientErr.Message != "Project Type Not Found" {
+		t.Errorf("expected a 404 Project Type Not Found got %#v", clientErr)
+	}
+
+	project, err := c.CreateProject(ctx, client.ProjectCreateRequest{
+		Type: "client-type", Name: "Client Project",
+		Data:   client.Data{"REPLICAS": 2},
+		Labels: map[string]string{"tier": "1"},
+	})
+	if err != nil {
+		t.Fatalf("expected error to be nil got %v", err)
+	}
+	waitForRuns(t)
+
+	list, err := c.ListProjects(ctx, client.ProjectFilter{Type: "client-type", Labels: []string{"tier=1"}})
+	if err != nil || len(list.Items) != 1 || list.Items[0].Id != project.Id {
+		t.Errorf("expected the project to be listed got %v %v", list, err)
+	}
+
+	desc := "changed"
+	project, err = c.UpdateProject(ctx, project.Id, client.ProjectUpdateRequest{Desc: &desc})
+	if err != nil || project.Desc != "changed" {
+		t.Errorf("expected desc to be changed got %v %v", project, err)
+	}
+
+	runs, err := c.ListRuns(ctx, project.Id)
+	if err != nil || len(runs) != 1 || runs[0].Action != "generate" {
+		t.Fatalf("expected the generate run got %v %v", runs, err)
+	}
+
+	run, err := c.GetRun(ctx, project.Id, runs[0].Id)
+	if err != nil || !run.Status.Done() {
+		t.Errorf("expected a finished run got %v %v", run, err)
+	}
+
+	_, status, err := c.RunLog(ctx, project.Id, run.Id, 0)
+	if err != nil || status != run.Status {
+		t.Errorf("expected log status %v got %v %v", run.Status, status, err)
+	}
+
+	_, err = c.ApproveRun(ctx, project.Id, run.Id)
+	if !errors.Is(err, client.ErrConflict) {
+		t.Errorf("expected ErrConflict got %v", err)
+	}
+
+	actions, err := c.ListActions(ctx, project.Id)
+	if err != nil || len(actions) != 1 || actions[0].Name != "noop" {
+		t.Errorf("expected the noop action got %v %v", actions, err)
+	}
+
+	run, err = c.RunAction(ctx, project.Id, "noop", nil)
+	if err != nil || run.Action != "action:noop" {
+		t.Errorf("expected the noop run got %v %v", run, err)
+	}
+	waitForRuns(t)
+
+	_, err = c.RunAction(ctx, project.Id, "missing", nil)
+	if !errors.Is(err, client.ErrNotFound) {
+		t.Errorf("expected ErrNotFound got %v", err)
+	}
+
+	// The skeleton has no github step, so give the project a repo to destroy.
+	projectRepo := skeletonRepo(t, map[string]string{".skeleton/skeleton.yaml": "destroy:\n  steps: []\n"})
+	runsLock.Lock()
+	Projects[project.Id].Repo = projectRepo
+	runsLock.Unlock()
+
+	_, err = c.DeleteProject(ctx, project.Id)
+	if err != nil {
+		t.Errorf("expected error to be nil got %v", err)
+	}
+	waitForRuns(t)
+
+	_, err = c.GetProject(ctx, project.Id)
+	if !errors.Is(err, client.ErrNotFound) {
+		t.Errorf("expected ErrNotFound got %v", err)
+	}
+
+	_, err = c.DeleteProjectType(ctx, "client-type")
+	if err != nil {
+		t.Errorf("expected error to be nil got %v", err)
+	}
+
+	_, err = c.GetProjectType(ctx, "client-type")
+	if !errors.Is(err, client.ErrNotFound) {
+		t.Errorf("expected ErrNotFound got %v", err)
+	}
+}
+
+func TestClientRetries(t *testing.T) {
+
+	resetState(t)
+
+	router := newRouter()
+
+	var requests int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt64(&requests, 1) <= 2 {
+			http.Error(w, "Unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		router.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	c := client.New(server.URL)
+	c.Backoff = time.Millisecond
+
+	_, err := c.ListProjectTypes(context.Background(), client.ProjectTypeFilter{})
+	if err != nil {
+		t.Errorf("expected error to be nil got %v", err)
+	}
+	if atomic.LoadInt64(&requests) != 3 {
+		t.Errorf("expected 3 requests got %v", atomic.LoadInt64(&requests))
+	}
+
+	// Requests that change something aren't retried.
+	atomic.StoreInt64(&requests, 0)
+	_, err = c.CreateProjectType(context.Background(), client.ProjectTypeCreateRequest{Name: "Retried"})
+	if !errors.Is(err, client.ErrServer) {
+		t.Errorf("expected ErrServer got %v", err)
+	}
+	if atomic.LoadInt64(&requests) != 1 {
+		t.Errorf("expected 1 request got %v", atomic.LoadInt64(&requests))
+	}
+
+	// The context ends the retries.
+	atomic.StoreInt64(&requests, 0)
+	c.Backoff = time.Hour
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err = c.GetProjectType(ctx, "missing")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected context.DeadlineExceeded got %v", err)
+	}
+	if atomic.LoadInt64(&requests) != 1 {
+		t.Errorf("expected 1 request got %v", atomic.LoadInt64(&requests))
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/bones/server/client"
+	"gopkg.in/yaml.v3"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// listFlag is a flag that can be given more than once, e.g. -set A=1 -set B=2.
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// parseValue parses text typed as a value of input, in the server's formats:
+// list and object values are JSON.
+func parseValue(input *client.Input, text string) (interface{}, error) {
+	switch input.Type {
+	case "", "string":
+		return text, nil
+	case "bool":
+		return strconv.ParseBool(text)
+	case "number":
+		return strconv.ParseFloat(text, 64)
+	case "list":
+		var list []interface{}
+		err := json.Unmarshal([]byte(text), &list)
+		return list, err
+	case "object":
+		var object map[string]interface{}
+		err := json.Unmarshal([]byte(text), &object)
+		return object, err
+	}
+
+	return nil, fmt.Errorf("input %s has unknown type %q", input.Name, input.Type)
+}
+
+// readDataFile reads project data from a YAML (or JSON) file of keys and
+// values.
+func readDataFile(path string) (client.Data, error) {
+	text, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	data := client.Data{}
+	err = yaml.Unmarshal(text, &data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	return data, nil
+}
+
+// inputData gathers the data of a project. It starts from the file, if
+// given, then applies each KEY=VALUE of sets, parsed as the type of the input
+// of that name. When prompt is set, it asks on out for each input still
+// missing and reads the answers from in; otherwise a required input without a
+// default that is still missing is an error.
+func inputData(inputs []*client.Input, file string, sets []string, prompt bool, in io.Reader, out io.Writer) (client.Data, error) {
+	data := client.Data{}
+	if file != "" {
+		var err error
+		data, err = readDataFile(file)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	byName := make(map[string]*client.Input)
+	for _, input := range inputs {
+		byName[input.Name] = input
+	}
+
+	for _, set := range sets {
+		key, text, ok := strings.Cut(set, "=")
+		if !ok {
+			return nil, usageError(fmt.Sprintf("-set %s is not KEY=VALUE", set))
+		}
+
+		input, ok := byName[key]
+		if !ok {
+			// Undeclared keys are kept as they are, like the server does.
+			data[key] = text
+			continue
+		}
+
+		value, err := parseValue(input, text)
+		if err != nil {
+			return nil, fmt.Errorf("input %s must be a %s: %v", key, input.Type, err)
+		}
+		data[key] = value
+	}
+
+	answers := bufio.NewScanner(in)
+	for _, input := range inputs {
+		if _, ok := data[input.Name]; ok {
+			continue
+		}
+
+		if !prompt {
+			if input.Required && input.Default == nil {
+				return nil, fmt.Errorf("input %s is required", input.Name)
+			}
+			continue
+		}
+
+		value, err := ask(input, answers, out)
+		if err != nil {
+			return nil, err
+		}
+		if value != nil {
+			data[input.Name] = value
+		}
+	}
+
+	return data, nil
+}
+
+// ask prompts for the value of input until it gets a valid one. An empty
+// answer leaves the input to its default, or unset when it isn't required.
+func ask(input *client.Input, answers *bufio.Scanner, out io.Writer) (interface{}, error) {
+	prompt := input.Name
+	if input.Description != "" {
+		prompt += " (" + input.Description + ")"
+	}
+	if input.Type != "" && input.Type != "string" {
+		prompt += " [" + input.Type + "]"
+	}
+	if input.Default != nil {
+		prompt += fmt.Sprintf(" default %v", input.Default)
+	}
+
+	for {
+		fmt.Fprintf(out, "%s: ", prompt)
+
+		if !answers.Scan() {
+			if err := answers.Err(); err != nil {
+				return nil, err
+			}
+			return nil, fmt.Errorf("no value for input %s", input.Name)
+		}
+
+		text := strings.TrimSpace(answers.Text())
+		if text == "" {
+			if input.Default != nil || !input.Required {
+				return nil, nil
+			}
+			fmt.Fprintf(out, "%s is required\n", input.Name)
+			continue
+		}
+
+		value, err := parseValue(input, text)
+		if err != nil {
+			fmt.Fprintf(out, "%s must be a %s\n", input.Name, input.Type)
+			continue
+		}
+
+		return value, nil
+	}
+}
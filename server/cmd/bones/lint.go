@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/bones/server/common"
+	"os"
+	"skeletonarmydev/bones/render"
+)
+
+// lintSkeleton reports the problems of a skeleton, one per line with its
+// file and position, and fails when there are any.
+func lintSkeleton(ctx context.Context, cli *cli, args []string) error {
+	flags := flag.NewFlagSet("lint", flag.ContinueOnError)
+	flags.SetOutput(cli.out)
+
+	skeleton := flags.String("skeleton", ".", "Directory or repo of the skeleton")
+	path := flags.String("path", "/", "Path of the skeleton in the directory or repo")
+	ref := flags.String("ref", "", "Branch, tag or commit of a skeleton repo, HEAD by default")
+	addon := flags.Bool("addon", false, "Lint the skeleton of an add-on type")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	ctx, s, err := render.Open(ctx, *skeleton, *path, *ref)
+	if err != nil {
+		return err
+	}
+
+	own, err := s.Manifest(ctx)
+	if err != nil {
+		return err
+	}
+
+	options := common.LintOptions{Addon: *addon}
+
+	var problems []common.Problem
+	dir, err := s.Checkout(ctx)
+	if err != nil {
+		// A manifest that doesn't parse can't be composed either.
+		problems = common.LintSkeleton("", own, options)
+		if len(problems) == 0 {
+			return err
+		}
+	} else {
+		defer os.RemoveAll(dir)
+		problems = common.LintSkeleton(dir+s.Path, own, options)
+	}
+
+	for _, problem := range problems {
+		fmt.Fprintln(cli.out, problem)
+	}
+
+	switch len(problems) {
+	case 0:
+		fmt.Fprintln(cli.out, "No problems found")
+		return nil
+	case 1:
+		return fmt.Errorf("1 problem found")
+	}
+
+	return fmt.Errorf("%d problems found", len(problems))
+}
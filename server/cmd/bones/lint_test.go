@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"skeletonarmydev/bones/skeletontest"
+	"strings"
+	"testing"
+)
+
+func TestLintSkeleton(t *testing.T) {
+
+	root := t.TempDir()
+	skeletontest.WriteFiles(t, root, map[string]string{
+		"base/.skeleton/skeleton.yaml": "generate:\n  steps:\n    - name: repo\n      handler: github\n",
+		"app/.skeleton/skeleton.yaml": `include:
+  - path: /base
+generate:
+  steps:
+    - name: infra
+      handler: aws
+      depends_on: [repo]
+`,
+		"app/infra/aws-ecs/main.tf": "# {{ .APP_NAME }\n",
+	})
+
+	out := new(bytes.Buffer)
+	err := run(context.Background(), []string{"lint", "-skeleton", root, "-path", "/app"}, strings.NewReader(""), out)
+	if err == nil || err.Error() != "1 problem found" {
+		t.Errorf("expected one problem got %v", err)
+	}
+	if out.String() != "infra/aws-ecs/main.tf:1: unexpected \"}\" in operand\n" {
+		t.Errorf("expected the template problem got %q", out.String())
+	}
+
+	skeletontest.WriteFiles(t, root, map[string]string{"app/infra/aws-ecs/main.tf": "# {{ .APP_NAME }}\n"})
+
+	out.Reset()
+	err = run(context.Background(), []string{"lint", "-skeleton", root, "-path", "/app"}, strings.NewReader(""), out)
+	if err != nil || out.String() != "No problems found\n" {
+		t.Errorf("expected no problems got %v %q", err, out.String())
+	}
+
+	// A manifest that doesn't parse is reported, though it can't be composed.
+	skeletontest.WriteFiles(t, root, map[string]string{"app/.skeleton/skeleton.yaml": "include:\n  - path: [\n"})
+
+	out.Reset()
+	err = run(context.Background(), []string{"lint", "-skeleton", root, "-path", "/app"}, strings.NewReader(""), out)
+	if err == nil || !strings.HasPrefix(out.String(), ".skeleton/skeleton.yaml:") {
+		t.Errorf("expected a syntax error got %v %q", err, out.String())
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/bones/server/client"
+	"time"
+)
+
+// pollInterval is how often a run's log is polled while it runs.
+var pollInterval = time.Second
+
+// tailRun copies the output of a run to out as it is written, until the run
+// has finished, and returns the finished run.
+func tailRun(ctx context.Context, cli *cli, projectId string, runId string) (*client.Run, error) {
+	offset := 0
+	var last client.RunStatus
+
+	for {
+		output, status, err := cli.client.RunLog(ctx, projectId, runId, offset)
+		if err != nil {
+			return nil, err
+		}
+		cli.out.Write(output)
+		offset += len(output)
+
+		if status.Done() {
+			return cli.client.GetRun(ctx, projectId, runId)
+		}
+
+		if status == client.RunAwaitingApproval && last != status {
+			fmt.Fprintf(cli.out, "Run %s is awaiting approval of its plan\n", runId)
+		}
+		last = status
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+// follow tails a run and fails unless it succeeded.
+func follow(ctx context.Context, cli *cli, projectId string, runId string) error {
+	run, err := tailRun(ctx, cli, projectId, runId)
+	if err != nil {
+		return err
+	}
+
+	if run.Status != client.RunSucceeded {
+		if run.Error != "" {
+			return fmt.Errorf("run %s %s: %s", run.Id, run.Status, run.Error)
+		}
+		return fmt.Errorf("run %s %s", run.Id, run.Status)
+	}
+
+	fmt.Fprintf(cli.out, "Run %s succeeded\n", run.Id)
+	return nil
+}
@@ -0,0 +1,143 @@
+// Command bones is the command-line client of the bones server.
+//
+//	bones [-server URL] type list|add|rm
+//	bones [-server URL] project create|list|show|delete|logs
+//	bones render -skeleton DIR|REPO -data answers.yaml -out DIR
+//	bones lint -skeleton DIR|REPO
+//	bones test -skeleton DIR|REPO [-update]
+//
+// The server defaults to $BONES_SERVER, or http://localhost:8080.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/bones/server/client"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+)
+
+const defaultServer = "http://localhost:8080"
+
+const usage = `Usage: bones [-server URL] <command> [flags] [args]
+
+Commands:
+  type list                    List project types
+  type add -name N -repo R     Add a project type
+  type rm SLUG                 Remove a project type
+
+  project create -type T -name N [-set KEY=VALUE] [-f data.yaml] [-i]
+                               Create a project and follow its generate run
+  project list                 List projects
+  project show ID              Show a project
+  project delete ID            Destroy a project and follow the run
+  project logs ID [RUN]        Follow a run of a project, its last by default
+
+  render -skeleton DIR|REPO [-path P] [-data answers.yaml] [-set KEY=VALUE] -out DIR
+                               Render a skeleton locally, without a server
+  lint -skeleton DIR|REPO [-path P] [-ref REF] [-addon]
+                               Check a skeleton for problems, without a server
+  test -skeleton DIR|REPO [-path P] [-run REGEXP] [-update]
+                               Run the tests in a skeleton's .skeleton/tests
+
+Flags go before the arguments. Run "bones <command> <subcommand> -h" for the
+flags of a command.
+`
+
+// cli is what commands run with: the API client and where they read prompt
+// answers from and write their output to.
+type cli struct {
+	client *client.Client
+	in     io.Reader
+	out    io.Writer
+}
+
+type command func(ctx context.Context, cli *cli, args []string) error
+
+// topCommands have no subcommand.
+var topCommands = map[string]command{
+	"render": renderSkeleton,
+	"lint":   lintSkeleton,
+	"test":   testSkeleton,
+}
+
+var commands = map[string]map[string]command{
+	"type": {
+		"list": listTypes,
+		"add":  addType,
+		"rm":   removeType,
+	},
+	"project": {
+		"create": createProject,
+		"list":   listProjects,
+		"show":   showProject,
+		"delete": deleteProject,
+		"logs":   projectLogs,
+	},
+}
+
+// usageError is returned for a command line that doesn't make sense, and
+// prints the usage along with the message.
+type usageError string
+
+func (e usageError) Error() string {
+	return string(e)
+}
+
+func run(ctx context.Context, args []string, in io.Reader, out io.Writer) error {
+	server := os.Getenv("BONES_SERVER")
+	if server == "" {
+		server = defaultServer
+	}
+
+	flags := flag.NewFlagSet("bones", flag.ContinueOnError)
+	flags.SetOutput(out)
+	flags.Usage = func() { fmt.Fprint(out, usage) }
+	flags.StringVar(&server, "server", server, "URL of the bones server")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	args = flags.Args()
+
+	c := &cli{client: client.New(server), in: in, out: out}
+
+	if len(args) > 0 {
+		if cmd, ok := topCommands[args[0]]; ok {
+			return cmd(ctx, c, args[1:])
+		}
+	}
+
+	if len(args) < 2 {
+		return usageError("expected a command and a subcommand")
+	}
+
+	cmd, ok := commands[args[0]][args[1]]
+	if !ok {
+		return usageError(fmt.Sprintf("unknown command %s", strings.Join(args[:2], " ")))
+	}
+
+	return cmd(ctx, c, args[2:])
+}
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	err := run(ctx, os.Args[1:], os.Stdin, os.Stdout)
+	if err == flag.ErrHelp {
+		return
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "bones:", err)
+		if _, ok := err.(usageError); ok {
+			fmt.Fprint(os.Stderr, "\n"+usage)
+			os.Exit(2)
+		}
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/bones/server/client"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestInputData(t *testing.T) {
+
+	inputs := []*client.Input{
+		{Name: "APP_TITLE"},
+		{Name: "REPLICAS", Type: "number", Required: true},
+		{Name: "ENABLE_DATABASE", Type: "bool", Default: false},
+		{Name: "PORTS", Type: "list"},
+	}
+
+	file := filepath.Join(t.TempDir(), "data.yaml")
+	os.WriteFile(file, []byte("APP_TITLE: From file\nPORTS: [8080]\n"), 0644)
+
+	data, err := inputData(inputs, file, []string{"REPLICAS=3", "EXTRA=x"}, false, strings.NewReader(""), new(bytes.Buffer))
+	if err != nil {
+		t.Fatalf("expected error to be nil got %v", err)
+	}
+
+	if data["APP_TITLE"] != "From file" || data["REPLICAS"] != 3.0 || data["EXTRA"] != "x" {
+		t.Errorf("expected the file and -set values got %v", data)
+	}
+	if _, ok := data["ENABLE_DATABASE"]; ok {
+		t.Errorf("expected ENABLE_DATABASE to be left to its default got %v", data)
+	}
+
+	_, err = inputData(inputs, "", []string{"REPLICAS=many"}, false, strings.NewReader(""), new(bytes.Buffer))
+	if err == nil {
+		t.Errorf("expected an error for a number that isn't one")
+	}
+
+	_, err = inputData(inputs, "", nil, false, strings.NewReader(""), new(bytes.Buffer))
+	if err == nil || !strings.Contains(err.Error(), "REPLICAS is required") {
+		t.Errorf("expected REPLICAS to be required got %v", err)
+	}
+
+	// Prompts ask again for an invalid or missing required value.
+	out := new(bytes.Buffer)
+	answers := strings.NewReader("Prompted\nmany\n\n2\ntrue\n[80, 443]\n")
+	data, err = inputData(inputs, "", nil, true, answers, out)
+	if err != nil {
+		t.Fatalf("expected error to be nil got %v", err)
+	}
+
+	if data["APP_TITLE"] != "Prompted" || data["REPLICAS"] != 2.0 || data["ENABLE_DATABASE"] != true || len(data["PORTS"].([]interface{})) != 2 {
+		t.Errorf("expected the prompted values got %v", data)
+	}
+	if !strings.Contains(out.String(), "REPLICAS must be a number") || !strings.Contains(out.String(), "REPLICAS is required") {
+		t.Errorf("expected REPLICAS to be asked again got %q", out.String())
+	}
+}
+
+func TestProjectLogs(t *testing.T) {
+
+	pollInterval = 0
+
+	output := []string{"terraform init\n", "", "terraform apply\n"}
+	status := []client.RunStatus{client.RunRunning, client.RunAwaitingApproval, client.RunSucceeded}
+	polls := 0
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/project/p":
+			json.NewEncoder(w).Encode(client.Project{Id: "p", LastRun: "r"})
+		case "/v1/project/p/runs/r":
+			json.NewEncoder(w).Encode(client.Run{Id: "r", Status: client.RunSucceeded})
+		case "/v1/project/p/runs/r/log":
+			offset := 0
+			for _, o := range output[:polls] {
+				offset += len(o)
+			}
+			if r.URL.Query().Get("offset") != strconv.Itoa(offset) {
+				t.Errorf("expected offset %v got %v", offset, r.URL.Query().Get("offset"))
+			}
+			w.Header().Set("X-Run-Status", string(status[polls]))
+			w.Write([]byte(output[polls]))
+			polls++
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	out := new(bytes.Buffer)
+	err := run(context.Background(), []string{"-server", server.URL, "project", "logs", "p"}, strings.NewReader(""), out)
+	if err != nil {
+		t.Fatalf("expected error to be nil got %v", err)
+	}
+
+	expected := "terraform init\nRun r is awaiting approval of its plan\nterraform apply\nRun r succeeded\n"
+	if out.String() != expected {
+		t.Errorf("expected %q got %q", expected, out.String())
+	}
+}
+
+func TestUnknownCommand(t *testing.T) {
+
+	err := run(context.Background(), []string{"project", "frobnicate"}, strings.NewReader(""), new(bytes.Buffer))
+	if _, ok := err.(usageError); !ok {
+		t.Errorf("expected a usage error got %v", err)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/bones/server/client"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+func createProject(ctx context.Context, cli *cli, args []string) error {
+	flags := flag.NewFlagSet("project create", flag.ContinueOnError)
+	flags.SetOutput(cli.out)
+
+	var request client.ProjectCreateRequest
+	flags.StringVar(&request.Type, "type", "", "Slug of the project type")
+	flags.StringVar(&request.Name, "name", "", "Name of the project")
+	flags.StringVar(&request.Desc, "desc", "", "Description of the project")
+
+	var sets, owners, labels listFlag
+	flags.Var(&sets, "set", "KEY=VALUE of an input, repeatable")
+	flags.Var(&owners, "owner", "Owner of the project, repeatable")
+	flags.Var(&labels, "label", "KEY=VALUE label of the project, repeatable")
+	file := flags.String("f", "", "YAML file of input values")
+	prompt := flags.Bool("i", false, "Prompt for the inputs not given by -set or -f")
+	detach := flags.Bool("detach", false, "Don't follow the generate run")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if request.Type == "" || request.Name == "" {
+		return usageError("project create needs -type and -name")
+	}
+
+	inputs, err := cli.client.ListProjectTypeInputs(ctx, request.Type)
+	if err != nil {
+		return err
+	}
+
+	request.Data, err = inputData(inputs, *file, sets, *prompt, cli.in, cli.out)
+	if err != nil {
+		return err
+	}
+
+	request.Owners = owners
+	if len(labels) > 0 {
+		request.Labels = make(map[string]string)
+		for _, label := range labels {
+			key, value, _ := strings.Cut(label, "=")
+			request.Labels[key] = value
+		}
+	}
+
+	project, err := cli.client.CreateProject(ctx, request)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(cli.out, "Created project %s\n", project.Id)
+	if *detach {
+		return nil
+	}
+
+	return follow(ctx, cli, project.Id, project.LastRun)
+}
+
+func listProjects(ctx context.Context, cli *cli, args []string) error {
+	flags := flag.NewFlagSet("project list", flag.ContinueOnError)
+	flags.SetOutput(cli.out)
+
+	var filter client.ProjectFilter
+	var labels listFlag
+	flags.StringVar(&filter.Type, "type", "", "Only projects of this type")
+	flags.StringVar(&filter.Owner, "owner", "", "Only projects with this owner")
+	flags.StringVar((*string)(&filter.Status), "status", "", "Only projects whose last run has this status")
+	flags.StringVar(&filter.Name, "name", "", "Only projects whose name starts with this")
+	flags.StringVar(&filter.Sort, "sort", "", "created, updated or name, with a leading - for descending order")
+	flags.Var(&labels, "label", "KEY=VALUE or KEY label the projects have, repeatable")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	filter.Labels = labels
+
+	w := tabwriter.NewWriter(cli.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tTYPE\tUPDATED")
+
+	for {
+		list, err := cli.client.ListProjects(ctx, filter)
+		if err != nil {
+			return err
+		}
+
+		for _, p := range list.Items {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", p.Id, p.Name, p.Type, p.UpdatedAt.Local().Format(time.RFC3339))
+		}
+
+		if list.Next == "" {
+			return w.Flush()
+		}
+		filter.Cursor = list.Next
+	}
+}
+
+func showProject(ctx context.Context, cli *cli, args []string) error {
+	if len(args) != 1 {
+		return usageError("project show needs the id of the project")
+	}
+
+	project, err := cli.client.GetProject(ctx, args[0])
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(cli.out)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(project)
+}
+
+func deleteProject(ctx context.Context, cli *cli, args []string) error {
+	flags := flag.NewFlagSet("project delete", flag.ContinueOnError)
+	flags.SetOutput(cli.out)
+	detach := flags.Bool("detach", false, "Don't follow the destroy run")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if flags.NArg() != 1 {
+		return usageError("project delete needs the id of the project")
+	}
+
+	project, err := cli.client.DeleteProject(ctx, flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(cli.out, "Deleting project %s\n", project.Id)
+	if *detach {
+		return nil
+	}
+
+	return follow(ctx, cli, project.Id, project.LastRun)
+}
+
+func projectLogs(ctx context.Context, cli *cli, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return usageError("project logs needs the id of the project, and optionally of the run")
+	}
+
+	projectId := args[0]
+
+	var runId string
+	if len(args) == 2 {
+		runId = args[1]
+	} else {
+		project, err := cli.client.GetProject(ctx, projectId)
+		if err != nil {
+			return err
+		}
+		if project.LastRun == "" {
+			return fmt.Errorf("project %s has no runs", projectId)
+		}
+		runId = project.LastRun
+	}
+
+	return follow(ctx, cli, projectId, runId)
+}
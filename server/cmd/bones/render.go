@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/bones/server/common"
+	"os"
+	"path/filepath"
+	"skeletonarmydev/bones/render"
+	"strings"
+)
+
+// emptyDir fails unless dir is missing or empty.
+func emptyDir(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(entries) > 0 {
+		return fmt.Errorf("%s is not empty", dir)
+	}
+
+	return nil
+}
+
+// renderSkeleton renders a skeleton into a local directory with the
+// templating of the generate steps, without creating repos or running
+// Terraform. Templates see no Terraform outputs, and the project has no
+// repo.
+func renderSkeleton(ctx context.Context, cli *cli, args []string) error {
+	flags := flag.NewFlagSet("render", flag.ContinueOnError)
+	flags.SetOutput(cli.out)
+
+	skeleton := flags.String("skeleton", ".", "Directory or repo of the skeleton")
+	path := flags.String("path", "/", "Path of the skeleton in the directory or repo")
+	ref := flags.String("ref", "", "Branch, tag or commit of a skeleton repo, HEAD by default")
+	file := flags.String("data", "", "YAML file of input values")
+	name := flags.String("name", "", "Name of the project, by default that of the -out directory")
+	dst := flags.String("out", "", "Directory to render into, which must be missing or empty")
+	var sets listFlag
+	flags.Var(&sets, "set", "KEY=VALUE of an input, repeatable")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if *dst == "" {
+		return usageError("render needs -out")
+	}
+	err = emptyDir(*dst)
+	if err != nil {
+		return err
+	}
+
+	if *name == "" {
+		abs, err := filepath.Abs(*dst)
+		if err != nil {
+			return err
+		}
+		*name = filepath.Base(abs)
+	}
+
+	data := common.Data{}
+	if *file != "" {
+		values, err := readDataFile(*file)
+		if err != nil {
+			return err
+		}
+		data = common.Data(values)
+	}
+	for _, set := range sets {
+		key, value, ok := strings.Cut(set, "=")
+		if !ok {
+			return usageError(fmt.Sprintf("-set %s is not KEY=VALUE", set))
+		}
+		data[key] = value
+	}
+
+	ctx, s, err := render.Open(ctx, *skeleton, *path, *ref)
+	if err != nil {
+		return err
+	}
+
+	err = s.Render(ctx, *dst, render.Options{Name: *name, Data: data, Out: cli.out})
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(cli.out, "Rendered %s into %s\n", *name, *dst)
+	return nil
+}
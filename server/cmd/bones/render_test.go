@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"skeletonarmydev/bones/skeletontest"
+	"strings"
+	"testing"
+)
+
+func TestRenderSkeleton(t *testing.T) {
+
+	root := t.TempDir()
+	skeletontest.WriteFiles(t, root, map[string]string{
+		"base/.skeleton/skeleton.yaml": `inputs:
+  - name: REPLICAS
+    type: number
+    default: 1
+generate:
+  steps:
+    - name: repo
+      handler: github
+`,
+		"base/infra/aws-ecs/main.tf": "variable \"REPLICAS\" {}\n# {{ .project.slug }} runs {{ .REPLICAS }}\n",
+		"app/.skeleton/skeleton.yaml": `include:
+  - path: /base
+inputs:
+  - name: CI
+    type: bool
+    default: true
+generate:
+  steps:
+    - name: infra
+      handler: aws
+    - name: sign-off
+      handler: approval
+    - name: ci
+      handler: circleci
+      when: '{{ .data.CI }}'
+`,
+		"app/{{ .APP_NAME }}.md":          "# {{ .APP_NAME }}\n",
+		"app/infra/circleci/config.yml":   "name: {{ .SERVICE_NAME }}\n",
+		"app/infra/circleci/variables.tf": "",
+	})
+
+	answers := filepath.Join(t.TempDir(), "answers.yaml")
+	skeletontest.WriteFiles(t, filepath.Dir(answers), map[string]string{"answers.yaml": "REPLICAS: 3\n"})
+
+	out := filepath.Join(t.TempDir(), "My Shop")
+	log := new(bytes.Buffer)
+
+	err := run(context.Background(), []string{"render", "-skeleton", root, "-path", "/app", "-data", answers, "-out", out}, strings.NewReader(""), log)
+	if err != nil {
+		t.Fatalf("expected error to be nil got %v: %s", err, log.String())
+	}
+
+	// The github step copies the composed skeleton, rendering names only.
+	readme, err := os.ReadFile(filepath.Join(out, "my-shop.md"))
+	if err != nil || string(readme) != "# {{ .APP_NAME }}\n" {
+		t.Errorf("expected my-shop.md to be copied got %q %v", readme, err)
+	}
+
+	main, err := os.ReadFile(filepath.Join(out, "infra/aws-ecs/main.tf"))
+	if err != nil || !strings.Contains(string(main), "# my-shop runs 3") {
+		t.Errorf("expected main.tf to be rendered got %q %v", main, err)
+	}
+
+	var vars map[string]interface{}
+	text, _ := os.ReadFile(filepath.Join(out, "infra/aws-ecs/bones_data.auto.tfvars.json"))
+	json.Unmarshal(text, &vars)
+	if vars["REPLICAS"] != 3.0 {
+		t.Errorf("expected REPLICAS 3 in the data vars got %s", text)
+	}
+
+	config, err := os.ReadFile(filepath.Join(out, ".circleci/config.yml"))
+	if err != nil || string(config) != "name: my-shop-service\n" {
+		t.Errorf("expected the CircleCI config to be rendered got %q %v", config, err)
+	}
+
+	if !strings.Contains(log.String(), "Skipping step sign-off") {
+		t.Errorf("expected the approval step to be skipped got %q", log.String())
+	}
+
+	// A when that is false leaves its step out, and the output must be empty.
+	err = run(context.Background(), []string{"render", "-skeleton", root, "-path", "/app", "-set", "CI=false", "-out", out}, strings.NewReader(""), log)
+	if err == nil || !strings.Contains(err.Error(), "is not empty") {
+		t.Errorf("expected an error for an output that isn't empty got %v", err)
+	}
+
+	out = filepath.Join(t.TempDir(), "shop")
+	err = run(context.Background(), []string{"render", "-skeleton", root, "-path", "/app", "-set", "CI=false", "-out", out}, strings.NewReader(""), log)
+	if err != nil {
+		t.Fatalf("expected error to be nil got %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(out, ".circleci")); !os.IsNotExist(err) {
+		t.Errorf("expected the ci step to be left out got %v", err)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"regexp"
+	"skeletonarmydev/bones/render"
+	"skeletonarmydev/bones/skeletontest"
+)
+
+// testSkeleton runs the tests of a skeleton, see package skeletontest, and
+// fails when any of them does.
+func testSkeleton(ctx context.Context, cli *cli, args []string) error {
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags.SetOutput(cli.out)
+
+	skeleton := flags.String("skeleton", ".", "Directory or repo of the skeleton")
+	path := flags.String("path", "/", "Path of the skeleton in the directory or repo")
+	ref := flags.String("ref", "", "Branch, tag or commit of a skeleton repo, HEAD by default")
+	run := flags.String("run", "", "Regular expression selecting the tests to run by name")
+	update := flags.Bool("update", false, "Write the golden files of a local skeleton instead of comparing them")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	options := skeletontest.Options{Update: *update}
+	if *run != "" {
+		options.Run, err = regexp.Compile(*run)
+		if err != nil {
+			return usageError(fmt.Sprintf("-run: %v", err))
+		}
+	}
+
+	ctx, s, err := render.Open(ctx, *skeleton, *path, *ref)
+	if err != nil {
+		return err
+	}
+
+	results, err := skeletontest.Run(ctx, s, options)
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, result := range results {
+		switch {
+		case result.Failed():
+			failed++
+			fmt.Fprintf(cli.out, "FAIL  %s\n", result.Name)
+			for _, failure := range result.Failures {
+				fmt.Fprintf(cli.out, "      %s\n", failure)
+			}
+		case result.Updated:
+			fmt.Fprintf(cli.out, "ok    %s (updated)\n", result.Name)
+		default:
+			fmt.Fprintf(cli.out, "ok    %s\n", result.Name)
+		}
+	}
+
+	if len(results) == 0 {
+		fmt.Fprintln(cli.out, "No tests found")
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d tests failed", failed, len(results))
+	}
+
+	return nil
+}
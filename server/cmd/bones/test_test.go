@@ -0,0 +1,37 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"skeletonarmydev/bones/skeletontest"
+	"strings"
+	"testing"
+)
+
+func TestTestSkeleton(t *testing.T) {
+
+	root := t.TempDir()
+	skeletontest.WriteFiles(t, root, map[string]string{
+		".skeleton/skeleton.yaml":    "generate:\n  steps:\n    - name: repo\n      handler: github\n",
+		"{{ .APP_NAME }}.md":         "# Shop\n",
+		".skeleton/tests/shop.yaml":  "project: Shop\n",
+		".skeleton/tests/other.yaml": "project: Other\nfiles:\n  shop.md: \"# Shop\\n\"\n",
+	})
+
+	out := new(bytes.Buffer)
+	err := run(context.Background(), []string{"test", "-skeleton", root, "-run", "^shop$", "-update"}, strings.NewReader(""), out)
+	if err != nil || out.String() != "ok    shop (updated)\n" {
+		t.Errorf("expected shop to be updated got %v %q", err, out.String())
+	}
+
+	out.Reset()
+	err = run(context.Background(), []string{"test", "-skeleton", root}, strings.NewReader(""), out)
+	if err == nil || err.Error() != "1 of 2 tests failed" {
+		t.Errorf("expected other to fail got %v", err)
+	}
+
+	expected := "FAIL  other\n      shop.md: not rendered\nok    shop\n"
+	if out.String() != expected {
+		t.Errorf("expected %q got %q", expected, out.String())
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/bones/server/client"
+	"text/tabwriter"
+)
+
+func listTypes(ctx context.Context, cli *cli, args []string) error {
+	flags := flag.NewFlagSet("type list", flag.ContinueOnError)
+	flags.SetOutput(cli.out)
+	name := flags.String("name", "", "Only types whose name starts with this")
+	sort := flags.String("sort", "", "created, updated or name, with a leading - for descending order")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(cli.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SLUG\tNAME\tREPO\tPATH\tADDON")
+
+	filter := client.ProjectTypeFilter{Name: *name, ListOptions: client.ListOptions{Sort: *sort}}
+	for {
+		list, err := cli.client.ListProjectTypes(ctx, filter)
+		if err != nil {
+			return err
+		}
+
+		for _, t := range list.Items {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%v\n", t.Slug, t.Name, t.Repo, t.Path, t.Addon)
+		}
+
+		if list.Next == "" {
+			return w.Flush()
+		}
+		filter.Cursor = list.Next
+	}
+}
+
+func addType(ctx context.Context, cli *cli, args []string) error {
+	flags := flag.NewFlagSet("type add", flag.ContinueOnError)
+	flags.SetOutput(cli.out)
+
+	var request client.ProjectTypeCreateRequest
+	flags.StringVar(&request.Name, "name", "", "Name of the type")
+	flags.StringVar(&request.Desc, "desc", "", "Description of the type")
+	flags.StringVar(&request.Repo, "repo", "", "Repo of the skeleton")
+	flags.StringVar(&request.Path, "path", "/", "Path of the skeleton in its repo")
+	flags.BoolVar(&request.Addon, "addon", false, "The type is an add-on, applied to existing projects")
+	flags.StringVar(&request.Terraform.Tool, "terraform-tool", "", "terraform or tofu")
+	flags.StringVar(&request.Terraform.Version, "terraform-version", "", "Version of the Terraform binary")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if request.Name == "" || request.Repo == "" {
+		return usageError("type add needs -name and -repo")
+	}
+
+	projectType, err := cli.client.CreateProjectType(ctx, request)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(cli.out, "Added type %s\n", projectType.Slug)
+	return nil
+}
+
+func removeType(ctx context.Context, cli *cli, args []string) error {
+	if len(args) != 1 {
+		return usageError("type rm needs the slug of the type")
+	}
+
+	projectType, err := cli.client.DeleteProjectType(ctx, args[0])
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(cli.out, "Removed type %s\n", projectType.Slug)
+	return nil
+}
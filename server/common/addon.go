@@ -0,0 +1,31 @@
+package common
+
+import (
+	"context"
+)
+
+type addonKey struct{}
+
+// WithAddon returns a copy of ctx for applying the add-on slug to an existing
+// project. Handlers keep the add-on's infrastructure apart from the
+// project's own with AddonDir.
+func WithAddon(ctx context.Context, slug string) context.Context {
+	return context.WithValue(ctx, addonKey{}, slug)
+}
+
+// AddonFromContext returns the add-on carried by ctx, if any.
+func AddonFromContext(ctx context.Context) (string, bool) {
+	slug, ok := ctx.Value(addonKey{}).(string)
+	return slug, ok
+}
+
+// AddonDir returns where dir, such as infra/aws-ecs, lives in the project
+// repo and in state keys: dir itself for the project, and
+// addons/<slug>/dir for an add-on.
+func AddonDir(ctx context.Context, dir string) string {
+	if slug, ok := AddonFromContext(ctx); ok {
+		return "addons/" + slug + "/" + dir
+	}
+
+	return dir
+}
@@ -0,0 +1,254 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/hashicorp/go-version"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// TerraformBinary selects the executable used to run a project's Terraform
+// configurations. Empty fields fall back to the server configuration:
+//
+//	TERRAFORM_TOOL     terraform (default) or tofu
+//	TERRAFORM_PATH     executable used for terraform when no binary dir matches
+//	TOFU_PATH          executable used for tofu when no binary dir matches
+//	TERRAFORM_BIN_DIR  directory of pre-installed binaries named
+//	                   <tool>_<version>, e.g. terraform_1.5.7 or tofu_1.6.2
+type TerraformBinary struct {
+	Tool    string `json:"tool,omitempty"`
+	Version string `json:"version,omitempty"`
+	Path    string `json:"path,omitempty"`
+}
+
+// Validate reports an unknown tool or a version that isn't a constraint.
+func (binary TerraformBinary) Validate() error {
+	if binary.Tool != "" && binary.Tool != "terraform" && binary.Tool != "tofu" {
+		return fmt.Errorf("unknown terraform tool %q, expected terraform or tofu", binary.Tool)
+	}
+
+	if binary.Version != "" {
+		_, err := version.NewConstraint(binary.Version)
+		if err != nil {
+			return fmt.Errorf("invalid version constraint %q: %w", binary.Version, err)
+		}
+	}
+
+	return nil
+}
+
+type binaryKey struct{}
+
+// WithTerraformBinary returns a copy of ctx that selects binary for every
+// Terraform invocation made with it.
+func WithTerraformBinary(ctx context.Context, binary TerraformBinary) context.Context {
+	return context.WithValue(ctx, binaryKey{}, binary)
+}
+
+var requiredVersion = regexp.MustCompile(`required_version\s*=\s*"([^"]+)"`)
+
+// RequiredVersions returns the required_version constraints declared by the
+// .tf files in workingDir.
+func RequiredVersions(workingDir string) []string {
+	var constraints []string
+
+	files, _ := filepath.Glob(workingDir + "/*.tf")
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			continue
+		}
+
+		for _, match := range requiredVersion.FindAllStringSubmatch(string(data), -1) {
+			constraints = append(constraints, match[1])
+		}
+	}
+
+	return constraints
+}
+
+// installedBinaries lists the versions of tool found in dir.
+func installedBinaries(dir string, tool string) map[*version.Version]string {
+	binaries := make(map[*version.Version]string)
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		fmt.Printf("Can't read TERRAFORM_BIN_DIR: %s\n", err)
+		return binaries
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasPrefix(entry.Name(), tool+"_") {
+			continue
+		}
+
+		v, err := version.NewVersion(strings.TrimPrefix(entry.Name(), tool+"_"))
+		if err != nil {
+			continue
+		}
+
+		binaries[v] = filepath.Join(dir, entry.Name())
+	}
+
+	return binaries
+}
+
+func defaultExecPath(tool string) (string, error) {
+	if tool == "tofu" {
+		if execPath := GetConfig("TOFU_PATH"); execPath != "" {
+			return execPath, nil
+		}
+		return exec.LookPath("tofu")
+	}
+
+	if execPath := GetConfig("TERRAFORM_PATH"); execPath != "" {
+		return execPath, nil
+	}
+
+	return getTerraformDir(), nil
+}
+
+var (
+	versionOutput = regexp.MustCompile(`(?m)^(?:Terraform|OpenTofu) v(\S+)`)
+
+	binaryVersionsLock sync.Mutex
+	binaryVersions     = make(map[string]*version.Version)
+)
+
+// binaryVersion asks the executable at execPath for its version. Versions
+// are remembered by path and modification time.
+func binaryVersion(ctx context.Context, execPath string) (*version.Version, error) {
+	key := execPath
+	if info, err := os.Stat(execPath); err == nil {
+		key = fmt.Sprintf("%s@%d", execPath, info.ModTime().UnixNano())
+	}
+
+	binaryVersionsLock.Lock()
+	v, ok := binaryVersions[key]
+	binaryVersionsLock.Unlock()
+	if ok {
+		return v, nil
+	}
+
+	out, err := exec.CommandContext(ctx, execPath, "version", "-json").Output()
+	if err != nil {
+		return nil, fmt.Errorf("can't get the version of %s: %w", execPath, err)
+	}
+
+	var info struct {
+		TerraformVersion string `json:"terraform_version"`
+	}
+	text := ""
+	if json.Unmarshal(out, &info) == nil {
+		text = info.TerraformVersion
+	} else if match := versionOutput.FindSubmatch(out); match != nil {
+		text = string(match[1])
+	}
+
+	v, err = version.NewVersion(text)
+	if err != nil {
+		return nil, fmt.Errorf("can't read the version of %s from %q", execPath, out)
+	}
+
+	binaryVersionsLock.Lock()
+	binaryVersions[key] = v
+	binaryVersionsLock.Unlock()
+
+	return v, nil
+}
+
+// checkedExecPath returns execPath if its version satisfies required, which
+// is nil without constraints.
+func checkedExecPath(ctx context.Context, execPath string, required version.Constraints) (string, error) {
+	if required == nil {
+		return execPath, nil
+	}
+
+	v, err := binaryVersion(ctx, execPath)
+	if err != nil {
+		return "", err
+	}
+	if !required.Check(v) {
+		return "", fmt.Errorf("%s is version %s, which doesn't satisfy %q", execPath, v, required.String())
+	}
+
+	return execPath, nil
+}
+
+// terraformExecPath picks the executable for the configuration in
+// workingDir. With a binary directory configured, the newest installed
+// version that satisfies both the selected version and the configuration's
+// required_version is used. Any other executable must satisfy them itself.
+func terraformExecPath(ctx context.Context, workingDir string) (string, error) {
+	binary, _ := ctx.Value(binaryKey{}).(TerraformBinary)
+
+	constraints := RequiredVersions(workingDir)
+	if binary.Version != "" {
+		constraints = append(constraints, binary.Version)
+	}
+
+	var required version.Constraints
+	if len(constraints) > 0 {
+		var err error
+		required, err = version.NewConstraint(strings.Join(constraints, ","))
+		if err != nil {
+			return "", fmt.Errorf("invalid version constraint %q: %w", strings.Join(constraints, ","), err)
+		}
+	}
+
+	if binary.Path != "" {
+		return checkedExecPath(ctx, binary.Path, required)
+	}
+
+	tool := binary.Tool
+	if tool == "" {
+		tool = GetConfig("TERRAFORM_TOOL")
+	}
+	if tool == "" {
+		tool = "terraform"
+	}
+	if tool != "terraform" && tool != "tofu" {
+		return "", fmt.Errorf("unknown terraform tool %q", tool)
+	}
+
+	binDir := GetConfig("TERRAFORM_BIN_DIR")
+	if binDir == "" {
+		return fallbackExecPath(ctx, tool, required)
+	}
+
+	binaries := installedBinaries(binDir, tool)
+
+	var chosen *version.Version
+	for v := range binaries {
+		if required != nil && !required.Check(v) {
+			continue
+		}
+		if chosen == nil || v.GreaterThan(chosen) {
+			chosen = v
+		}
+	}
+
+	if chosen == nil {
+		if required != nil {
+			return "", fmt.Errorf("no %s binary in %s satisfies %q", tool, binDir, strings.Join(constraints, ","))
+		}
+		return defaultExecPath(tool)
+	}
+
+	return binaries[chosen], nil
+}
+
+func fallbackExecPath(ctx context.Context, tool string, required version.Constraints) (string, error) {
+	execPath, err := defaultExecPath(tool)
+	if err != nil {
+		return "", err
+	}
+
+	return checkedExecPath(ctx, execPath, required)
+}
@@ -0,0 +1,88 @@
+package common
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTerraformExecPathFromBinDir(t *testing.T) {
+
+	binDir := t.TempDir()
+	for _, name := range []string{"terraform_1.3.9", "terraform_1.5.7", "terraform_1.6.0", "tofu_1.6.2"} {
+		os.WriteFile(filepath.Join(binDir, name), nil, 0755)
+	}
+	t.Setenv("TERRAFORM_BIN_DIR", binDir)
+
+	workingDir := t.TempDir()
+	os.WriteFile(filepath.Join(workingDir, "main.tf"), []byte(`terraform {
+  required_version = ">= 1.3, < 1.6"
+}`), 0644)
+
+	execPath, err := terraformExecPath(context.Background(), workingDir)
+	if err != nil {
+		t.Errorf("expected error to be nil got %v", err)
+	}
+	if filepath.Base(execPath) != "terraform_1.5.7" {
+		t.Errorf("expected terraform_1.5.7 got %v", execPath)
+	}
+
+	ctx := WithTerraformBinary(context.Background(), TerraformBinary{Version: "~> 1.3.0"})
+	execPath, err = terraformExecPath(ctx, workingDir)
+	if err != nil {
+		t.Errorf("expected error to be nil got %v", err)
+	}
+	if filepath.Base(execPath) != "terraform_1.3.9" {
+		t.Errorf("expected terraform_1.3.9 got %v", execPath)
+	}
+
+	ctx = WithTerraformBinary(context.Background(), TerraformBinary{Tool: "tofu"})
+	_, err = terraformExecPath(ctx, workingDir)
+	if err == nil {
+		t.Errorf("expected no tofu binary to satisfy the constraint")
+	}
+}
+
+func TestTerraformExecPathChecksVersion(t *testing.T) {
+
+	execPath := filepath.Join(t.TempDir(), "terraform")
+	os.WriteFile(execPath, []byte("#!/bin/sh\necho '{\"terraform_version\":\"1.5.7\"}'\n"), 0755)
+	t.Setenv("TERRAFORM_BIN_DIR", "")
+	t.Setenv("TERRAFORM_PATH", execPath)
+
+	workingDir := t.TempDir()
+	os.WriteFile(filepath.Join(workingDir, "main.tf"), []byte(`terraform {
+  required_version = ">= 1.3"
+}`), 0644)
+
+	got, err := terraformExecPath(context.Background(), workingDir)
+	if err != nil || got != execPath {
+		t.Errorf("expected %s got %v %v", execPath, got, err)
+	}
+
+	ctx := WithTerraformBinary(context.Background(), TerraformBinary{Version: ">= 1.6"})
+	_, err = terraformExecPath(ctx, workingDir)
+	if err == nil {
+		t.Errorf("expected terraform 1.5.7 not to satisfy >= 1.6")
+	}
+
+	ctx = WithTerraformBinary(context.Background(), TerraformBinary{Path: execPath, Version: "~> 1.4.0"})
+	_, err = terraformExecPath(ctx, workingDir)
+	if err == nil {
+		t.Errorf("expected terraform 1.5.7 not to satisfy ~> 1.4.0")
+	}
+}
+
+func TestTerraformBinaryValidate(t *testing.T) {
+
+	if err := (TerraformBinary{Tool: "tofu", Version: "~> 1.6"}).Validate(); err != nil {
+		t.Errorf("expected error to be nil got %v", err)
+	}
+	if err := (TerraformBinary{Tool: "terraformx"}).Validate(); err == nil {
+		t.Errorf("expected an unknown tool to be an error")
+	}
+	if err := (TerraformBinary{Version: "latest"}).Validate(); err == nil {
+		t.Errorf("expected an invalid version to be an error")
+	}
+}
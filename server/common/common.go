@@ -5,11 +5,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/hashicorp/terraform-exec/tfexec"
+	tfjson "github.com/hashicorp/terraform-json"
 	"io"
 	"io/ioutil"
 	"log"
 	"os"
 	"path"
+	"time"
 )
 
 type TerraformAction int64
@@ -106,27 +108,44 @@ func GetConfig(key string) (value string) {
 	return os.Getenv(key)
 }
 
-func runApplyTerraform(workingDir string, vars map[string]string, statefileDir string) error {
-	execPath := getTerraformDir()
+// initTerraform prepares workingDir against the remote state stored under
+// statefileDir.
+func initTerraform(ctx context.Context, workingDir string, statefileDir string) (*tfexec.Terraform, error) {
+	execPath, err := terraformExecPath(ctx, workingDir)
+	if err != nil {
+		fmt.Printf("error selecting terraform binary: %s", err)
+		return nil, err
+	}
 
 	awsCredsEnv := GetConfig("AWS")
 
 	var awsCreds AWSCreds
-	err := json.Unmarshal([]byte(awsCredsEnv), &awsCreds)
+	err = json.Unmarshal([]byte(awsCredsEnv), &awsCreds)
 	if err != nil {
 		fmt.Printf("Can't parse awsCreds: %s", err)
-		return err
+		return nil, err
 	}
 
-	os.Remove(workingDir + "/out.plan")
-
 	tf, err := tfexec.NewTerraform(workingDir, execPath)
 	if err != nil {
 		fmt.Printf("error running NewTerraform: %s (execPath: %s)", err, execPath)
-		return err
+		return nil, err
+	}
+
+	if run := RunFromContext(ctx); run != nil {
+		tf.SetStdout(run.Log())
+		tf.SetStderr(run.Log())
+	}
+
+	cmdCtx, cancel := commandContext(ctx)
+	defer cancel()
+
+	if GetConfig("TF_PLUGIN_CACHE_DIR") != "" {
+		pluginCacheLock.Lock()
+		defer pluginCacheLock.Unlock()
 	}
 
-	err = tf.Init(context.Background(),
+	err = tf.Init(cmdCtx,
 		tfexec.BackendConfig("region=us-east-1"),
 		tfexec.BackendConfig("bucket=bones-server"),
 		tfexec.BackendConfig("encrypt=true"),
@@ -136,6 +155,17 @@ func runApplyTerraform(workingDir string, vars map[string]string, statefileDir s
 	)
 	if err != nil {
 		fmt.Printf("error running Init: %s", err)
+		return nil, err
+	}
+
+	return tf, nil
+}
+
+func runApplyTerraform(ctx context.Context, workingDir string, vars map[string]string, statefileDir string) error {
+	os.Remove(workingDir + "/out.plan")
+
+	tf, err := initTerraform(ctx, workingDir, statefileDir)
+	if err != nil {
 		return err
 	}
 
@@ -147,14 +177,18 @@ func runApplyTerraform(workingDir string, vars map[string]string, statefileDir s
 		tfvars = append(tfvars, tfexec.Var(key+"="+val))
 	}
 
-	pass, err := tf.Plan(context.Background(), tfvars...)
+	cmdCtx, cancel := commandContext(ctx)
+	pass, err := tf.Plan(cmdCtx, tfvars...)
+	cancel()
 	if err != nil {
 		fmt.Printf("error running Plan: %s", err)
 		return err
 	}
 
 	if pass {
-		plan, err := tf.ShowPlanFile(context.Background(), workingDir+"/out.plan")
+		cmdCtx, cancel := commandContext(ctx)
+		plan, err := tf.ShowPlanFile(cmdCtx, workingDir+"/out.plan")
+		cancel()
 		if err != nil {
 			fmt.Printf("error running fetch plan: %s", err)
 			return err
@@ -164,8 +198,23 @@ func runApplyTerraform(workingDir string, vars map[string]string, statefileDir s
 			fmt.Printf("Change: %s %s\n", s.Change.Actions, s.Name)
 		}
 
+		if run := RunFromContext(ctx); run != nil {
+			err = run.AwaitApproval(ctx, statefileDir, plan)
+			if err != nil {
+				fmt.Printf("plan not approved: %s", err)
+				return err
+			}
+		}
+
+		// Last chance to stop: once started, the apply runs to completion.
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+
 		fmt.Println("Applying changes")
-		err2 := tf.Apply(context.Background(), tfexec.DirOrPlan(workingDir+"/out.plan"))
+		applyCtx, cancel := stateContext(ctx)
+		err2 := tf.Apply(applyCtx, tfexec.DirOrPlan(workingDir+"/out.plan"))
+		cancel()
 
 		if err2 != nil {
 			fmt.Printf("error running apply: %s", err2)
@@ -175,38 +224,76 @@ func runApplyTerraform(workingDir string, vars map[string]string, statefileDir s
 		os.Remove(workingDir + "/out.plan")
 	}
 
+	run, tc := RunFromContext(ctx), templateContextFrom(ctx)
+	if run != nil || tc != nil {
+		showCtx, cancel := stateContext(ctx)
+		state, err := tf.Show(showCtx)
+		cancel()
+		if err != nil {
+			fmt.Printf("error reading state: %s", err)
+		}
+
+		if run != nil {
+			run.Applied(ctx, statefileDir, Inventory(state, statefileDir))
+		}
+		if tc != nil {
+			tc.recordOutputs(state)
+		}
+	}
+
 	return nil
 }
 
-func runDestroyTerraform(workingDir string, vars map[string]string, statefileDir string) error {
-	execPath := getTerraformDir()
+// Resource is a managed resource found in a Terraform state.
+type Resource struct {
+	StateKey string `json:"stateKey"`
+	Address  string `json:"address"`
+	Type     string `json:"type"`
+	Name     string `json:"name"`
+	Provider string `json:"provider"`
+	Id       string `json:"id,omitempty"`
+	Arn      string `json:"arn,omitempty"`
+}
 
-	tf, err := tfexec.NewTerraform(workingDir, execPath)
-	if err != nil {
-		fmt.Printf("error running NewTerraform: %s (execPath: %s)", err, execPath)
-		return err
+// Inventory lists the managed resources of state, including those of child
+// modules. A nil state has no resources.
+func Inventory(state *tfjson.State, statefileDir string) []Resource {
+	resources := []Resource{}
+	if state == nil || state.Values == nil || state.Values.RootModule == nil {
+		return resources
 	}
 
-	awsCredsEnv := GetConfig("AWS")
+	modules := []*tfjson.StateModule{state.Values.RootModule}
+	for len(modules) > 0 {
+		module := modules[0]
+		modules = append(modules[1:], module.ChildModules...)
 
-	var awsCreds AWSCreds
-	err = json.Unmarshal([]byte(awsCredsEnv), &awsCreds)
-	if err != nil {
-		fmt.Printf("Can't parse awsCreds: %s", err)
-		return err
+		for _, r := range module.Resources {
+			if r.Mode != tfjson.ManagedResourceMode {
+				continue
+			}
+
+			id, _ := r.AttributeValues["id"].(string)
+			arn, _ := r.AttributeValues["arn"].(string)
+
+			resources = append(resources, Resource{
+				StateKey: statefileDir,
+				Address:  r.Address,
+				Type:     r.Type,
+				Name:     r.Name,
+				Provider: r.ProviderName,
+				Id:       id,
+				Arn:      arn,
+			})
+		}
 	}
 
-	err = tf.Init(
-		context.Background(),
-		tfexec.BackendConfig("region=us-east-1"),
-		tfexec.BackendConfig("bucket=bones-server"),
-		tfexec.BackendConfig("encrypt=true"),
-		tfexec.BackendConfig("key=statefiles/"+statefileDir+"/terraform.tfstate"),
-		tfexec.BackendConfig("access_key="+awsCreds.AWS_ACCESS_KEY),
-		tfexec.BackendConfig("secret_key="+awsCreds.AWS_SECRET_KEY),
-	)
+	return resources
+}
+
+func runDestroyTerraform(ctx context.Context, workingDir string, vars map[string]string, statefileDir string) error {
+	tf, err := initTerraform(ctx, workingDir, statefileDir)
 	if err != nil {
-		fmt.Printf("error running Init: %s", err)
 		return err
 	}
 
@@ -216,25 +303,97 @@ func runDestroyTerraform(workingDir string, vars map[string]string, statefileDir
 		tfvars = append(tfvars, tfexec.Var(key+"="+val))
 	}
 
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+
 	fmt.Println("Destroying changes")
-	err = tf.Destroy(context.Background(), tfvars...)
+	destroyCtx, cancel := stateContext(ctx)
+	err = tf.Destroy(destroyCtx, tfvars...)
+	cancel()
 	if err != nil {
 		fmt.Printf("error running destroy: %s", err)
 		return err
 	}
 
+	if run := RunFromContext(ctx); run != nil {
+		run.Destroyed(statefileDir)
+	}
+
 	return nil
 }
 
-func ExecuteTerraform(workingDir string, vars map[string]string, action TerraformAction, statefileDir string) error {
+// ExecuteTerraform runs action against the Terraform configuration in
+// workingDir. When ctx carries a Run, applies wait on Run.AwaitApproval
+// before the saved plan is applied and all output goes to Run.Log.
+//
+// Every command is limited by TERRAFORM_TIMEOUT. Cancelling ctx stops init,
+// plan and a pending approval at once, while an apply or destroy that has
+// already started runs to completion so that no state is lost.
+func ExecuteTerraform(ctx context.Context, workingDir string, vars map[string]string, action TerraformAction, statefileDir string) error {
+	statefileDir = EachDir(ctx, statefileDir)
+
 	switch action {
 	case PlanAction:
 		return nil
 	case ApplyAction:
-		return runApplyTerraform(workingDir, vars, statefileDir)
+		return runApplyTerraform(ctx, workingDir, vars, statefileDir)
 	case DestroyAction:
-		return runDestroyTerraform(workingDir, vars, statefileDir)
+		return runDestroyTerraform(ctx, workingDir, vars, statefileDir)
 	}
 
 	return nil
 }
+
+// Drift is the outcome of planning a stored state against the real
+// infrastructure. Any planned change means reality no longer matches.
+type Drift struct {
+	StateKey string    `json:"stateKey"`
+	Drifted  bool      `json:"drifted"`
+	Changes  []string  `json:"changes,omitempty"`
+	Checked  time.Time `json:"checked"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// DetectDrift runs terraform plan for statefileDir without applying it.
+func DetectDrift(ctx context.Context, workingDir string, vars map[string]string, statefileDir string) (*Drift, error) {
+	statefileDir = EachDir(ctx, statefileDir)
+	drift := &Drift{StateKey: statefileDir, Checked: time.Now()}
+
+	tf, err := initTerraform(ctx, workingDir, statefileDir)
+	if err != nil {
+		return drift, err
+	}
+
+	var tfvars = []tfexec.PlanOption{tfexec.Out(workingDir + "/drift.plan")}
+	for key, val := range vars {
+		tfvars = append(tfvars, tfexec.Var(key+"="+val))
+	}
+	defer os.Remove(workingDir + "/drift.plan")
+
+	cmdCtx, cancel := commandContext(ctx)
+	defer cancel()
+
+	drift.Drifted, err = tf.Plan(cmdCtx, tfvars...)
+	if err != nil {
+		fmt.Printf("error running Plan: %s", err)
+		return drift, err
+	}
+
+	if drift.Drifted {
+		plan, err := tf.ShowPlanFile(cmdCtx, workingDir+"/drift.plan")
+		if err != nil {
+			fmt.Printf("error running fetch plan: %s", err)
+			return drift, err
+		}
+
+		for _, s := range plan.ResourceChanges {
+			if s.Change.Actions.NoOp() || s.Change.Actions.Read() {
+				continue
+			}
+			drift.Changes = append(drift.Changes, fmt.Sprintf("%s %s", s.Change.Actions, s.Address))
+		}
+	}
+
+	return drift, nil
+}
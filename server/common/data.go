@@ -0,0 +1,81 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+// Data holds a project's inputs. Values are whatever JSON allows: strings,
+// booleans, numbers, lists and nested objects. Older projects only have
+// strings.
+type Data map[string]interface{}
+
+// String returns the value of key as text, or "" if it is not set.
+func (data Data) String(key string) string {
+	value, ok := data[key]
+	if !ok || value == nil {
+		return ""
+	}
+
+	if s, ok := value.(string); ok {
+		return s
+	}
+
+	return fmt.Sprint(value)
+}
+
+// DataVarsFile is the tfvars file WriteDataVars writes. Terraform loads it
+// automatically, so plans made later from the project repo see the same
+// values.
+const DataVarsFile = "bones_data.auto.tfvars.json"
+
+var variableBlock = regexp.MustCompile(`variable\s+"([^"]+)"`)
+
+// declaredVariables returns the input variables declared by the .tf files in
+// workingDir.
+func declaredVariables(workingDir string) map[string]bool {
+	declared := make(map[string]bool)
+
+	files, _ := filepath.Glob(workingDir + "/*.tf")
+	for _, file := range files {
+		text, err := os.ReadFile(file)
+		if err != nil {
+			continue
+		}
+
+		for _, match := range variableBlock.FindAllStringSubmatch(string(text), -1) {
+			declared[match[1]] = true
+		}
+	}
+
+	return declared
+}
+
+// WriteDataVars passes data to the configuration in workingDir: every key
+// named like a declared variable is written, with its JSON type, to
+// DataVarsFile. It returns the file's content, or nil when no variable
+// matched and nothing was written.
+func WriteDataVars(workingDir string, data Data) ([]byte, error) {
+	declared := declaredVariables(workingDir)
+
+	vars := make(map[string]interface{})
+	for key, value := range data {
+		if declared[key] {
+			vars[key] = value
+		}
+	}
+
+	if len(vars) == 0 {
+		return nil, nil
+	}
+
+	content, err := json.MarshalIndent(vars, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	return content, os.WriteFile(filepath.Join(workingDir, DataVarsFile), content, 0640)
+}
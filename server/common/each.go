@@ -0,0 +1,54 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+// Each is the item a for_each step is running for.
+type Each struct {
+	Key   string
+	Value interface{}
+	Index int
+}
+
+type eachKey struct{}
+
+// WithEach returns a copy of ctx for the for_each item each. Templates see it
+// as .each, and every state applied with it gets its own key.
+func WithEach(ctx context.Context, each Each) context.Context {
+	return context.WithValue(ctx, eachKey{}, each)
+}
+
+// EachFromContext returns the for_each item carried by ctx, if any.
+func EachFromContext(ctx context.Context) (Each, bool) {
+	each, ok := ctx.Value(eachKey{}).(Each)
+	return each, ok
+}
+
+var unsafeKey = regexp.MustCompile(`[^A-Za-z0-9_.-]+`)
+
+// EachKey names item, the index-th of a for_each list, for state keys and
+// step names: scalars by their value, anything else by its index.
+func EachKey(index int, item interface{}) string {
+	switch item.(type) {
+	case string, bool, float64, int:
+		if key := unsafeKey.ReplaceAllString(fmt.Sprint(item), "-"); key != "" {
+			return key
+		}
+	}
+
+	return strconv.Itoa(index)
+}
+
+// EachDir gives dir its own directory per for_each item, in the project repo
+// and in state keys, e.g. infra/aws-ecs/us-east-1.
+func EachDir(ctx context.Context, dir string) string {
+	if each, ok := EachFromContext(ctx); ok {
+		return dir + "/" + each.Key
+	}
+
+	return dir
+}
@@ -0,0 +1,46 @@
+package common
+
+import (
+	"encoding/json"
+	"os"
+)
+
+// Environment selects one of a project's environments. The zero value is the
+// environment created together with the project.
+type Environment struct {
+	Name string
+	Vars map[string]string
+}
+
+// StateKey returns the state key of infraDir for appName in the environment,
+// e.g. app/infra/aws-ecs for the default environment or
+// app/staging/infra/aws-ecs for staging.
+func (env Environment) StateKey(appName string, infraDir string) string {
+	if env.Name == "" {
+		return appName + "/" + infraDir
+	}
+
+	return appName + "/" + env.Name + "/" + infraDir
+}
+
+// WriteVars writes the environment's variables, plus its name as
+// "environment", to an auto-loaded tfvars file in workingDir. Terraform only
+// warns about values for variables a configuration does not declare, so the
+// same directory works for skeletons that are not environment aware.
+func (env Environment) WriteVars(workingDir string) error {
+	if env.Name == "" {
+		return nil
+	}
+
+	vars := map[string]string{"environment": env.Name}
+	for key, val := range env.Vars {
+		vars[key] = val
+	}
+
+	data, err := json.MarshalIndent(vars, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(workingDir+"/bones_environment.auto.tfvars.json", data, 0640)
+}
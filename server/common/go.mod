@@ -2,11 +2,16 @@ module bones/server/common
 
 go 1.18
 
-require github.com/hashicorp/terraform-exec v0.17.3
+require (
+	github.com/go-git/go-git/v5 v5.5.1
+	github.com/google/uuid v1.3.0
+	github.com/hashicorp/go-version v1.6.0
+	github.com/hashicorp/terraform-exec v0.17.3
+	github.com/hashicorp/terraform-json v0.14.0
+	gopkg.in/yaml.v3 v3.0.1
+)
 
 require (
-	github.com/hashicorp/go-version v1.6.0 // indirect
-	github.com/hashicorp/terraform-json v0.14.0 // indirect
 	github.com/zclconf/go-cty v1.11.0 // indirect
 	golang.org/x/text v0.3.7 // indirect
 )
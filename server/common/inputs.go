@@ -0,0 +1,109 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// Input declares one of the values a skeleton expects in a project's data:
+//
+//	inputs:
+//	  - name: PORTS
+//	    type: list
+//	    default: [8080]
+//	  - name: ENABLE_DATABASE
+//	    type: bool
+//	    required: true
+//
+// Type is one of string (the default), bool, number, list or object.
+type Input struct {
+	Name        string      `json:"name"`
+	Type        string      `json:"type,omitempty"`
+	Description string      `json:"description,omitempty"`
+	Required    bool        `json:"required,omitempty"`
+	Default     interface{} `json:"default,omitempty"`
+}
+
+// coerce converts value to the input's type. Strings are parsed, so that
+// projects created with flat string data keep working.
+func (input Input) coerce(value interface{}) (interface{}, error) {
+	s, isString := value.(string)
+
+	switch input.Type {
+	case "", "string":
+		if isString {
+			return value, nil
+		}
+	case "bool":
+		if isString {
+			if b, err := strconv.ParseBool(s); err == nil {
+				return b, nil
+			}
+		}
+		if _, ok := value.(bool); ok {
+			return value, nil
+		}
+	case "number":
+		if isString {
+			if n, err := strconv.ParseFloat(s, 64); err == nil {
+				return n, nil
+			}
+		}
+		switch value.(type) {
+		case float64, int:
+			return value, nil
+		}
+	case "list":
+		if isString {
+			var list []interface{}
+			if json.Unmarshal([]byte(s), &list) == nil {
+				return list, nil
+			}
+		}
+		if _, ok := value.([]interface{}); ok {
+			return value, nil
+		}
+	case "object":
+		if isString {
+			var object map[string]interface{}
+			if json.Unmarshal([]byte(s), &object) == nil {
+				return object, nil
+			}
+		}
+		if _, ok := value.(map[string]interface{}); ok {
+			return value, nil
+		}
+	default:
+		return nil, fmt.Errorf("input %s has unknown type %q", input.Name, input.Type)
+	}
+
+	return nil, fmt.Errorf("input %s must be a %s, got %v", input.Name, input.Type, value)
+}
+
+// ApplyInputs checks data against the skeleton's inputs, filling in defaults
+// and converting values to their declared types. Keys the skeleton does not
+// declare are left as they are.
+func ApplyInputs(inputs []Input, data Data) error {
+	for _, input := range inputs {
+		value, ok := data[input.Name]
+		if !ok || value == nil {
+			if input.Default != nil {
+				data[input.Name] = input.Default
+				continue
+			}
+			if input.Required {
+				return fmt.Errorf("input %s is required", input.Name)
+			}
+			continue
+		}
+
+		value, err := input.coerce(value)
+		if err != nil {
+			return err
+		}
+		data[input.Name] = value
+	}
+
+	return nil
+}
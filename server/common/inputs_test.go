@@ -0,0 +1,38 @@
+package common
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestApplyInputs(t *testing.T) {
+
+	inputs := []Input{
+		{Name: "ENABLE_DATABASE", Type: "bool"},
+		{Name: "REPLICAS", Type: "number"},
+		{Name: "PORTS", Type: "list", Default: []interface{}{8080}},
+		{Name: "TAGS", Type: "object"},
+	}
+
+	// Flat string data from older clients is converted to the declared types.
+	data := Data{"ENABLE_DATABASE": "true", "REPLICAS": "3", "TAGS": `{"team":"shop"}`}
+	err := ApplyInputs(inputs, data)
+	if err != nil {
+		t.Errorf("expected error to be nil got %v", err)
+	}
+
+	encoded, _ := json.Marshal(data)
+	if string(encoded) != `{"ENABLE_DATABASE":true,"PORTS":[8080],"REPLICAS":3,"TAGS":{"team":"shop"}}` {
+		t.Errorf("expected typed data got %s", encoded)
+	}
+
+	err = ApplyInputs(inputs, Data{"ENABLE_DATABASE": []interface{}{}})
+	if err == nil {
+		t.Errorf("expected an error for a list given to a bool input")
+	}
+
+	err = ApplyInputs([]Input{{Name: "REGION", Required: true}}, Data{})
+	if err == nil {
+		t.Errorf("expected an error for a missing required input")
+	}
+}
@@ -0,0 +1,431 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// Problem is something wrong with a skeleton, at a position in one of its
+// files. Line and Column are 0 when the position isn't known.
+type Problem struct {
+	File    string `json:"file"`
+	Line    int    `json:"line,omitempty"`
+	Column  int    `json:"column,omitempty"`
+	Message string `json:"message"`
+}
+
+func (p Problem) String() string {
+	switch {
+	case p.Column != 0:
+		return fmt.Sprintf("%s:%d:%d: %s", p.File, p.Line, p.Column, p.Message)
+	case p.Line != 0:
+		return fmt.Sprintf("%s:%d: %s", p.File, p.Line, p.Message)
+	}
+
+	return fmt.Sprintf("%s: %s", p.File, p.Message)
+}
+
+// LintOptions says how a skeleton is used.
+type LintOptions struct {
+	// Addon skeletons are applied to existing projects: every file they
+	// open a pull request with is rendered, and they can't use circleci.
+	Addon bool
+}
+
+// lintHandlers are the Terraform directories of the step handlers that apply
+// one. Files lists the files of the directory that the handler needs and
+// renders; when it is empty, every file is rendered.
+var lintHandlers = map[string]struct {
+	dir   string
+	files []string
+}{
+	"aws":      {dir: "infra/aws-ecs"},
+	"circleci": {dir: "infra/circleci", files: []string{"infra/circleci/config.yml"}},
+}
+
+// LintSkeleton reports everything wrong with a skeleton that can be found
+// without running it: a manifest that doesn't parse or doesn't match
+// ManifestSchema, steps defined twice or depending on unknown steps, input
+// defaults of the wrong type, conditions and templates that don't parse,
+// rules that don't load, and steps whose Terraform directory is missing.
+//
+// own is the skeleton's own manifest, which positions are reported in. dir
+// is the skeleton checked out with its includes composed, or "" when it
+// couldn't be, in which case only own is checked.
+func LintSkeleton(dir string, own []byte, options LintOptions) []Problem {
+	l := &linter{dir: dir, options: options}
+
+	var merged *yaml.Node
+	if dir != "" {
+		text, err := os.ReadFile(filepath.Join(dir, manifestFile))
+		if err == nil {
+			merged = parseManifest(text)
+		}
+	}
+
+	l.manifest(own, merged)
+
+	if dir != "" {
+		l.tree()
+	}
+
+	sort.SliceStable(l.problems, func(i, j int) bool {
+		a, b := l.problems[i], l.problems[j]
+		if a.File != b.File {
+			return a.File < b.File
+		}
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Column < b.Column
+	})
+
+	return l.problems
+}
+
+type linter struct {
+	dir      string
+	options  LintOptions
+	problems []Problem
+}
+
+func (l *linter) add(file string, node *yaml.Node, format string, args ...interface{}) {
+	p := Problem{File: file, Message: fmt.Sprintf(format, args...)}
+	if node != nil {
+		p.Line, p.Column = node.Line, node.Column
+	}
+
+	l.problems = append(l.problems, p)
+}
+
+var yamlErrorLine = regexp.MustCompile(`^yaml: line (\d+): (.*)$`)
+
+// yamlProblem reports a YAML syntax error in file.
+func yamlProblem(file string, message string) Problem {
+	p := Problem{File: file, Message: strings.TrimPrefix(message, "yaml: ")}
+	if m := yamlErrorLine.FindStringSubmatch(message); m != nil {
+		p.Line, _ = strconv.Atoi(m[1])
+		p.Message = m[2]
+	}
+
+	return p
+}
+
+// parseManifest returns the top-level node of a manifest, or nil when it
+// doesn't parse.
+func parseManifest(text []byte) *yaml.Node {
+	var doc yaml.Node
+	if yaml.Unmarshal(text, &doc) != nil || len(doc.Content) == 0 {
+		return nil
+	}
+
+	return doc.Content[0]
+}
+
+// field returns the value of key in the mapping node, or nil.
+func field(node *yaml.Node, key string) *yaml.Node {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil
+	}
+
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return resolve(node.Content[i+1])
+		}
+	}
+
+	return nil
+}
+
+func resolve(node *yaml.Node) *yaml.Node {
+	for node != nil && node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+
+	return node
+}
+
+// items returns the entries of a sequence node.
+func items(node *yaml.Node) []*yaml.Node {
+	if node == nil || node.Kind != yaml.SequenceNode {
+		return nil
+	}
+
+	result := make([]*yaml.Node, len(node.Content))
+	for i, item := range node.Content {
+		result[i] = resolve(item)
+	}
+
+	return result
+}
+
+// stepNames returns the names of the steps in a section of a manifest.
+func stepNames(manifest *yaml.Node, section string) map[string]bool {
+	names := make(map[string]bool)
+	for _, step := range items(field(field(manifest, section), "steps")) {
+		if name := field(step, "name"); name != nil {
+			names[name.Value] = true
+		}
+	}
+
+	return names
+}
+
+func (l *linter) manifest(text []byte, merged *yaml.Node) {
+	if text == nil {
+		l.add(manifestFile, nil, "missing")
+		return
+	}
+
+	var doc yaml.Node
+	err := yaml.Unmarshal(text, &doc)
+	if err != nil {
+		l.problems = append(l.problems, yamlProblem(manifestFile, err.Error()))
+		return
+	}
+	if len(doc.Content) == 0 {
+		return
+	}
+	root := resolve(doc.Content[0])
+
+	var schema jsonSchema
+	err = json.Unmarshal(ManifestSchema, &schema)
+	if err != nil {
+		panic(err)
+	}
+	l.validate(root, &schema, &schema, "")
+
+	l.inputs(field(root, "inputs"), "inputs")
+
+	for _, section := range []string{"generate", "destroy"} {
+		known := stepNames(merged, section)
+		l.steps(field(field(root, section), "steps"), section+".steps", known)
+	}
+
+	for i, action := range items(field(root, "actions")) {
+		path := fmt.Sprintf("actions[%d]", i)
+		l.inputs(field(action, "inputs"), path+".inputs")
+		l.steps(field(action, "steps"), path+".steps", nil)
+	}
+}
+
+// inputs checks that input names are unique and defaults have the input's
+// type.
+func (l *linter) inputs(node *yaml.Node, path string) {
+	seen := make(map[string]bool)
+
+	for i, item := range items(node) {
+		name := field(item, "name")
+		if name == nil {
+			continue
+		}
+		if seen[name.Value] {
+			l.add(manifestFile, name, "%s[%d]: input %s is defined twice", path, i, name.Value)
+		}
+		seen[name.Value] = true
+
+		var input Input
+		if item.Decode(&input) != nil || input.Default == nil {
+			continue
+		}
+
+		_, err := input.coerce(input.Default)
+		if err != nil {
+			l.add(manifestFile, field(item, "default"), "%s[%d].default: %v", path, i, err)
+		}
+	}
+}
+
+// steps checks the steps of a section. known are the names of its steps
+// after includes are composed.
+func (l *linter) steps(node *yaml.Node, path string, known map[string]bool) {
+	seen := make(map[string]bool)
+	for _, step := range items(node) {
+		if name := field(step, "name"); name != nil {
+			if known == nil {
+				known = make(map[string]bool)
+			}
+			known[name.Value] = true
+		}
+	}
+
+	for i, step := range items(node) {
+		at := fmt.Sprintf("%s[%d]", path, i)
+
+		name := field(step, "name")
+		if name != nil {
+			if seen[name.Value] {
+				l.add(manifestFile, name, "%s: step %s is defined twice", at, name.Value)
+			}
+			seen[name.Value] = true
+		}
+
+		for j, dep := range items(field(step, "depends_on")) {
+			if !known[dep.Value] {
+				l.add(manifestFile, dep, "%s.depends_on[%d]: unknown step %s", at, j, dep.Value)
+			}
+		}
+
+		if when := field(step, "when"); when != nil && when.Kind == yaml.ScalarNode {
+			_, err := parseTemplate(when.Value, "{{", "}}")
+			if err != nil {
+				l.add(manifestFile, when, "%s.when: %s", at, templateMessage(err))
+			}
+		}
+
+		handler := field(step, "handler")
+		if handler == nil {
+			continue
+		}
+		if l.options.Addon && handler.Value == "circleci" {
+			l.add(manifestFile, handler, "%s.handler: add-ons can't use circleci", at)
+		}
+
+		terraform, ok := lintHandlers[handler.Value]
+		if !ok || l.dir == "" {
+			continue
+		}
+		if !hasTerraform(filepath.Join(l.dir, terraform.dir)) {
+			l.add(manifestFile, handler, "%s.handler: %s needs Terraform files in %s", at, handler.Value, terraform.dir)
+		}
+		for _, file := range terraform.files {
+			if _, err := os.Stat(filepath.Join(l.dir, file)); err != nil {
+				l.add(manifestFile, handler, "%s.handler: %s needs %s", at, handler.Value, file)
+			}
+		}
+	}
+}
+
+func hasTerraform(dir string) bool {
+	files, _ := filepath.Glob(filepath.Join(dir, "*.tf"))
+	return len(files) > 0
+}
+
+// tree checks the rules file and that the templates of the skeleton parse:
+// every file and directory name, and the contents of the files a run
+// renders.
+func (l *linter) tree() {
+	config, err := ReadSkeletonConfig(l.dir)
+	if err != nil {
+		l.problems = append(l.problems, yamlProblem(RulesFile, strings.TrimPrefix(err.Error(), "parsing "+RulesFile+": ")))
+		return
+	}
+	left, right := config.delims()
+
+	for i, rule := range config.Rules {
+		for _, expr := range []string{rule.When, rule.Unless} {
+			if expr == "" {
+				continue
+			}
+			_, err := parseTemplate(expr, left, right)
+			if err != nil {
+				l.add(RulesFile, nil, "rules[%d] %s: %s", i, rule.Path, templateMessage(err))
+			}
+		}
+	}
+
+	filepath.WalkDir(l.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(l.dir, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		if rel == ".git" || rel == ".skeleton" || config.Ignored(rel, d.IsDir()) {
+			return skip(d)
+		}
+
+		name := d.Name()
+		if strings.Contains(name, left) {
+			_, err := parseTemplate(pathTemplate(name, left, right), left, right)
+			if err != nil {
+				l.add(rel, nil, "name: %s", templateMessage(err))
+			}
+		}
+
+		if d.IsDir() || !l.rendered(rel) {
+			return nil
+		}
+		for _, pattern := range config.Raw {
+			if matchPath(pattern, rel) {
+				return nil
+			}
+		}
+
+		text, err := os.ReadFile(path)
+		if err != nil || isBinary(text) {
+			return nil
+		}
+
+		_, err = parseTemplate(string(text), left, right)
+		if err != nil {
+			p := Problem{File: rel, Message: templateMessage(err)}
+			p.Line = templateLine(err)
+			l.problems = append(l.problems, p)
+		}
+
+		return nil
+	})
+}
+
+// rendered reports whether a run renders the contents of the file at rel:
+// those of the Terraform directories, and of every file an add-on opens a
+// pull request with.
+func (l *linter) rendered(rel string) bool {
+	if l.options.Addon && !strings.HasPrefix(rel, "infra/") {
+		return true
+	}
+
+	for _, terraform := range lintHandlers {
+		if !strings.HasPrefix(rel, terraform.dir+"/") {
+			continue
+		}
+		if len(terraform.files) == 0 {
+			return true
+		}
+		for _, file := range terraform.files {
+			if rel == file {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func parseTemplate(text string, left string, right string) (*template.Template, error) {
+	return template.New("lint").Delims(left, right).Funcs(templateFuncs).Parse(text)
+}
+
+var templateError = regexp.MustCompile(`^template: lint:(\d+):(?:\d+:)? ?(.*)$`)
+
+// templateMessage strips the template name and line from a parse error.
+func templateMessage(err error) string {
+	if m := templateError.FindStringSubmatch(err.Error()); m != nil {
+		return m[2]
+	}
+
+	return err.Error()
+}
+
+func templateLine(err error) int {
+	if m := templateError.FindStringSubmatch(err.Error()); m != nil {
+		line, _ := strconv.Atoi(m[1])
+		return line
+	}
+
+	return 0
+}
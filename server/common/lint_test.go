@@ -0,0 +1,89 @@
+package common
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLintSkeleton(t *testing.T) {
+
+	manifest := `inputs:
+  - name: REPLICAS
+    type: number
+    default: many
+  - type: string
+    typ: string
+generate:
+  steps:
+    - name: repo
+      handler: github
+    - name: infra
+      handler: aws
+      when: '{{ if .data.X }}'
+    - name: ci
+      handler: circleci
+      depends_on: [repo, deploy]
+    - name: repo
+      handler: gitlab
+destroy:
+  steps:
+    - name: infra
+      handler: aws
+      depends_on: [base]
+`
+
+	dir := t.TempDir()
+	files := map[string]string{
+		".skeleton/skeleton.yaml": manifest + "    - name: base\n      handler: github\n",
+		".skeleton/rules.yaml":    "rules:\n  - path: docs\n    when: '{{ .data.DOCS'\n",
+		"infra/aws-ecs/main.tf":   "variable \"REPLICAS\" {}\n\n# {{ .data.REPLICAS | nosuch }}\n",
+		"{{ .APP_NAME }}.md":      "{{ not parsed }}",
+		"cmd/{{ end }}/main.go":   "package main",
+	}
+	for name, content := range files {
+		os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0755)
+		os.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+	}
+
+	var lines []string
+	for _, p := range LintSkeleton(dir, []byte(manifest), LintOptions{}) {
+		lines = append(lines, p.String())
+	}
+
+	// The base step comes from an include, as it is only in the merged
+	// manifest.
+	expected := []string{
+		`.skeleton/rules.yaml: rules[0] docs: unclosed action`,
+		`.skeleton/skeleton.yaml:4:14: inputs[0].default: input REPLICAS must be a number, got many`,
+		`.skeleton/skeleton.yaml:5:5: inputs[1]: name is required`,
+		`.skeleton/skeleton.yaml:6:5: inputs[1].typ: unknown field`,
+		`.skeleton/skeleton.yaml:13:13: generate.steps[1].when: unexpected EOF`,
+		`.skeleton/skeleton.yaml:15:16: generate.steps[2].handler: circleci needs Terraform files in infra/circleci`,
+		`.skeleton/skeleton.yaml:15:16: generate.steps[2].handler: circleci needs infra/circleci/config.yml`,
+		`.skeleton/skeleton.yaml:16:26: generate.steps[2].depends_on[1]: unknown step deploy`,
+		`.skeleton/skeleton.yaml:17:13: generate.steps[3]: step repo is defined twice`,
+		`.skeleton/skeleton.yaml:18:16: generate.steps[3].handler: must be one of approval, github, aws, circleci`,
+		`cmd/{{ end }}: name: unexpected {{end}}`,
+		`infra/aws-ecs/main.tf:3: function "nosuch" not defined`,
+	}
+
+	if strings.Join(lines, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected\n%s\ngot\n%s", strings.Join(expected, "\n"), strings.Join(lines, "\n"))
+	}
+
+	// Add-ons render every file and can't use circleci.
+	found := map[string]bool{}
+	for _, p := range LintSkeleton(dir, []byte(manifest), LintOptions{Addon: true}) {
+		found[p.File+": "+p.Message] = true
+	}
+	if !found[`{{ .APP_NAME }}.md: function "parsed" not defined`] || !found[".skeleton/skeleton.yaml: generate.steps[2].handler: add-ons can't use circleci"] {
+		t.Errorf("expected the add-on problems got %v", found)
+	}
+
+	problems := LintSkeleton("", []byte("generate:\n  steps:\n    - name: [\n"), LintOptions{})
+	if len(problems) != 1 || problems[0].File != manifestFile || problems[0].Line == 0 {
+		t.Errorf("expected a syntax error with its line got %v", problems)
+	}
+}
@@ -0,0 +1,56 @@
+package common
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// pluginCacheLock serializes terraform init while the plugin cache is shared,
+// since Terraform doesn't support concurrent installs into one cache and
+// steps run in parallel.
+var pluginCacheLock sync.Mutex
+
+// ConfigurePluginCache points every Terraform invocation at a provider plugin
+// cache shared by all runs, so providers are downloaded once per server
+// instead of once per init. The directory is TF_PLUGIN_CACHE_DIR when set,
+// otherwise bones-plugin-cache under the temp dir.
+func ConfigurePluginCache() string {
+	dir := GetConfig("TF_PLUGIN_CACHE_DIR")
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), "bones-plugin-cache")
+	}
+
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		fmt.Printf("Can't create plugin cache %s: %s\n", dir, err)
+		return ""
+	}
+
+	// tfexec passes the server's environment on to terraform.
+	os.Setenv("TF_PLUGIN_CACHE_DIR", dir)
+	fmt.Printf("Using provider plugin cache %s\n", dir)
+
+	return dir
+}
+
+// PluginCacheEntries counts the provider binaries in the plugin cache.
+func PluginCacheEntries() int {
+	dir := GetConfig("TF_PLUGIN_CACHE_DIR")
+	if dir == "" {
+		return 0
+	}
+
+	entries := 0
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() && strings.HasPrefix(d.Name(), "terraform-provider-") {
+			entries++
+		}
+		return nil
+	})
+
+	return entries
+}
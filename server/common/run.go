@@ -0,0 +1,85 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	tfjson "github.com/hashicorp/terraform-json"
+	"io"
+	"time"
+)
+
+// Run is implemented by the server for every generate or destroy run. It
+// travels on the context handed to the handlers so that the Terraform
+// invocations they make can report back to the run that triggered them.
+type Run interface {
+	// AwaitApproval blocks until the saved plan for statefileDir has been
+	// approved or rejected, or ctx is done. A non-nil error means the plan
+	// must not be applied.
+	AwaitApproval(ctx context.Context, statefileDir string, plan *tfjson.Plan) error
+
+	// Applied is called once the state under statefileDir has been applied,
+	// with the managed resources it now holds. Ctx is the one the state was
+	// applied with.
+	Applied(ctx context.Context, statefileDir string, resources []Resource)
+
+	// Destroyed is called once the state under statefileDir has been destroyed.
+	Destroyed(statefileDir string)
+
+	// Log receives the output of every Terraform command run for the run.
+	Log() io.Writer
+}
+
+type runKey struct{}
+
+// WithRun returns a copy of ctx carrying run.
+func WithRun(ctx context.Context, run Run) context.Context {
+	return context.WithValue(ctx, runKey{}, run)
+}
+
+// RunFromContext returns the run carried by ctx, or nil if there is none.
+func RunFromContext(ctx context.Context) Run {
+	run, _ := ctx.Value(runKey{}).(Run)
+	return run
+}
+
+const defaultTerraformTimeout = 30 * time.Minute
+
+// terraformTimeout reads TERRAFORM_TIMEOUT (e.g. "45m"), the longest a single
+// Terraform command may run before it is killed.
+func terraformTimeout() time.Duration {
+	value := GetConfig("TERRAFORM_TIMEOUT")
+	if value == "" {
+		return defaultTerraformTimeout
+	}
+
+	timeout, err := time.ParseDuration(value)
+	if err != nil || timeout <= 0 {
+		fmt.Printf("Can't parse TERRAFORM_TIMEOUT %q, using %s\n", value, defaultTerraformTimeout)
+		return defaultTerraformTimeout
+	}
+
+	return timeout
+}
+
+// commandContext bounds a single Terraform command by TERRAFORM_TIMEOUT.
+// Cancelling ctx kills the command.
+func commandContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, terraformTimeout())
+}
+
+// stateContext bounds a Terraform command that writes state, i.e. apply and
+// destroy. Killing those halfway leaves resources no state knows about, so
+// they run to completion when ctx is cancelled and only stop at the timeout.
+func stateContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(uncancelled{ctx}, terraformTimeout())
+}
+
+// uncancelled keeps the values of its parent but not its cancellation.
+type uncancelled struct {
+	parent context.Context
+}
+
+func (c uncancelled) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (c uncancelled) Done() <-chan struct{}       { return nil }
+func (c uncancelled) Err() error                  { return nil }
+func (c uncancelled) Value(key any) any           { return c.parent.Value(key) }
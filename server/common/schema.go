@@ -0,0 +1,122 @@
+package common
+
+import (
+	_ "embed"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"strings"
+)
+
+// ManifestSchema is the JSON schema of a skeleton manifest.
+//
+//go:embed skeleton.schema.json
+var ManifestSchema []byte
+
+// jsonSchema is the part of JSON Schema that ManifestSchema uses.
+type jsonSchema struct {
+	Ref                  string                 `json:"$ref"`
+	Type                 string                 `json:"type"`
+	Enum                 []string               `json:"enum"`
+	Properties           map[string]*jsonSchema `json:"properties"`
+	AdditionalProperties *bool                  `json:"additionalProperties"`
+	Required             []string               `json:"required"`
+	Items                *jsonSchema            `json:"items"`
+	Definitions          map[string]*jsonSchema `json:"definitions"`
+}
+
+// validate checks node, at path in the manifest, against schema. Refs are
+// resolved against root. Null values are left alone, as they decode to the
+// zero value.
+func (l *linter) validate(node *yaml.Node, schema *jsonSchema, root *jsonSchema, path string) {
+	node = resolve(node)
+	if node == nil || node.Tag == "!!null" {
+		return
+	}
+
+	if strings.HasPrefix(schema.Ref, "#/definitions/") {
+		ref, ok := root.Definitions[strings.TrimPrefix(schema.Ref, "#/definitions/")]
+		if !ok {
+			panic("unknown schema ref " + schema.Ref)
+		}
+		schema = ref
+	}
+
+	at := path
+	if at == "" {
+		at = "manifest"
+	}
+
+	switch schema.Type {
+	case "object":
+		if node.Kind != yaml.MappingNode {
+			l.add(manifestFile, node, "%s: must be a mapping", at)
+			return
+		}
+	case "array":
+		if node.Kind != yaml.SequenceNode {
+			l.add(manifestFile, node, "%s: must be a list", at)
+			return
+		}
+	case "string":
+		if node.Kind != yaml.ScalarNode {
+			l.add(manifestFile, node, "%s: must be a string", at)
+			return
+		}
+	case "boolean":
+		if node.Kind != yaml.ScalarNode || node.Tag != "!!bool" {
+			l.add(manifestFile, node, "%s: must be true or false", at)
+			return
+		}
+	}
+
+	if schema.Enum != nil {
+		ok := node.Kind == yaml.ScalarNode
+		if ok {
+			ok = false
+			for _, value := range schema.Enum {
+				ok = ok || node.Value == value
+			}
+		}
+		if !ok {
+			l.add(manifestFile, node, "%s: must be one of %s", at, strings.Join(schema.Enum, ", "))
+			return
+		}
+	}
+
+	if schema.Items != nil {
+		for i, item := range node.Content {
+			l.validate(item, schema.Items, root, fmt.Sprintf("%s[%d]", path, i))
+		}
+	}
+
+	if node.Kind != yaml.MappingNode || schema.Properties == nil {
+		return
+	}
+
+	seen := make(map[string]bool)
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key := node.Content[i]
+		seen[key.Value] = true
+
+		at := key.Value
+		if path != "" {
+			at = path + "." + key.Value
+		}
+
+		property, ok := schema.Properties[key.Value]
+		if !ok {
+			if schema.AdditionalProperties != nil && !*schema.AdditionalProperties {
+				l.add(manifestFile, key, "%s: unknown field", at)
+			}
+			continue
+		}
+
+		l.validate(node.Content[i+1], property, root, at)
+	}
+
+	for _, name := range schema.Required {
+		if !seen[name] {
+			l.add(manifestFile, node, "%s: %s is required", at, name)
+		}
+	}
+}
@@ -0,0 +1,380 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/google/uuid"
+	tfjson "github.com/hashicorp/terraform-json"
+	"gopkg.in/yaml.v3"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+	"unicode"
+)
+
+// TemplateContext is what skeleton templates are rendered with. Templates see
+// a map with these keys:
+//
+//	.project   name, slug, id, desc and repo of the project being generated
+//	.type      slug, name, desc, repo and path of its project type
+//	.data      the project's data, e.g. {{ .data.APP_NAME }} or
+//	           {{ range .data.PORTS }}, with values typed as in the API
+//	.outputs   the non-sensitive Terraform outputs applied so far in the run,
+//	           or stored on the project by earlier runs, by output name
+//	.server    name and url of the bones server, and the time the run started
+//	.each      key, value and index of the item a for_each step runs for
+//
+// Every data key is also available at the top level, e.g. {{ .APP_NAME }}, as
+// it was before the context existed. The functions available to templates
+// are listed in templateFuncs.
+type TemplateContext struct {
+	Project map[string]string
+	Type    map[string]string
+	Data    Data
+	Server  map[string]string
+
+	lock    sync.Mutex
+	outputs map[string]interface{}
+}
+
+type templateKey struct{}
+
+// WithTemplateContext returns a copy of ctx that renders templates with tc.
+func WithTemplateContext(ctx context.Context, tc *TemplateContext) context.Context {
+	return context.WithValue(ctx, templateKey{}, tc)
+}
+
+func templateContextFrom(ctx context.Context) *TemplateContext {
+	tc, _ := ctx.Value(templateKey{}).(*TemplateContext)
+	return tc
+}
+
+// SetProject updates a project value seen by the templates rendered after it,
+// such as the repo once the github step has created it.
+func SetProject(ctx context.Context, key string, value string) {
+	tc := templateContextFrom(ctx)
+	if tc == nil {
+		return
+	}
+
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+
+	project := map[string]string{key: value}
+	for k, v := range tc.Project {
+		if k != key {
+			project[k] = v
+		}
+	}
+	tc.Project = project
+}
+
+// recordOutputs adds the outputs of an applied state for later templates.
+func (tc *TemplateContext) recordOutputs(state *tfjson.State) {
+	if state == nil || state.Values == nil {
+		return
+	}
+
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+
+	if tc.outputs == nil {
+		tc.outputs = make(map[string]interface{})
+	}
+
+	for name, output := range state.Values.Outputs {
+		if output != nil && !output.Sensitive {
+			tc.outputs[name] = output.Value
+		}
+	}
+}
+
+// SetOutputs seeds the outputs templates see with those of earlier runs, such
+// as a project's when an add-on is applied to it.
+func (tc *TemplateContext) SetOutputs(outputs map[string]interface{}) {
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+
+	tc.outputs = make(map[string]interface{})
+	for name, value := range outputs {
+		tc.outputs[name] = value
+	}
+}
+
+// Outputs returns the outputs known to the template context carried by ctx,
+// including those applied so far in the run.
+func Outputs(ctx context.Context) map[string]interface{} {
+	outputs := make(map[string]interface{})
+
+	tc := templateContextFrom(ctx)
+	if tc == nil {
+		return outputs
+	}
+
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+
+	for name, value := range tc.outputs {
+		outputs[name] = value
+	}
+
+	return outputs
+}
+
+func (tc *TemplateContext) values(data Data) map[string]interface{} {
+	values := make(map[string]interface{})
+	outputs := make(map[string]interface{})
+
+	if tc != nil {
+		tc.lock.Lock()
+		for name, value := range tc.outputs {
+			outputs[name] = value
+		}
+		values["project"] = tc.Project
+		tc.lock.Unlock()
+
+		values["type"] = tc.Type
+		values["server"] = tc.Server
+		if data == nil {
+			data = tc.Data
+		}
+	}
+
+	for key, value := range data {
+		values[key] = value
+	}
+	values["data"] = data
+	values["outputs"] = outputs
+
+	return values
+}
+
+// RenderTemplate renders text with the template context carried by ctx. Data
+// takes precedence over the context's own data when it is non-nil.
+func RenderTemplate(ctx context.Context, name string, text []byte, data Data) ([]byte, error) {
+	return renderText(ctx, name, text, data, "{{", "}}")
+}
+
+// Condition renders expr, such as a step's when, and reports whether the
+// result is true. Empty, false, 0, no and off are false.
+func Condition(ctx context.Context, expr string, data Data) (bool, error) {
+	out, err := RenderTemplate(ctx, "when", []byte(expr), data)
+	if err != nil {
+		return false, err
+	}
+
+	return truthy(string(out)), nil
+}
+
+func renderText(ctx context.Context, name string, text []byte, data Data, left string, right string) ([]byte, error) {
+	tmpl, err := template.New(name).Delims(left, right).Funcs(templateFuncs).Parse(string(text))
+	if err != nil {
+		return nil, err
+	}
+
+	values := templateContextFrom(ctx).values(data)
+	if each, ok := EachFromContext(ctx); ok {
+		values["each"] = map[string]interface{}{"key": each.Key, "value": each.Value, "index": each.Index}
+	}
+
+	buf := &bytes.Buffer{}
+	err = tmpl.Execute(buf, values)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// words splits s into lowercase words at spaces, punctuation and case
+// changes, so that "MyApp name" and "my-app_name" both give my, app, name.
+func words(s string) []string {
+	var result []string
+	var word []rune
+
+	runes := []rune(s)
+	for i, r := range runes {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			if len(word) > 0 {
+				result = append(result, string(word))
+				word = nil
+			}
+			continue
+		}
+
+		if unicode.IsUpper(r) && len(word) > 0 {
+			prev := runes[i-1]
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) || (unicode.IsUpper(prev) && nextLower) {
+				result = append(result, string(word))
+				word = nil
+			}
+		}
+
+		word = append(word, unicode.ToLower(r))
+	}
+
+	if len(word) > 0 {
+		result = append(result, string(word))
+	}
+
+	return result
+}
+
+// text formats a template value as a string, so that the string helpers also
+// take numbers, bools and missing values.
+func text(value interface{}) string {
+	if value == nil {
+		return ""
+	}
+
+	return fmt.Sprint(value)
+}
+
+// squote quotes s for YAML, where a single-quoted string doubles every
+// single quote in it.
+func squote(s interface{}) string {
+	return "'" + strings.ReplaceAll(text(s), "'", "''") + "'"
+}
+
+// join joins the elements of a list, of any element type, with sep.
+func join(sep string, list interface{}) string {
+	v := reflect.ValueOf(list)
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return text(list)
+	}
+
+	elems := make([]string, v.Len())
+	for i := range elems {
+		elems[i] = text(v.Index(i).Interface())
+	}
+
+	return strings.Join(elems, sep)
+}
+
+func capitalize(word string) string {
+	runes := []rune(word)
+	runes[0] = unicode.ToUpper(runes[0])
+	return string(runes)
+}
+
+func camel(s string) string {
+	w := words(s)
+	for i := 1; i < len(w); i++ {
+		w[i] = capitalize(w[i])
+	}
+	return strings.Join(w, "")
+}
+
+func pascal(s string) string {
+	return strings.ReplaceAll(title(s), " ", "")
+}
+
+func title(s string) string {
+	w := words(s)
+	for i := range w {
+		w[i] = capitalize(w[i])
+	}
+	return strings.Join(w, " ")
+}
+
+// empty reports whether value is nil, false, zero or has no elements.
+func empty(value interface{}) bool {
+	if value == nil {
+		return true
+	}
+
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.String, reflect.Array, reflect.Slice, reflect.Map:
+		return v.Len() == 0
+	case reflect.Ptr, reflect.Interface:
+		return v.IsNil()
+	}
+
+	return v.IsZero()
+}
+
+func indent(spaces int, s string) string {
+	pad := strings.Repeat(" ", spaces)
+	return pad + strings.ReplaceAll(s, "\n", "\n"+pad)
+}
+
+func toYaml(value interface{}) (string, error) {
+	buf := &bytes.Buffer{}
+
+	encoder := yaml.NewEncoder(buf)
+	encoder.SetIndent(2)
+	err := encoder.Encode(value)
+	encoder.Close()
+
+	return strings.TrimSuffix(buf.String(), "\n"), err
+}
+
+func toJson(value interface{}) (string, error) {
+	out, err := json.Marshal(value)
+	return string(out), err
+}
+
+// templateFuncs is the function library available to every template.
+var templateFuncs = template.FuncMap{
+	// Case helpers, e.g. {{ .project.name | kebab }}. They and the string
+	// helpers take any value, formatted as with fmt.Sprint.
+	"lower":  func(s interface{}) string { return strings.ToLower(text(s)) },
+	"upper":  func(s interface{}) string { return strings.ToUpper(text(s)) },
+	"title":  func(s interface{}) string { return title(text(s)) },
+	"camel":  func(s interface{}) string { return camel(text(s)) },
+	"pascal": func(s interface{}) string { return pascal(text(s)) },
+	"snake":  func(s interface{}) string { return strings.Join(words(text(s)), "_") },
+	"kebab":  func(s interface{}) string { return strings.Join(words(text(s)), "-") },
+
+	// Strings, e.g. {{ join "," .data.PORTS }}.
+	"trim":      func(s interface{}) string { return strings.TrimSpace(text(s)) },
+	"replace":   func(old string, new string, s interface{}) string { return strings.ReplaceAll(text(s), old, new) },
+	"contains":  func(substr string, s interface{}) bool { return strings.Contains(text(s), substr) },
+	"hasPrefix": func(prefix string, s interface{}) bool { return strings.HasPrefix(text(s), prefix) },
+	"hasSuffix": func(suffix string, s interface{}) bool { return strings.HasSuffix(text(s), suffix) },
+	"split":     func(sep string, s interface{}) []string { return strings.Split(text(s), sep) },
+	"join":      join,
+	"quote":     func(s interface{}) string { return strconv.Quote(text(s)) },
+	"squote":    squote,
+	"indent":    func(spaces int, s interface{}) string { return indent(spaces, text(s)) },
+	"nindent":   func(spaces int, s interface{}) string { return "\n" + indent(spaces, text(s)) },
+
+	// Defaults and conditionals, e.g. {{ .data.PORT | default "8080" }}.
+	"default": func(def interface{}, value interface{}) interface{} {
+		if empty(value) {
+			return def
+		}
+		return value
+	},
+	"empty": empty,
+	"coalesce": func(values ...interface{}) interface{} {
+		for _, value := range values {
+			if !empty(value) {
+				return value
+			}
+		}
+		return nil
+	},
+	"ternary": func(yes interface{}, no interface{}, cond bool) interface{} {
+		if cond {
+			return yes
+		}
+		return no
+	},
+
+	// Encoding.
+	"toYaml": toYaml,
+	"toJson": toJson,
+
+	// Generated values, e.g. {{ now | date "2006-01-02" }}.
+	"uuid": func() string { return uuid.New().String() },
+	"now":  time.Now,
+	"date": func(layout string, t time.Time) string { return t.Format(layout) },
+}
@@ -0,0 +1,176 @@
+package common
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRenderTemplate(t *testing.T) {
+
+	ctx := WithTemplateContext(context.Background(), &TemplateContext{
+		Project: map[string]string{"name": "My Shop API"},
+		Data:    Data{"APP_NAME": "my-shop-api", "PORTS": []interface{}{80, 443}, "DATABASE": true},
+	})
+
+	tests := map[string]string{
+		`{{ .APP_NAME }}`:                          "my-shop-api",
+		`{{ .data.APP_NAME | pascal }}`:            "MyShopApi",
+		`{{ .project.name | snake }}`:              "my_shop_api",
+		`{{ .project.name | camel }}`:              "myShopApi",
+		`{{ "HTTPServer" | kebab }}`:               "http-server",
+		`{{ .data.PORT | default "8080" }}`:        "8080",
+		`{{ .project.name | quote }}`:              `"My Shop API"`,
+		`{{ .data | toJson }}`:                     `{"APP_NAME":"my-shop-api","DATABASE":true,"PORTS":[80,443]}`,
+		`{{ .data | toYaml | nindent 2 }}`:         "\n  APP_NAME: my-shop-api\n  DATABASE: true\n  PORTS:\n    - 80\n    - 443",
+		`{{ if empty .outputs }}none{{ end }}`:     "none",
+		`{{ range .data.PORTS }}{{ . }} {{ end }}`: "80 443 ",
+		`{{ if .data.DATABASE }}db{{ end }}`:       "db",
+	}
+
+	for text, expected := range tests {
+		rendered, err := RenderTemplate(ctx, "test", []byte(text), nil)
+		if err != nil {
+			t.Errorf("%s: expected error to be nil got %v", text, err)
+		}
+		if string(rendered) != expected {
+			t.Errorf("%s: expected %q got %q", text, expected, rendered)
+		}
+	}
+}
+
+func TestTemplateFuncsTypedData(t *testing.T) {
+
+	// Structured data reaches templates as it was decoded from JSON.
+	data := Data{"PORTS": []interface{}{80.0, 443.0}, "TAGS": []string{"a", "b"}, "REPLICAS": 3.0, "DATABASE": true, "NAME": "My App"}
+
+	tests := map[string]string{
+		`{{ join "," .data.PORTS }}`:            "80,443",
+		`{{ join "-" .data.TAGS }}`:             "a-b",
+		`{{ join "," .data.REPLICAS }}`:         "3",
+		`{{ .data.REPLICAS | upper }}`:          "3",
+		`{{ .data.DATABASE | title }}`:          "True",
+		`{{ .data.DATABASE | upper }}`:          "TRUE",
+		`{{ .data.MISSING | lower }}`:           "",
+		`{{ .data.NAME | kebab }}`:              "my-app",
+		`{{ contains "44" (join "," .PORTS) }}`: "true",
+		`{{ .REPLICAS | trim }}`:                "3",
+		`{{ .data.MISSING | quote }}`:           `""`,
+		`{{ .data.MISSING | squote }}`:          `''`,
+		`{{ "say \"hi\"" | quote }}`:            `"say \"hi\""`,
+		`{{ "it's" | squote }}`:                 `'it''s'`,
+	}
+
+	for text, expected := range tests {
+		rendered, err := RenderTemplate(context.Background(), "test", []byte(text), data)
+		if err != nil {
+			t.Errorf("%s: expected error to be nil got %v", text, err)
+		}
+		if string(rendered) != expected {
+			t.Errorf("%s: expected %q got %q", text, expected, rendered)
+		}
+	}
+}
+
+func TestCopyTree(t *testing.T) {
+
+	src := t.TempDir()
+	os.MkdirAll(filepath.Join(src, ".skeleton"), 0755)
+	os.MkdirAll(filepath.Join(src, "cmd", "{{APP_NAME}}"), 0755)
+	os.MkdirAll(filepath.Join(src, "worker"), 0755)
+	os.WriteFile(filepath.Join(src, "cmd", "{{APP_NAME}}", "main.go"), []byte("package main"), 0644)
+	os.WriteFile(filepath.Join(src, "worker", "main.go"), []byte("package main"), 0644)
+	os.WriteFile(filepath.Join(src, "{{ if .DOCKER }}Dockerfile{{ end }}"), nil, 0644)
+	os.WriteFile(filepath.Join(src, ".skeleton", "rules.yaml"), []byte(`rules:
+  - path: worker
+    when: '{{ eq .data.WORKER "true" }}'
+`), 0644)
+
+	dst := t.TempDir()
+	err := CopyTree(context.Background(), src, dst, Data{"APP_NAME": "shop", "WORKER": "false"})
+	if err != nil {
+		t.Errorf("expected error to be nil got %v", err)
+	}
+
+	for path, expected := range map[string]bool{
+		"cmd/shop/main.go":     true,
+		".skeleton/rules.yaml": true,
+		"worker":               false,
+		"Dockerfile":           false,
+	} {
+		_, err := os.Stat(filepath.Join(dst, path))
+		if (err == nil) != expected {
+			t.Errorf("%s: expected exists to be %v got %v", path, expected, err == nil)
+		}
+	}
+}
+
+func TestRenderFileRawAndDelimiters(t *testing.T) {
+
+	root := t.TempDir()
+	os.MkdirAll(filepath.Join(root, ".skeleton"), 0755)
+	os.MkdirAll(filepath.Join(root, ".github"), 0755)
+	os.WriteFile(filepath.Join(root, ".skeleton", "rules.yaml"), []byte(`delimiters: ["[[", "]]"]
+raw:
+  - .github
+`), 0644)
+	os.WriteFile(filepath.Join(root, "config.yml"), []byte("name: [[ .APP_NAME ]]\ntoken: ${{ secrets.TOKEN }}"), 0644)
+	os.WriteFile(filepath.Join(root, ".github", "build.yml"), []byte("[[ .APP_NAME ]]"), 0644)
+	os.WriteFile(filepath.Join(root, "logo.png"), []byte("\x89PNG\x00[[ .APP_NAME ]]"), 0644)
+
+	skeleton, err := ReadSkeletonConfig(root)
+	if err != nil {
+		t.Errorf("expected error to be nil got %v", err)
+	}
+
+	data := Data{"APP_NAME": "shop"}
+	for path, expected := range map[string]string{
+		"config.yml":        "name: shop\ntoken: ${{ secrets.TOKEN }}",
+		".github/build.yml": "[[ .APP_NAME ]]",
+		"logo.png":          "\x89PNG\x00[[ .APP_NAME ]]",
+	} {
+		rendered, err := skeleton.RenderFile(context.Background(), filepath.Join(root, path), data)
+		if err != nil {
+			t.Errorf("%s: expected error to be nil got %v", path, err)
+		}
+		if string(rendered) != expected {
+			t.Errorf("%s: expected %q got %q", path, expected, rendered)
+		}
+	}
+}
+
+func TestCopyTreeIgnore(t *testing.T) {
+
+	src := t.TempDir()
+	os.MkdirAll(filepath.Join(src, ".skeleton"), 0755)
+	os.MkdirAll(filepath.Join(src, "testdata"), 0755)
+	os.WriteFile(filepath.Join(src, ".skeletonignore"), []byte("# author files\n*.notes\ntestdata/\n.skeleton/\n!keep.notes\n"), 0644)
+	os.WriteFile(filepath.Join(src, ".skeleton", "skeleton.yaml"), nil, 0644)
+	os.WriteFile(filepath.Join(src, ".skeleton", "rules.yaml"), nil, 0644)
+	os.WriteFile(filepath.Join(src, "testdata", "fixture.json"), nil, 0644)
+	os.WriteFile(filepath.Join(src, "todo.notes"), nil, 0644)
+	os.WriteFile(filepath.Join(src, "keep.notes"), nil, 0644)
+	os.WriteFile(filepath.Join(src, "main.go"), nil, 0644)
+
+	dst := t.TempDir()
+	err := CopyTree(context.Background(), src, dst, nil)
+	if err != nil {
+		t.Errorf("expected error to be nil got %v", err)
+	}
+
+	for path, expected := range map[string]bool{
+		"main.go":                 true,
+		"keep.notes":              true,
+		".skeleton/skeleton.yaml": true,
+		".skeleton/rules.yaml":    false,
+		".skeletonignore":         false,
+		"testdata":                false,
+		"todo.notes":              false,
+	} {
+		_, err := os.Stat(filepath.Join(dst, path))
+		if (err == nil) != expected {
+			t.Errorf("%s: expected exists to be %v got %v", path, expected, err == nil)
+		}
+	}
+}
@@ -0,0 +1,386 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/go-git/go-git/v5/plumbing/format/gitignore"
+	"gopkg.in/yaml.v3"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// RulesFile configures how a skeleton is rendered. It lives next to the
+// manifest, relative to the skeleton's root:
+//
+//	delimiters: ["[[", "]]"]
+//	raw:
+//	  - .github
+//	  - "*.tpl"
+//	rules:
+//	  - path: cmd/worker
+//	    when: '{{ .data.WORKER }}'
+//	  - path: "*.md"
+//	    unless: '{{ .data.NO_DOCS }}'
+//
+// Delimiters replace {{ and }} in file contents, file names and rule
+// conditions, for skeletons whose files are themselves full of braces.
+//
+// Raw files are copied without rendering. Binary files always are.
+//
+// A path is left out when a matching rule's when renders to an empty or
+// false value, or its unless renders to a true one.
+//
+// Raw and rule paths are filepath.Match patterns against the path in the
+// skeleton, before its names are rendered. A pattern matching a directory
+// covers everything in it, and one without a slash also matches file names
+// anywhere in the tree.
+const RulesFile = ".skeleton/rules.yaml"
+
+// IgnoreFile lists, with gitignore syntax, the paths of a skeleton that never
+// reach the generated project, such as test fixtures and author notes. The
+// ignore file itself is never copied, and the manifest always is, since
+// projects need it to be destroyed.
+const IgnoreFile = ".skeletonignore"
+
+// TestsDir holds a skeleton's tests: sample inputs and the files they are
+// expected to render to. It never reaches the generated project.
+const TestsDir = ".skeleton/tests"
+
+const manifestFile = ".skeleton/skeleton.yaml"
+
+type SkeletonRule struct {
+	Path   string `yaml:"path"`
+	When   string `yaml:"when"`
+	Unless string `yaml:"unless"`
+}
+
+// SkeletonConfig is the content of a skeleton's RulesFile.
+type SkeletonConfig struct {
+	Delimiters []string       `yaml:"delimiters"`
+	Raw        []string       `yaml:"raw"`
+	Rules      []SkeletonRule `yaml:"rules"`
+
+	root   string
+	ignore gitignore.Matcher
+}
+
+// ReadSkeletonConfig loads the rules file of the skeleton in dir. A skeleton
+// without one renders everything with the default delimiters.
+func ReadSkeletonConfig(dir string) (*SkeletonConfig, error) {
+	config := &SkeletonConfig{root: dir}
+
+	ignore, err := os.ReadFile(filepath.Join(dir, IgnoreFile))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	var patterns []gitignore.Pattern
+	for _, line := range strings.Split(string(ignore), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, gitignore.ParsePattern(line, nil))
+	}
+	config.ignore = gitignore.NewMatcher(patterns)
+
+	data, err := os.ReadFile(filepath.Join(dir, RulesFile))
+	if os.IsNotExist(err) {
+		return config, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = yaml.Unmarshal(data, config)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", RulesFile, err)
+	}
+
+	if len(config.Delimiters) != 0 && (len(config.Delimiters) != 2 || config.Delimiters[0] == "" || config.Delimiters[1] == "") {
+		return nil, fmt.Errorf("parsing %s: delimiters must be a left and a right delimiter", RulesFile)
+	}
+
+	return config, nil
+}
+
+func (config *SkeletonConfig) delims() (string, string) {
+	if len(config.Delimiters) != 2 {
+		return "{{", "}}"
+	}
+
+	return config.Delimiters[0], config.Delimiters[1]
+}
+
+// matchPath reports whether pattern matches rel or one of its parents, or,
+// for a pattern without a slash, its file name.
+func matchPath(pattern string, rel string) bool {
+	rel = filepath.ToSlash(rel)
+
+	if !strings.Contains(pattern, "/") {
+		if ok, _ := filepath.Match(pattern, filepath.Base(rel)); ok {
+			return true
+		}
+	}
+
+	for p := rel; p != "." && p != "/"; p = filepath.Dir(p) {
+		if ok, _ := filepath.Match(pattern, p); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Ignored reports whether rel, a path in the skeleton, is left out of the
+// generated project by the ignore file.
+func (config *SkeletonConfig) Ignored(rel string, isDir bool) bool {
+	rel = filepath.ToSlash(rel)
+
+	switch rel {
+	case IgnoreFile, TestsDir:
+		return true
+	case manifestFile, ".skeleton":
+		return false
+	}
+
+	return config.ignore.Match(strings.Split(rel, "/"), isDir)
+}
+
+// truthy reports whether a rendered condition holds.
+func truthy(value string) bool {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "", "false", "0", "no", "off", "<no value>":
+		return false
+	}
+
+	return true
+}
+
+func (config *SkeletonConfig) render(ctx context.Context, name string, text string, data Data) (string, error) {
+	left, right := config.delims()
+	out, err := renderText(ctx, name, []byte(text), data, left, right)
+	return string(out), err
+}
+
+// includes applies the rules matching rel.
+func (config *SkeletonConfig) includes(ctx context.Context, rel string, data Data) (bool, error) {
+	for _, rule := range config.Rules {
+		if !matchPath(rule.Path, rel) {
+			continue
+		}
+
+		if rule.When != "" {
+			out, err := config.render(ctx, rule.Path, rule.When, data)
+			if err != nil || !truthy(out) {
+				return false, err
+			}
+		}
+
+		if rule.Unless != "" {
+			out, err := config.render(ctx, rule.Path, rule.Unless, data)
+			if err != nil || truthy(out) {
+				return false, err
+			}
+		}
+	}
+
+	return true, nil
+}
+
+var templateKeywords = map[string]bool{
+	"else": true, "end": true, "nil": true, "break": true, "continue": true,
+}
+
+// bareName is an action of a path template that is only a name, such as
+// APP_NAME in {{APP_NAME}}.
+var bareName = regexp.MustCompile(`^\s*([A-Za-z_][A-Za-z0-9_]*)\s*$`)
+
+// pathTemplate expands the {{APP_NAME}} shorthand for {{ .APP_NAME }} in a
+// segment of a path.
+func pathTemplate(segment string, left string, right string) string {
+	var out strings.Builder
+
+	for {
+		start := strings.Index(segment, left)
+		if start < 0 {
+			break
+		}
+		end := strings.Index(segment[start+len(left):], right)
+		if end < 0 {
+			break
+		}
+		end += start + len(left)
+
+		out.WriteString(segment[:start])
+
+		action := segment[start+len(left) : end]
+		match := bareName.FindStringSubmatch(action)
+		if match == nil || templateKeywords[match[1]] {
+			out.WriteString(left + action + right)
+		} else if _, ok := templateFuncs[match[1]]; ok {
+			out.WriteString(left + action + right)
+		} else {
+			out.WriteString(left + " ." + match[1] + " " + right)
+		}
+
+		segment = segment[end+len(right):]
+	}
+
+	out.WriteString(segment)
+	return out.String()
+}
+
+// RenderPath renders every segment of rel as a template, so that
+// cmd/{{ .APP_NAME }}/main.go, or cmd/{{APP_NAME}}/main.go for short, becomes
+// cmd/shop/main.go. A segment that renders empty drops the path, which
+// reports false.
+func (config *SkeletonConfig) RenderPath(ctx context.Context, rel string, data Data) (string, bool, error) {
+	left, right := config.delims()
+
+	segments := strings.Split(filepath.ToSlash(rel), "/")
+
+	for i, segment := range segments {
+		if !strings.Contains(segment, left) {
+			continue
+		}
+
+		out, err := config.render(ctx, rel, pathTemplate(segment, left, right), data)
+		if err != nil {
+			return "", false, fmt.Errorf("rendering path %s: %w", rel, err)
+		}
+
+		segments[i] = strings.TrimSpace(out)
+		if segments[i] == "" {
+			return "", false, nil
+		}
+		if strings.Contains(segments[i], "/") || segments[i] == ".." {
+			return "", false, fmt.Errorf("rendering path %s: %q is not a file name", rel, segments[i])
+		}
+	}
+
+	return filepath.Join(segments...), true, nil
+}
+
+// isBinary guesses whether data is a binary file from its first 8000 bytes,
+// the way git does, plus a check that the text is UTF-8.
+func isBinary(data []byte) bool {
+	if len(data) > 8000 {
+		data = data[:8000]
+	}
+
+	if bytes.IndexByte(data, 0) != -1 {
+		return true
+	}
+
+	// A multi-byte rune may have been cut at the end.
+	for i := 0; i < utf8.UTFMax && len(data) > 0 && !utf8.Valid(data); i++ {
+		data = data[:len(data)-1]
+	}
+
+	return !utf8.Valid(data)
+}
+
+// RenderFile renders the template at path, inside the skeleton, in place and
+// returns the result. Raw and binary files are returned as they are.
+func (config *SkeletonConfig) RenderFile(ctx context.Context, path string, data Data) ([]byte, error) {
+	text, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	rel, err := filepath.Rel(config.root, path)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, pattern := range config.Raw {
+		if matchPath(pattern, rel) {
+			return text, nil
+		}
+	}
+
+	if isBinary(text) {
+		return text, nil
+	}
+
+	rendered, err := config.render(ctx, rel, string(text), data)
+	if err != nil {
+		return nil, fmt.Errorf("rendering %s: %w", rel, err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(rendered), os.WriteFile(path, []byte(rendered), info.Mode())
+}
+
+// CopyTree copies the skeleton at src into dst, leaving out what the ignore
+// and rules files exclude and rendering file and directory names. File
+// contents are copied as they are. Names in the .skeleton directory are not
+// rendered, since projects keep their manifest.
+func CopyTree(ctx context.Context, src string, dst string, data Data) error {
+	config, err := ReadSkeletonConfig(src)
+	if err != nil {
+		return err
+	}
+
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil || rel == "." {
+			return err
+		}
+
+		if rel == ".git" || config.Ignored(rel, d.IsDir()) {
+			return skip(d)
+		}
+
+		target := rel
+		if rel != ".skeleton" && !strings.HasPrefix(rel, ".skeleton"+string(filepath.Separator)) {
+			ok, err := config.includes(ctx, rel, data)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return skip(d)
+			}
+
+			target, ok, err = config.RenderPath(ctx, rel, data)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return skip(d)
+			}
+		}
+
+		if d.IsDir() {
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			return os.MkdirAll(filepath.Join(dst, target), info.Mode())
+		}
+
+		return File(path, filepath.Join(dst, target))
+	})
+}
+
+func skip(d fs.DirEntry) error {
+	if d.IsDir() {
+		return filepath.SkipDir
+	}
+
+	return nil
+}
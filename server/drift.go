@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/bones/server/common"
+	aws "github.com/bones/server/handlers/aws"
+	circleci "github.com/bones/server/handlers/circleci"
+	github "github.com/bones/server/handlers/github"
+	"github.com/gorilla/mux"
+	"net/http"
+	"time"
+)
+
+const defaultDriftInterval = 24 * time.Hour
+
+// ProjectDrift is the result of the last drift check of a project.
+type ProjectDrift struct {
+	Checked time.Time       `json:"checked"`
+	Drifted bool            `json:"drifted"`
+	States  []*common.Drift `json:"states"`
+}
+
+// driftInterval reads DRIFT_INTERVAL (e.g. "6h"). Zero disables the job.
+func driftInterval() time.Duration {
+	value := common.GetConfig("DRIFT_INTERVAL")
+	if value == "" {
+		return defaultDriftInterval
+	}
+
+	interval, err := time.ParseDuration(value)
+	if err != nil {
+		fmt.Printf("Can't parse DRIFT_INTERVAL %q, using %s: %s\n", value, defaultDriftInterval, err)
+		return defaultDriftInterval
+	}
+
+	return interval
+}
+
+func detectStateDrift(ctx context.Context, project *Project, state ProjectState) (*common.Drift, error) {
+	env := projectEnvironment(project, state.Environment)
+	ctx = state.context(ctx)
+
+	switch state.Handler {
+	case "github":
+		return github.DetectRepoDrift(ctx, project.Name)
+	case "aws":
+		return aws.DetectAWSInfraDrift(ctx, project.Name, project.Repo, env)
+	case "circleci":
+		return circleci.DetectProjectDrift(ctx, project.Name, project.Repo, env)
+	}
+
+	return nil, fmt.Errorf("handler %s does not support drift detection", state.Handler)
+}
+
+func reconcileState(ctx context.Context, project *Project, state ProjectState) error {
+	env := projectEnvironment(project, state.Environment)
+	ctx = state.context(ctx)
+
+	switch state.Handler {
+	case "github":
+		return github.ReconcileRepo(ctx, project.Name)
+	case "aws":
+		return aws.ApplyAWSInfra(ctx, project.Name, project.Repo, env)
+	case "circleci":
+		return circleci.ApplyProject(ctx, project.Name, project.Repo, env)
+	}
+
+	return fmt.Errorf("handler %s does not support reconciling", state.Handler)
+}
+
+// detectProjectDrift plans every state recorded on the project and stores
+// the outcome on it.
+func detectProjectDrift(project *Project) *ProjectDrift {
+	runsLock.Lock()
+	states := append([]ProjectState{}, project.States...)
+	runsLock.Unlock()
+
+	result := &ProjectDrift{Checked: time.Now(), States: []*common.Drift{}}
+
+	for _, state := range states {
+		drift, err := detectStateDrift(projectContext(project, nil), project, state)
+		if drift == nil {
+			drift = &common.Drift{StateKey: state.Key, Checked: time.Now()}
+		}
+		if err != nil {
+			drift.Error = err.Error()
+			fmt.Printf("Drift detection failed for %s: %s\n", state.Key, err)
+		}
+
+		result.Drifted = result.Drifted || drift.Drifted
+		result.States = append(result.States, drift)
+	}
+
+	runsLock.Lock()
+	project.Drift = result
+	runsLock.Unlock()
+
+	return result
+}
+
+// detectDrift checks every project that has applied state and no run in
+// progress.
+func detectDrift() {
+	var projects []*Project
+
+	runsLock.Lock()
+	for _, project := range Projects {
+		if len(project.States) > 0 && !projectBusy(project.Id) {
+			projects = append(projects, project)
+		}
+	}
+	runsLock.Unlock()
+
+	fmt.Printf("Checking %d projects for drift\n", len(projects))
+
+	for _, project := range projects {
+		if detectProjectDrift(project).Drifted {
+			fmt.Printf("Project %s (%s) has drifted\n", project.Name, project.Id)
+		}
+	}
+}
+
+func scheduleDriftDetection(interval time.Duration) {
+	if interval <= 0 {
+		fmt.Println("Drift detection disabled")
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			detectDrift()
+		}
+	}()
+}
+
+func returnProjectDrift(w http.ResponseWriter, r *http.Request) {
+	project, ok := lookupProject(mux.Vars(r)["id"])
+	if !ok {
+		http.Error(w, "Project Not Found", http.StatusNotFound)
+		return
+	}
+
+	runsLock.Lock()
+	defer runsLock.Unlock()
+
+	drift := project.Drift
+	if drift == nil {
+		drift = &ProjectDrift{States: []*common.Drift{}}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(drift)
+}
+
+// reconcileProjectDrift re-applies every state found drifted by the last
+// check and checks the project again afterwards. The plans of states applied
+// after an approval step wait for sign-off again.
+func reconcileProjectDrift(w http.ResponseWriter, r *http.Request) {
+	project, ok := lookupProject(mux.Vars(r)["id"])
+	if !ok {
+		http.Error(w, "Project Not Found", http.StatusNotFound)
+		return
+	}
+
+	runsLock.Lock()
+	var drifted []ProjectState
+	if project.Drift != nil {
+		for _, drift := range project.Drift.States {
+			for _, state := range project.States {
+				if drift.Drifted && state.Key == drift.StateKey {
+					drifted = append(drifted, state)
+				}
+			}
+		}
+	}
+
+	var run *Run
+	if len(drifted) > 0 {
+		run = startRun(project, "reconcile")
+	}
+	if run != nil {
+		project.LastRun = run.Id
+	}
+	runsLock.Unlock()
+
+	if len(drifted) == 0 {
+		http.Error(w, "Project has no drift to reconcile", http.StatusConflict)
+		return
+	}
+
+	if run == nil {
+		http.Error(w, "Project has a run in progress", http.StatusConflict)
+		return
+	}
+
+	go func() {
+		ctx := projectContext(project, run)
+
+		var err error
+		for _, state := range drifted {
+			err = run.runStep(ctx, state.Key, state.Handler, state.Gated, func(ctx context.Context) error {
+				return reconcileState(ctx, project, state)
+			})
+			if err != nil {
+				break
+			}
+		}
+
+		run.finish(err)
+		detectProjectDrift(project)
+	}()
+
+	runsLock.Lock()
+	defer runsLock.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(run)
+}
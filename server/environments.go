@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/bones/server/common"
+	aws "github.com/bones/server/handlers/aws"
+	circleci "github.com/bones/server/handlers/circleci"
+	github "github.com/bones/server/handlers/github"
+	"github.com/gorilla/mux"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+)
+
+// Environment is an additional deployment of a project's infrastructure,
+// such as staging or prod, with its own Terraform variables and state keys.
+type Environment struct {
+	Name    string            `json:"name"`
+	Vars    map[string]string `json:"vars"`
+	LastRun string            `json:"lastRun,omitempty"`
+}
+
+type EnvironmentCreateRequest struct {
+	Name string            `json:"name"`
+	Vars map[string]string `json:"vars"`
+}
+
+var environmentName = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// environmentHandlers are the step handlers that run once per environment.
+// The rest, such as github, belong to the project as a whole.
+var environmentHandlers = map[string]bool{
+	"approval": true,
+	"aws":      true,
+	"circleci": true,
+}
+
+// projectEnvironment returns the handler view of the named environment. The
+// empty name is the project's default environment.
+func projectEnvironment(project *Project, name string) common.Environment {
+	runsLock.Lock()
+	defer runsLock.Unlock()
+
+	env, ok := project.Environments[name]
+	if name == "" || !ok {
+		return common.Environment{}
+	}
+
+	return common.Environment{Name: env.Name, Vars: env.Vars}
+}
+
+func processEnvironmentSteps(ctx context.Context, step GenerateStep, project *Project, env common.Environment) error {
+	fmt.Printf("Running step: %s (%s)\n", step.Name, env.Name)
+
+	switch step.Handler {
+	case "aws":
+		return aws.ApplyAWSInfra(ctx, project.Name, project.Repo, env)
+	case "circleci":
+		return circleci.ApplyProject(ctx, project.Name, project.Repo, env)
+	}
+
+	return nil
+}
+
+func createEnvironment(run *Run, project *Project, env common.Environment) error {
+	projectDir := github.DownloadRepo(project.Repo)
+	defer os.RemoveAll(projectDir)
+
+	skeleton, err := readSkeletonYaml(projectDir)
+	if err != nil {
+		return err
+	}
+
+	ctx := projectContext(project, run)
+
+	var steps []skeletonStep
+	for _, s := range skeleton.Generate.Steps {
+		s := s
+		steps = append(steps, skeletonStep{
+			Name: s.Name, Handler: s.Handler, When: s.When, ForEach: s.ForEach, DependsOn: s.DependsOn,
+			leftOut: !environmentHandlers[s.Handler],
+			run: func(ctx context.Context) error {
+				return processEnvironmentSteps(ctx, s, project, env)
+			},
+		})
+	}
+
+	return runSteps(ctx, run, project.Data, steps, false)
+}
+
+func destroyEnvironment(run *Run, project *Project, env common.Environment) error {
+	projectDir := github.DownloadRepo(project.Repo)
+	defer os.RemoveAll(projectDir)
+
+	skeleton, err := readSkeletonYaml(projectDir)
+	if err != nil {
+		return err
+	}
+
+	return destroyEnvironmentSteps(projectContext(project, run), run, project, skeleton, env)
+}
+
+// destroyEnvironmentSteps runs the destroy steps of the project's skeleton
+// that apply to env, then forgets the environment.
+func destroyEnvironmentSteps(ctx context.Context, run *Run, project *Project, skeleton SkeletonYaml, env common.Environment) error {
+	var steps []skeletonStep
+	for _, s := range skeleton.Destroy.Steps {
+		s := s
+		steps = append(steps, skeletonStep{
+			Name: s.Name, Handler: s.Handler, When: s.When, ForEach: s.ForEach, DependsOn: s.DependsOn,
+			leftOut: !environmentHandlers[s.Handler],
+			run: func(ctx context.Context) error {
+				return processDestroySteps(ctx, s, project, env)
+			},
+		})
+	}
+
+	err := runSteps(ctx, run, project.Data, steps, true)
+	if err != nil {
+		return err
+	}
+
+	runsLock.Lock()
+	delete(project.Environments, env.Name)
+	runsLock.Unlock()
+
+	return nil
+}
+
+func returnProjectEnvironments(w http.ResponseWriter, r *http.Request) {
+	project, ok := lookupProject(mux.Vars(r)["id"])
+	if !ok {
+		http.Error(w, "Project Not Found", http.StatusNotFound)
+		return
+	}
+
+	runsLock.Lock()
+	defer runsLock.Unlock()
+
+	environments := []*Environment{}
+	for _, env := range project.Environments {
+		environments = append(environments, env)
+	}
+
+	sort.Slice(environments, func(i, j int) bool {
+		return environments[i].Name < environments[j].Name
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(environments)
+}
+
+func createProjectEnvironment(w http.ResponseWriter, r *http.Request) {
+	project, ok := lookupProject(mux.Vars(r)["id"])
+	if !ok {
+		http.Error(w, "Project Not Found", http.StatusNotFound)
+		return
+	}
+
+	var envRequest EnvironmentCreateRequest
+	err := json.NewDecoder(r.Body).Decode(&envRequest)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !environmentName.MatchString(envRequest.Name) {
+		http.Error(w, "Environment name must be lowercase letters, digits and dashes", http.StatusBadRequest)
+		return
+	}
+
+	env := &Environment{Name: envRequest.Name, Vars: envRequest.Vars}
+	if env.Vars == nil {
+		env.Vars = make(map[string]string)
+	}
+
+	runsLock.Lock()
+	if _, exists := project.Environments[env.Name]; exists {
+		runsLock.Unlock()
+		http.Error(w, "Environment already exists", http.StatusConflict)
+		return
+	}
+
+	run := startRun(project, "create-environment")
+	if run == nil {
+		runsLock.Unlock()
+		http.Error(w, "Project has a run in progress", http.StatusConflict)
+		return
+	}
+	run.environment = env.Name
+	env.LastRun = run.Id
+
+	if project.Environments == nil {
+		project.Environments = make(map[string]*Environment)
+	}
+	project.Environments[env.Name] = env
+	runsLock.Unlock()
+
+	go func() {
+		err := createEnvironment(run, project, common.Environment{Name: env.Name, Vars: env.Vars})
+
+		// A failed environment can be created again.
+		if err != nil {
+			runsLock.Lock()
+			if project.Environments[env.Name] == env {
+				delete(project.Environments, env.Name)
+			}
+			runsLock.Unlock()
+		}
+
+		run.finish(err)
+	}()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(env)
+}
+
+func deleteProjectEnvironment(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	project, ok := lookupProject(vars["id"])
+	if !ok {
+		http.Error(w, "Project Not Found", http.StatusNotFound)
+		return
+	}
+
+	runsLock.Lock()
+	env, exists := project.Environments[vars["env"]]
+	if !exists {
+		runsLock.Unlock()
+		http.Error(w, "Environment Not Found", http.StatusNotFound)
+		return
+	}
+
+	run := startRun(project, "destroy-environment")
+	if run == nil {
+		runsLock.Unlock()
+		http.Error(w, "Project has a run in progress", http.StatusConflict)
+		return
+	}
+	run.environment = env.Name
+	env.LastRun = run.Id
+	runsLock.Unlock()
+
+	go func() {
+		run.finish(destroyEnvironment(run, project, common.Environment{Name: env.Name, Vars: env.Vars}))
+	}()
+
+	runsLock.Lock()
+	defer runsLock.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(env)
+}
@@ -1,7 +1,7 @@
 package handlers
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/bones/server/common"
@@ -9,7 +9,6 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
-	"text/template"
 )
 
 type AWSCreds struct {
@@ -18,25 +17,55 @@ type AWSCreds struct {
 	AWS_SECRET_KEY string
 }
 
-func CreateAWSInfra(name string, repo string, skeletonRepo string, skeletonRepoPath string, data map[string]string) error {
+func CreateAWSInfra(ctx context.Context, name string, repo string, skeletonRepo string, skeletonRepoPath string, data common.Data) error {
+	return createInfra(ctx, name, skeletonRepo, skeletonRepoPath, data, func(files []github.RemoteFile) error {
+		return github.AddFilesToRepo(repo, "Process AWS Terraform file", files)
+	})
+}
+
+// CreateAddonInfra is CreateAWSInfra for the add-on carried by ctx. Its
+// configuration is applied, but goes to the project repo as a pull request
+// on branch instead of onto the default branch. It returns the pull
+// request's URL.
+func CreateAddonInfra(ctx context.Context, name string, repo string, branch string, skeletonRepo string, skeletonRepoPath string, data common.Data, title string) (string, error) {
+	var pullRequest string
+	err := createInfra(ctx, name, skeletonRepo, skeletonRepoPath, data, func(files []github.RemoteFile) error {
+		var err error
+		pullRequest, err = github.OpenFilesPullRequest(repo, branch, files, title)
+		return err
+	})
+
+	return pullRequest, err
+}
+
+// createInfra renders the skeleton's infra/aws-ecs configuration, hands the
+// files to commit and applies it.
+func createInfra(ctx context.Context, name string, skeletonRepo string, skeletonRepoPath string, data common.Data, commit func(files []github.RemoteFile) error) error {
 
 	fmt.Printf("Creating AWS Infra for app: %s\n", name)
 
-	skeletonDir := github.DownloadRepo(skeletonRepo)
+	skeletonDir, err := github.CheckoutSkeleton(ctx, skeletonRepo, skeletonRepoPath)
+	if err != nil {
+		return err
+	}
 	defer os.RemoveAll(skeletonDir)
 
 	workingDir := skeletonDir + skeletonRepoPath + "/infra/aws-ecs"
 
+	// Where the configuration goes in state: an add-on's is kept apart from
+	// the project's own, and ExecuteTerraform keys every for_each item.
+	infraDir := common.AddonDir(ctx, "infra/aws-ecs")
+
 	awsCredsEnv := common.GetConfig("AWS")
 
 	var awsCreds AWSCreds
-	err := json.Unmarshal([]byte(awsCredsEnv), &awsCreds)
+	err = json.Unmarshal([]byte(awsCredsEnv), &awsCreds)
 	if err != nil {
 		fmt.Printf("Can't parse awsCreds: %s", err)
 		return err
 	}
 
-	fmt.Printf("Create AWS Infra: %s\n", data["APP_NAME"])
+	fmt.Printf("Create AWS Infra: %s\n", data.String("APP_NAME"))
 
 	vars := make(map[string]string)
 	vars["vpc_id"] = "vpc-c92c8baf"
@@ -44,6 +73,37 @@ func CreateAWSInfra(name string, repo string, skeletonRepo string, skeletonRepoP
 	vars["aws_access_key"] = awsCreds.AWS_ACCESS_KEY
 	vars["aws_secret_key"] = awsCreds.AWS_SECRET_KEY
 
+	files, err := RenderFiles(ctx, skeletonDir+skeletonRepoPath, data)
+	if err != nil {
+		return err
+	}
+
+	err = commit(files)
+	if err != nil {
+		return err
+	}
+
+	err = common.ExecuteTerraform(ctx, workingDir, vars, common.ApplyAction, data.String("APP_NAME")+"/"+infraDir)
+
+	fmt.Printf("Finished creating AWS Infra for app: %s\n", name)
+
+	return err
+}
+
+// RenderFiles renders, in place, the infra/aws-ecs configuration of the
+// skeleton checked out at dir and returns the files CreateAWSInfra commits to
+// the project repo for it, without running Terraform. Ignored files are
+// removed from dir, so that they aren't applied either. Every for_each item
+// gets its own directory in the repo, such as infra/aws-ecs/us-east-1.
+func RenderFiles(ctx context.Context, dir string, data common.Data) ([]github.RemoteFile, error) {
+	workingDir := dir + "/infra/aws-ecs"
+	infraDir := common.EachDir(ctx, common.AddonDir(ctx, "infra/aws-ecs"))
+
+	skeleton, err := common.ReadSkeletonConfig(dir)
+	if err != nil {
+		return nil, err
+	}
+
 	//Process template
 	var files = []github.RemoteFile{}
 
@@ -53,40 +113,80 @@ func CreateAWSInfra(name string, repo string, skeletonRepo string, skeletonRepoP
 				return err
 			}
 
+			rel, err := filepath.Rel(dir, path)
+			if err != nil {
+				return err
+			}
+
+			// Ignored files are neither pushed nor applied.
+			if skeleton.Ignored(rel, info.IsDir()) {
+				if info.IsDir() {
+					os.RemoveAll(path)
+					return filepath.SkipDir
+				}
+				return os.Remove(path)
+			}
+
 			if !info.IsDir() {
-				tmpl, err := template.ParseFiles(path)
-				common.CheckIfError(err)
-				buf := &bytes.Buffer{}
-				err = tmpl.Execute(buf, data)
+				rendered, err := skeleton.RenderFile(ctx, path, data)
+				if err != nil {
+					return err
+				}
 
 				files = append(files, github.RemoteFile{
 					Name: info.Name(),
-					Path: "infra/aws-ecs",
-					Data: buf.Bytes(),
+					Path: infraDir,
+					Data: rendered,
 					Perm: 0750,
 				})
-
-				os.WriteFile(path, buf.Bytes(), 0750)
 			}
 
 			return nil
 		})
+	if err != nil {
+		return nil, err
+	}
 
-	github.AddFilesToRepo(repo, "Process AWS Terraform file", files)
-
-	err = common.ExecuteTerraform(workingDir, vars, common.ApplyAction, data["APP_NAME"]+"/infra/aws-ecs")
-
-	fmt.Printf("Finished creating AWS Infra for app: %s\n", name)
+	dataVars, err := common.WriteDataVars(workingDir, data)
+	if err != nil {
+		return nil, err
+	}
+	if dataVars != nil {
+		files = append(files, github.RemoteFile{
+			Name: common.DataVarsFile,
+			Path: infraDir,
+			Data: dataVars,
+			Perm: 0640,
+		})
+	}
 
-	return err
+	return files, nil
 }
 
-func DestroyAWSInfra(name string, repo string) error {
+// withProjectInfra checks out the project repo and hands fn its rendered
+// infra/aws-ecs directory, or that of the add-on or for_each item carried by
+// ctx, together with the variables and state key that belong to env.
+func withProjectInfra(ctx context.Context, name string, repo string, env common.Environment, fn func(workingDir string, vars map[string]string, statefileDir string) error) error {
 
 	projectDir := github.DownloadRepo(repo)
 	defer os.RemoveAll(projectDir)
 
-	workingDir := projectDir + "/infra/aws-ecs"
+	infraDir := common.EachDir(ctx, common.AddonDir(ctx, "infra/aws-ecs"))
+	workingDir := projectDir + "/" + infraDir
+
+	// An add-on's configuration is only there once its pull request is
+	// merged.
+	if _, err := os.Stat(workingDir); err != nil {
+		return fmt.Errorf("%s is not in %s: %w", infraDir, repo, err)
+	}
+
+	return withInfraDir(ctx, name, workingDir, env, fn)
+}
+
+// withInfraDir hands fn the infra/aws-ecs configuration in workingDir
+// together with the variables and state key that belong to env.
+func withInfraDir(ctx context.Context, name string, workingDir string, env common.Environment, fn func(workingDir string, vars map[string]string, statefileDir string) error) error {
+	infraDir := common.AddonDir(ctx, "infra/aws-ecs")
 
 	awsCredsEnv := common.GetConfig("AWS")
 
@@ -98,8 +198,6 @@ func DestroyAWSInfra(name string, repo string) error {
 	}
 	appName := strings.ReplaceAll(strings.ToLower(name), " ", "-")
 
-	fmt.Printf("Destroy AWS Infra: %s\n", appName)
-
 	vars := make(map[string]string)
 	vars["vpc_id"] = "vpc-c92c8baf"
 	//vars["app_name"] = appName
@@ -107,6 +205,128 @@ func DestroyAWSInfra(name string, repo string) error {
 	vars["aws_access_key"] = awsCreds.AWS_ACCESS_KEY
 	vars["aws_secret_key"] = awsCreds.AWS_SECRET_KEY
 
-	err = common.ExecuteTerraform(workingDir, vars, common.DestroyAction, appName+"/infra/aws-ecs")
-	return err
+	err = env.WriteVars(workingDir)
+	if err != nil {
+		return err
+	}
+
+	return fn(workingDir, vars, env.StateKey(appName, infraDir))
+}
+
+func DestroyAWSInfra(ctx context.Context, name string, repo string, env common.Environment) error {
+	return withProjectInfra(ctx, name, repo, env, func(workingDir string, vars map[string]string, statefileDir string) error {
+		fmt.Printf("Destroy AWS Infra: %s\n", statefileDir)
+		return common.ExecuteTerraform(ctx, workingDir, vars, common.DestroyAction, statefileDir)
+	})
+}
+
+// DestroyAddonInfra destroys the infrastructure of the add-on carried by ctx
+// in env. Its configuration comes from the project repo once its pull request
+// is merged. Until then, or if it never is, the add-on skeleton at
+// skeletonRepoPath is rendered with data again, from the commit ctx pins it
+// to.
+func DestroyAddonInfra(ctx context.Context, name string, repo string, skeletonRepo string, skeletonRepoPath string, data common.Data, env common.Environment) error {
+	projectDir := github.DownloadRepo(repo)
+	defer os.RemoveAll(projectDir)
+
+	workingDir := projectDir + "/" + common.EachDir(ctx, common.AddonDir(ctx, "infra/aws-ecs"))
+
+	if _, err := os.Stat(workingDir); err != nil {
+		skeletonDir, err := github.CheckoutSkeleton(ctx, skeletonRepo, skeletonRepoPath)
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(skeletonDir)
+
+		_, err = RenderFiles(ctx, skeletonDir+skeletonRepoPath, data)
+		if err != nil {
+			return err
+		}
+		workingDir = skeletonDir + skeletonRepoPath + "/infra/aws-ecs"
+	}
+
+	return withInfraDir(ctx, name, workingDir, env, func(workingDir string, vars map[string]string, statefileDir string) error {
+		fmt.Printf("Destroy AWS Infra: %s\n", statefileDir)
+		return common.ExecuteTerraform(ctx, workingDir, vars, common.DestroyAction, statefileDir)
+	})
+}
+
+func DetectAWSInfraDrift(ctx context.Context, name string, repo string, env common.Environment) (*common.Drift, error) {
+	var drift *common.Drift
+	err := withProjectInfra(ctx, name, repo, env, func(workingDir string, vars map[string]string, statefileDir string) error {
+		var err error
+		drift, err = common.DetectDrift(ctx, workingDir, vars, statefileDir)
+		return err
+	})
+	return drift, err
+}
+
+// ApplyAWSInfra applies the project's committed infra/aws-ecs configuration
+// to env. It creates new environments and reverts drift in existing ones.
+func ApplyAWSInfra(ctx context.Context, name string, repo string, env common.Environment) error {
+	return withProjectInfra(ctx, name, repo, env, func(workingDir string, vars map[string]string, statefileDir string) error {
+		fmt.Printf("Apply AWS Infra: %s\n", statefileDir)
+		return common.ExecuteTerraform(ctx, workingDir, vars, common.ApplyAction, statefileDir)
+	})
+}
+
+// ApplyActionInfra renders the infra/aws-ecs configuration at
+// skeletonRepoPath with the action's data into the project's own, commits the
+// result to repo with message and applies it to env. The data also fills in
+// the variables the project's configuration declares, as it does when the
+// project is created.
+func ApplyActionInfra(ctx context.Context, name string, repo string, skeletonRepo string, skeletonRepoPath string, data common.Data, env common.Environment, message string) error {
+
+	skeletonDir, err := github.CheckoutSkeleton(ctx, skeletonRepo, skeletonRepoPath)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(skeletonDir)
+
+	// An action without configuration of its own only re-renders the data.
+	var rendered []github.RemoteFile
+	if _, err := os.Stat(skeletonDir + skeletonRepoPath + "/infra/aws-ecs"); err == nil {
+		rendered, err = RenderFiles(ctx, skeletonDir+skeletonRepoPath, data)
+		if err != nil {
+			return err
+		}
+	}
+
+	return withProjectInfra(ctx, name, repo, env, func(workingDir string, vars map[string]string, statefileDir string) error {
+		infraDir := common.EachDir(ctx, common.AddonDir(ctx, "infra/aws-ecs"))
+
+		var files []github.RemoteFile
+		for _, file := range rendered {
+			if file.Name == common.DataVarsFile {
+				continue
+			}
+
+			err := os.WriteFile(filepath.Join(workingDir, file.Name), file.Data, file.Perm)
+			if err != nil {
+				return err
+			}
+			files = append(files, file)
+		}
+
+		dataVars, err := common.WriteDataVars(workingDir, data)
+		if err != nil {
+			return err
+		}
+		if dataVars != nil {
+			files = append(files, github.RemoteFile{
+				Name: common.DataVarsFile,
+				Path: infraDir,
+				Data: dataVars,
+				Perm: 0640,
+			})
+		}
+
+		err = github.AddFilesToRepo(repo, message, files)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Apply AWS Infra: %s\n", statefileDir)
+		return common.ExecuteTerraform(ctx, workingDir, vars, common.ApplyAction, statefileDir)
+	})
 }
@@ -1,7 +1,7 @@
 package handlers
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/bones/server/common"
@@ -9,14 +9,13 @@ import (
 	"log"
 	"os"
 	"strings"
-	"text/template"
 )
 
 type CircleCICreds struct {
 	TOKEN string
 }
 
-func CreateProject(name string, repo string, skeletonRepo string, skeletonRepoPath string, data map[string]string) error {
+func CreateProject(ctx context.Context, name string, repo string, skeletonRepo string, skeletonRepoPath string, data common.Data) error {
 
 	githubCredsEnv := os.Getenv("GITHUB")
 
@@ -28,7 +27,10 @@ func CreateProject(name string, repo string, skeletonRepo string, skeletonRepoPa
 
 	fmt.Printf("Creating CircleCI project for app: %s\n", name)
 
-	skeletonDir := github.DownloadRepo(skeletonRepo)
+	skeletonDir, err := github.CheckoutSkeleton(ctx, skeletonRepo, skeletonRepoPath)
+	if err != nil {
+		return err
+	}
 	defer os.RemoveAll(skeletonDir)
 
 	workingDir := skeletonDir + skeletonRepoPath + "/infra/circleci"
@@ -44,36 +46,99 @@ func CreateProject(name string, repo string, skeletonRepo string, skeletonRepoPa
 	}
 
 	vars := make(map[string]string)
-	vars["project_name"] = data["APP_NAME"]
+	vars["project_name"] = data.String("APP_NAME")
 	vars["github_user"] = githubUser
 	vars["circleci_token"] = circleCreds.TOKEN
 
-	err = common.ExecuteTerraform(workingDir, vars, common.ApplyAction, data["APP_NAME"]+"/infra/circleci")
-	common.CheckIfError(err)
+	files, err := dataVarsFiles(workingDir, data)
+	if err != nil {
+		return err
+	}
 
-	//Process template
-	tmpl, err := template.ParseFiles(workingDir + "/config.yml")
-	common.CheckIfError(err)
-	buf := &bytes.Buffer{}
-	err = tmpl.Execute(buf, data)
-	common.CheckIfError(err)
-
-	var files = []github.RemoteFile{
-		github.RemoteFile{
-			Name: "config.yml",
-			Path: ".circleci",
-			Data: buf.Bytes(),
-			Perm: 0750,
-		},
-	}
-	github.AddFilesToRepo(repo, "Adding CircleCI Config", files)
+	err = common.ExecuteTerraform(ctx, workingDir, vars, common.ApplyAction, data.String("APP_NAME")+"/infra/circleci")
+	if err != nil {
+		return err
+	}
+
+	// The config is rendered after apply, so that it sees the outputs.
+	config, err := configFiles(ctx, skeletonDir+skeletonRepoPath, data)
+	if err != nil {
+		return err
+	}
+	files = append(files, config...)
+
+	if len(files) > 0 {
+		err = github.AddFilesToRepo(repo, "Adding CircleCI Config", files)
+	}
 
 	fmt.Printf("Finished creating CircleCI project for app: %s\n", name)
 
 	return err
 }
 
-func DestroyProject(name string, repo string) error {
+// dataVarsFiles writes the data vars of the infra/circleci configuration in
+// workingDir and returns the file to commit for them, if any.
+func dataVarsFiles(workingDir string, data common.Data) ([]github.RemoteFile, error) {
+	dataVars, err := common.WriteDataVars(workingDir, data)
+	if err != nil || dataVars == nil {
+		return nil, err
+	}
+
+	return []github.RemoteFile{{
+		Name: common.DataVarsFile,
+		Path: "infra/circleci",
+		Data: dataVars,
+		Perm: 0640,
+	}}, nil
+}
+
+// configFiles renders the CircleCI config of the skeleton checked out at dir,
+// unless it is ignored.
+func configFiles(ctx context.Context, dir string, data common.Data) ([]github.RemoteFile, error) {
+	skeleton, err := common.ReadSkeletonConfig(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	//Process template
+	if skeleton.Ignored("infra/circleci/config.yml", false) {
+		return nil, nil
+	}
+
+	rendered, err := skeleton.RenderFile(ctx, dir+"/infra/circleci/config.yml", data)
+	if err != nil {
+		return nil, err
+	}
+
+	return []github.RemoteFile{{
+		Name: "config.yml",
+		Path: ".circleci",
+		Data: rendered,
+		Perm: 0750,
+	}}, nil
+}
+
+// RenderFiles returns the files CreateProject commits to the project repo
+// for the skeleton checked out at dir, without running Terraform. Templates
+// see no outputs of the CircleCI configuration.
+func RenderFiles(ctx context.Context, dir string, data common.Data) ([]github.RemoteFile, error) {
+	files, err := dataVarsFiles(dir+"/infra/circleci", data)
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := configFiles(ctx, dir, data)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(files, config...), nil
+}
+
+// withProjectInfra checks out the project repo and hands fn its
+// infra/circleci directory together with the variables and state key that
+// belong to env.
+func withProjectInfra(name string, repo string, env common.Environment, fn func(workingDir string, vars map[string]string, statefileDir string) error) error {
 
 	projectDir := github.DownloadRepo(repo)
 	defer os.RemoveAll(projectDir)
@@ -104,6 +169,70 @@ func DestroyProject(name string, repo string) error {
 	vars["github_user"] = githubUser
 	vars["circleci_token"] = circleCreds.TOKEN
 
-	err = common.ExecuteTerraform(workingDir, vars, common.DestroyAction, projectName+"/infra/circleci")
-	return err
+	err = env.WriteVars(workingDir)
+	if err != nil {
+		return err
+	}
+
+	return fn(workingDir, vars, env.StateKey(projectName, "infra/circleci"))
+}
+
+func DestroyProject(ctx context.Context, name string, repo string, env common.Environment) error {
+	return withProjectInfra(name, repo, env, func(workingDir string, vars map[string]string, statefileDir string) error {
+		return common.ExecuteTerraform(ctx, workingDir, vars, common.DestroyAction, statefileDir)
+	})
+}
+
+func DetectProjectDrift(ctx context.Context, name string, repo string, env common.Environment) (*common.Drift, error) {
+	var drift *common.Drift
+	err := withProjectInfra(name, repo, env, func(workingDir string, vars map[string]string, statefileDir string) error {
+		var err error
+		drift, err = common.DetectDrift(ctx, workingDir, vars, statefileDir)
+		return err
+	})
+	return drift, err
+}
+
+// ApplyProject applies the project's committed infra/circleci configuration
+// to env. It creates new environments and reverts drift in existing ones.
+func ApplyProject(ctx context.Context, name string, repo string, env common.Environment) error {
+	return withProjectInfra(name, repo, env, func(workingDir string, vars map[string]string, statefileDir string) error {
+		return common.ExecuteTerraform(ctx, workingDir, vars, common.ApplyAction, statefileDir)
+	})
+}
+
+// ApplyActionProject applies the project's infra/circleci configuration to
+// env with the action's data filling in the variables it declares, and
+// commits the data together with the CircleCI config at skeletonRepoPath,
+// if the action has one, rendered with the data.
+func ApplyActionProject(ctx context.Context, name string, repo string, skeletonRepo string, skeletonRepoPath string, data common.Data, env common.Environment, message string) error {
+
+	skeletonDir, err := github.CheckoutSkeleton(ctx, skeletonRepo, skeletonRepoPath)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(skeletonDir)
+
+	return withProjectInfra(name, repo, env, func(workingDir string, vars map[string]string, statefileDir string) error {
+		files, err := dataVarsFiles(workingDir, data)
+		if err != nil {
+			return err
+		}
+
+		err = common.ExecuteTerraform(ctx, workingDir, vars, common.ApplyAction, statefileDir)
+		if err != nil {
+			return err
+		}
+
+		// The config is rendered after apply, so that it sees the outputs.
+		if _, err := os.Stat(skeletonDir + skeletonRepoPath + "/infra/circleci/config.yml"); err == nil {
+			config, err := configFiles(ctx, skeletonDir+skeletonRepoPath, data)
+			if err != nil {
+				return err
+			}
+			files = append(files, config...)
+		}
+
+		return github.AddFilesToRepo(repo, message, files)
+	})
 }
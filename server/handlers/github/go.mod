@@ -6,7 +6,10 @@ require github.com/bones/server/common v0.0.0
 
 replace github.com/bones/server/common v0.0.0 => ../../common
 
-require github.com/go-git/go-git/v5 v5.4.2
+require (
+	github.com/go-git/go-git/v5 v5.5.1
+	gopkg.in/yaml.v3 v3.0.1
+)
 
 require (
 	github.com/Microsoft/go-winio v0.4.16 // indirect
@@ -1,18 +1,19 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/bones/server/common"
 	"github.com/go-git/go-git/v5"
 	"github.com/go-git/go-git/v5/plumbing/object"
-	http2 "github.com/go-git/go-git/v5/plumbing/transport/http"
 	"log"
 	"os"
 	"path"
 	"path/filepath"
 	"runtime"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -44,7 +45,9 @@ func getWorkingDir() string {
 	}
 }
 
-func createRepo(name string) string {
+// repoTerraform returns the variables and state key of the Terraform
+// configuration that manages the repo for name.
+func repoTerraform(name string) (map[string]string, string) {
 	githubCredsEnv := os.Getenv("GITHUB")
 
 	var githubCreds GithubCreds
@@ -59,101 +62,64 @@ func createRepo(name string) string {
 	vars["github_user"] = githubCreds.GITHUB_USER
 	vars["github_token"] = githubCreds.GITHUB_TOKEN
 
-	err = common.ExecuteTerraform(getWorkingDir(), vars, common.ApplyAction, repoName+"/infra/github")
-	common.CheckIfError(err)
-
-	return repoName
+	return vars, repoName + "/infra/github"
 }
 
-func DownloadRepo(repo string) string {
-	githubCredsEnv := os.Getenv("GITHUB")
+func createRepo(ctx context.Context, name string) (string, error) {
+	vars, statefileDir := repoTerraform(name)
 
-	var githubCreds GithubCreds
-	err := json.Unmarshal([]byte(githubCredsEnv), &githubCreds)
+	err := common.ExecuteTerraform(ctx, getWorkingDir(), vars, common.ApplyAction, statefileDir)
 	if err != nil {
-		log.Fatalf("Can't parse github environment: %s", err)
+		return "", err
 	}
 
+	return vars["repo_name"], nil
+}
+
+func DownloadRepo(repo string) string {
 	tempDir, err := os.MkdirTemp("", "repo")
 	common.CheckIfError(err)
 
 	_, err = git.PlainClone(tempDir, false, &git.CloneOptions{
 		URL:      repo,
 		Progress: os.Stdout,
-		Auth: &http2.BasicAuth{
-			Username: githubCreds.GITHUB_USER,
-			Password: githubCreds.GITHUB_TOKEN,
-		},
+		Auth:     repoAuth(repo),
 	})
 	common.CheckIfError(err)
 
 	return tempDir
 }
 
-func AddFilesToRepo(repo string, commitMessage string, files []RemoteFile) {
-	githubCredsEnv := os.Getenv("GITHUB")
+// AddFilesToRepo pushes files to the default branch of the existing project
+// repo as one commit. Nothing is committed when the repo already has them.
+func AddFilesToRepo(repo string, commitMessage string, files []RemoteFile) error {
+	defer lockRepo(repo)()
 
-	var githubCreds GithubCreds
-	err := json.Unmarshal([]byte(githubCredsEnv), &githubCreds)
+	r, repoDir, err := cloneRepo(repo)
 	if err != nil {
-		log.Fatalf("Can't parse githubToken: %s", err)
+		return err
 	}
-
-	repoDir, err := os.MkdirTemp("", "repo")
-	common.CheckIfError(err)
 	defer os.RemoveAll(repoDir)
 
-	_, err = git.PlainClone(repoDir, false, &git.CloneOptions{
-		URL:      repo,
-		Progress: os.Stdout,
-		Auth: &http2.BasicAuth{
-			Username: githubCreds.GITHUB_USER,
-			Password: githubCreds.GITHUB_TOKEN,
-		},
-	})
-	common.CheckIfError(err)
-
-	r, err := git.PlainOpen(repoDir)
-	common.CheckIfError(err)
-
 	w, err := r.Worktree()
-	common.CheckIfError(err)
-
-	err = os.Chdir(repoDir)
-	common.CheckIfError(err)
-
-	for _, fl := range files {
-		err = os.MkdirAll(fl.Path, fl.Perm)
-		common.CheckIfError(err)
-
-		err = os.WriteFile(fl.Path+"/"+fl.Name, fl.Data, fl.Perm)
-		common.CheckIfError(err)
-
-		_, err = w.Add(fl.Path + "/" + fl.Name)
-		common.CheckIfError(err)
+	if err != nil {
+		return err
 	}
 
-	commit, err := w.Commit(commitMessage, &git.CommitOptions{
-		Author: &object.Signature{
-			Name:  githubCreds.GITHUB_USER,
-			Email: githubCreds.GITHUB_EMAIL,
-			When:  time.Now(),
-		},
-	})
-	common.CheckIfError(err)
-	obj, err := r.CommitObject(commit)
-	common.CheckIfError(err)
+	err = writeFiles(repoDir, files)
+	if err != nil {
+		return err
+	}
 
-	fmt.Println(obj)
+	changed, err := commitAll(w, commitMessage)
+	if err != nil || !changed {
+		return err
+	}
 
-	err = r.Push(&git.PushOptions{Auth: &http2.BasicAuth{
-		Username: githubCreds.GITHUB_USER,
-		Password: githubCreds.GITHUB_TOKEN,
-	}})
-	common.CheckIfError(err)
+	return r.Push(&git.PushOptions{Auth: repoAuth(repo)})
 }
 
-func CreateRepo(appName string, skeletonRepo string, skeletonRepoPath string, data map[string]string) string {
+func CreateRepo(ctx context.Context, appName string, skeletonRepo string, skeletonRepoPath string, data common.Data) (string, error) {
 	githubCredsEnv := os.Getenv("GITHUB")
 
 	var githubCreds GithubCreds
@@ -162,104 +128,203 @@ func CreateRepo(appName string, skeletonRepo string, skeletonRepoPath string, da
 		log.Fatalf("Can't parse githubToken: %s", err)
 	}
 
-	repoName := createRepo(appName)
+	repoName, err := createRepo(ctx, appName)
+	if err != nil {
+		return "", err
+	}
 	repoUrl := githubCreds.GITHUB_BASE + "/" + repoName
 
-	skeletonDir, err := os.MkdirTemp("", "skeleton")
-	common.CheckIfError(err)
+	skeletonDir, err := CheckoutSkeleton(ctx, skeletonRepo, skeletonRepoPath)
+	if err != nil {
+		return "", err
+	}
 	defer os.RemoveAll(skeletonDir)
 
-	repoDir, err := os.MkdirTemp("", "repo")
-	common.CheckIfError(err)
+	defer lockRepo(repoUrl)()
+
+	r, repoDir, err := cloneRepo(repoUrl)
+	if err != nil {
+		return "", err
+	}
 	defer os.RemoveAll(repoDir)
 
-	_, err = git.PlainClone(skeletonDir, false, &git.CloneOptions{
-		URL:      skeletonRepo,
-		Progress: os.Stdout,
-		Auth: &http2.BasicAuth{
-			Username: githubCreds.GITHUB_USER,
-			Password: githubCreds.GITHUB_TOKEN,
-		},
-	})
-	common.CheckIfError(err)
+	w, err := r.Worktree()
+	if err != nil {
+		return "", err
+	}
 
-	_, err = git.PlainClone(repoDir, false, &git.CloneOptions{
-		URL:      repoUrl,
-		Progress: os.Stdout,
-		Auth: &http2.BasicAuth{
-			Username: githubCreds.GITHUB_USER,
-			Password: githubCreds.GITHUB_TOKEN,
-		},
-	})
-	common.CheckIfError(err)
+	err = common.CopyTree(ctx, skeletonDir+skeletonRepoPath, repoDir, data)
+	if err != nil {
+		return "", err
+	}
 
-	r, err := git.PlainOpen(repoDir)
-	common.CheckIfError(err)
+	_, err = commitAll(w, "Initial Commit")
+	if err != nil {
+		return "", err
+	}
 
-	w, err := r.Worktree()
-	common.CheckIfError(err)
+	err = r.Push(&git.PushOptions{Auth: repoAuth(repoUrl)})
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		return "", err
+	}
 
-	err = common.Dir(skeletonDir+skeletonRepoPath, repoDir)
-	common.CheckIfError(err)
+	return repoUrl, nil
+}
 
-	curDir, err := os.Getwd()
-	common.CheckIfError(err)
+// repoLocks serializes the commits pushed to each project repo. Steps run at
+// the same time, and a push made from an outdated clone would be rejected.
+var (
+	repoLocks     = make(map[string]*sync.Mutex)
+	repoLocksLock sync.Mutex
+)
 
-	err = os.Chdir(repoDir)
-	common.CheckIfError(err)
+// lockRepo holds repo from its clone until its push and returns the unlock.
+func lockRepo(repo string) func() {
+	repoLocksLock.Lock()
+	lock, ok := repoLocks[repo]
+	if !ok {
+		lock = &sync.Mutex{}
+		repoLocks[repo] = lock
+	}
+	repoLocksLock.Unlock()
 
-	err = filepath.Walk(".",
-		func(path string, info os.FileInfo, err error) error {
-			if err != nil {
-				return err
-			}
+	lock.Lock()
+	return lock.Unlock
+}
 
-			if !strings.HasPrefix(path, ".git") {
-				fmt.Println("Adding ", path)
-				_, err = w.Add(path)
-				common.CheckIfError(err)
-			}
+// cloneRepo clones the project repo into a new temporary directory, which
+// the caller removes.
+func cloneRepo(repo string) (*git.Repository, string, error) {
+	repoDir, err := os.MkdirTemp("", "repo")
+	if err != nil {
+		return nil, "", err
+	}
 
-			return nil
-		})
+	r, err := git.PlainClone(repoDir, false, &git.CloneOptions{
+		URL:      repo,
+		Progress: os.Stdout,
+		Auth:     repoAuth(repo),
+	})
+	if err != nil {
+		os.RemoveAll(repoDir)
+		return nil, "", err
+	}
+
+	return r, repoDir, nil
+}
+
+// commitAll stages every change in w and commits it. It reports false, and
+// commits nothing, when there is no change.
+func commitAll(w *git.Worktree, message string) (bool, error) {
+	githubCredsEnv := os.Getenv("GITHUB")
 
-	commit, err := w.Commit("Initial Commit", &git.CommitOptions{
+	var githubCreds GithubCreds
+	err := json.Unmarshal([]byte(githubCredsEnv), &githubCreds)
+	if err != nil {
+		fmt.Printf("Can't parse github environment: %s\n", err)
+	}
+
+	err = w.AddWithOptions(&git.AddOptions{All: true})
+	if err != nil {
+		return false, err
+	}
+
+	status, err := w.Status()
+	if err != nil || status.IsClean() {
+		return false, err
+	}
+
+	_, err = w.Commit(message, &git.CommitOptions{
 		Author: &object.Signature{
 			Name:  githubCreds.GITHUB_USER,
 			Email: githubCreds.GITHUB_EMAIL,
 			When:  time.Now(),
 		},
 	})
-	common.CheckIfError(err)
-	obj, err := r.CommitObject(commit)
-	common.CheckIfError(err)
 
-	fmt.Println(obj)
+	return err == nil, err
+}
 
-	err = r.Push(&git.PushOptions{Auth: &http2.BasicAuth{Username: githubCreds.GITHUB_USER, Password: githubCreds.GITHUB_TOKEN}})
-	common.CheckIfError(err)
+// UpdateRepo renders the skeleton at skeletonRepoPath into the existing
+// project repo and pushes the result as one commit. Unlike CreateRepo, which
+// copies a new project's files as they are, file contents are rendered with
+// data, as they are for an add-on's pull request. Files the skeleton doesn't
+// have are left alone. Nothing is committed when the repo is already up to
+// date.
+func UpdateRepo(ctx context.Context, repo string, skeletonRepo string, skeletonRepoPath string, data common.Data, message string) error {
+	skeletonDir, err := CheckoutSkeleton(ctx, skeletonRepo, skeletonRepoPath)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(skeletonDir)
 
-	os.Chdir(curDir)
+	err = renderContents(ctx, skeletonDir+skeletonRepoPath, data, []string{".skeleton"})
+	if err != nil {
+		return err
+	}
 
-	return repoUrl
-}
+	defer lockRepo(repo)()
 
-func DestroyRepo(name string) {
-	githubCredsEnv := os.Getenv("GITHUB")
+	r, repoDir, err := cloneRepo(repo)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(repoDir)
 
-	var githubCreds GithubCreds
-	err := json.Unmarshal([]byte(githubCredsEnv), &githubCreds)
+	w, err := r.Worktree()
 	if err != nil {
-		log.Fatalf("Can't parse github environment: %s", err)
+		return err
 	}
 
-	repoName := strings.ReplaceAll(strings.ToLower(name), " ", "-")
+	err = common.CopyTree(ctx, skeletonDir+skeletonRepoPath, repoDir, data)
+	if err != nil {
+		return err
+	}
 
-	vars := make(map[string]string)
-	vars["repo_name"] = repoName
-	vars["github_user"] = githubCreds.GITHUB_USER
-	vars["github_token"] = githubCreds.GITHUB_TOKEN
+	changed, err := commitAll(w, message)
+	if err != nil {
+		return err
+	}
+	if !changed {
+		fmt.Printf("Repo %s is up to date\n", repo)
+		return nil
+	}
 
-	err = common.ExecuteTerraform(getWorkingDir(), vars, common.DestroyAction, repoName+"/infra/github")
-	common.CheckIfError(err)
+	return r.Push(&git.PushOptions{Auth: repoAuth(repo)})
+}
+
+// writeFiles writes files under dir.
+func writeFiles(dir string, files []RemoteFile) error {
+	for _, file := range files {
+		err := os.MkdirAll(filepath.Join(dir, file.Path), 0755)
+		if err != nil {
+			return err
+		}
+
+		err = os.WriteFile(filepath.Join(dir, file.Path, file.Name), file.Data, file.Perm)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func DestroyRepo(ctx context.Context, name string) error {
+	vars, statefileDir := repoTerraform(name)
+
+	return common.ExecuteTerraform(ctx, getWorkingDir(), vars, common.DestroyAction, statefileDir)
+}
+
+func DetectRepoDrift(ctx context.Context, name string) (*common.Drift, error) {
+	vars, statefileDir := repoTerraform(name)
+
+	return common.DetectDrift(ctx, getWorkingDir(), vars, statefileDir)
+}
+
+// ReconcileRepo re-applies the repo configuration, reverting any drift.
+func ReconcileRepo(ctx context.Context, name string) error {
+	vars, statefileDir := repoTerraform(name)
+
+	return common.ExecuteTerraform(ctx, getWorkingDir(), vars, common.ApplyAction, statefileDir)
 }
@@ -0,0 +1,50 @@
+package handlers
+
+import (
+	"fmt"
+	"github.com/go-git/go-git/v5"
+	"sync"
+	"testing"
+)
+
+func TestAddFilesToRepoConcurrently(t *testing.T) {
+
+	t.Setenv("GITHUB", "{}")
+
+	repo := t.TempDir()
+	_, err := git.PlainClone(repo, true, &git.CloneOptions{URL: skeletonRepo(t, map[string]string{"README.md": "# Shop\n"})})
+	if err != nil {
+		t.Fatalf("expected error to be nil got %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			files := []RemoteFile{{Name: fmt.Sprintf("step%d.tf", i), Path: "infra", Data: []byte("# step\n"), Perm: 0640}}
+			err := AddFilesToRepo(repo, "Add step", files)
+			if err != nil {
+				t.Errorf("expected error to be nil got %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	r, err := git.PlainOpen(repo)
+	if err != nil {
+		t.Fatalf("expected error to be nil got %v", err)
+	}
+	head, _ := r.Head()
+	commit, err := r.CommitObject(head.Hash())
+	if err != nil {
+		t.Fatalf("expected error to be nil got %v", err)
+	}
+
+	for i := 0; i < 4; i++ {
+		if _, err := commit.File(fmt.Sprintf("infra/step%d.tf", i)); err != nil {
+			t.Errorf("expected every step's file to be pushed got %v", err)
+		}
+	}
+}
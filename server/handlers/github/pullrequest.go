@@ -0,0 +1,209 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/bones/server/common"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const defaultGithubAPI = "https://api.github.com"
+
+// addonOwnedDirs are the directories of an add-on skeleton that don't go
+// into its pull request: the manifest, and the infrastructure that its infra
+// steps commit and apply on their own.
+var addonOwnedDirs = []string{".skeleton", "infra"}
+
+// renderContents renders, in place, the files of the skeleton checked out at
+// dir, leaving out the owned directories.
+func renderContents(ctx context.Context, dir string, data common.Data, ownedDirs []string) error {
+	skeleton, err := common.ReadSkeletonConfig(dir)
+	if err != nil {
+		return err
+	}
+
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || rel == "." {
+			return err
+		}
+
+		owned := false
+		for _, ownedDir := range ownedDirs {
+			owned = owned || rel == ownedDir
+		}
+
+		if owned || skeleton.Ignored(rel, d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if d.IsDir() {
+			return nil
+		}
+
+		_, err = skeleton.RenderFile(ctx, path, data)
+		return err
+	})
+}
+
+// OpenPullRequest renders the add-on skeleton at skeletonRepoPath into the
+// existing project repo on branch and opens a pull request for it against
+// the default branch. It returns the pull request's URL, or "" when the add-on
+// doesn't change the repo.
+func OpenPullRequest(ctx context.Context, repo string, branch string, skeletonRepo string, skeletonRepoPath string, data common.Data, title string) (string, error) {
+	skeletonDir, err := CheckoutSkeleton(ctx, skeletonRepo, skeletonRepoPath)
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(skeletonDir)
+
+	err = renderContents(ctx, skeletonDir+skeletonRepoPath, data, addonOwnedDirs)
+	if err != nil {
+		return "", err
+	}
+
+	stagingDir, err := os.MkdirTemp("", "addon")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(stagingDir)
+
+	err = common.CopyTree(ctx, skeletonDir+skeletonRepoPath, stagingDir, data)
+	if err != nil {
+		return "", err
+	}
+
+	for _, dir := range addonOwnedDirs {
+		os.RemoveAll(filepath.Join(stagingDir, dir))
+	}
+
+	return pushPullRequest(repo, branch, title, func(repoDir string) error {
+		return copySkeleton(stagingDir, repoDir)
+	})
+}
+
+// OpenFilesPullRequest commits files to the existing project repo on branch
+// and opens a pull request for them against the default branch, like
+// OpenPullRequest. It returns the pull request's URL, or "" when the files
+// don't change the repo.
+func OpenFilesPullRequest(repo string, branch string, files []RemoteFile, title string) (string, error) {
+	return pushPullRequest(repo, branch, title, func(repoDir string) error {
+		return writeFiles(repoDir, files)
+	})
+}
+
+// pushPullRequest lets write change a clone of repo on a new branch, and
+// pushes and opens a pull request for the change, if there is one.
+func pushPullRequest(repo string, branch string, title string, write func(repoDir string) error) (string, error) {
+	r, repoDir, err := cloneRepo(repo)
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(repoDir)
+
+	head, err := r.Head()
+	if err != nil {
+		return "", err
+	}
+
+	w, err := r.Worktree()
+	if err != nil {
+		return "", err
+	}
+
+	err = w.Checkout(&git.CheckoutOptions{Branch: plumbing.NewBranchReferenceName(branch), Create: true})
+	if err != nil {
+		return "", err
+	}
+
+	err = write(repoDir)
+	if err != nil {
+		return "", err
+	}
+
+	changed, err := commitAll(w, title)
+	if err != nil || !changed {
+		return "", err
+	}
+
+	// The branch belongs to bones, so a previous attempt is replaced.
+	refSpec := config.RefSpec("+refs/heads/" + branch + ":refs/heads/" + branch)
+	err = r.Push(&git.PushOptions{Auth: repoAuth(repo), RefSpecs: []config.RefSpec{refSpec}})
+	if err != nil {
+		return "", err
+	}
+
+	return createPullRequest(repo, branch, head.Name().Short(), title)
+}
+
+// createPullRequest opens a pull request of branch into base with the GitHub
+// API at GITHUB_API.
+func createPullRequest(repo string, branch string, base string, title string) (string, error) {
+	api := common.GetConfig("GITHUB_API")
+	if api == "" {
+		api = defaultGithubAPI
+	}
+
+	parts := strings.Split(strings.TrimSuffix(strings.TrimSuffix(repo, "/"), ".git"), "/")
+	if len(parts) < 2 {
+		return "", fmt.Errorf("can't tell the owner and name of repo %s", repo)
+	}
+	ownerRepo := parts[len(parts)-2] + "/" + parts[len(parts)-1]
+
+	body, err := json.Marshal(map[string]string{
+		"title": title,
+		"head":  branch,
+		"base":  base,
+		"body":  "Opened by bones.",
+	})
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, api+"/repos/"+ownerRepo+"/pulls", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+
+	auth := githubAuth()
+	req.SetBasicAuth(auth.Username, auth.Password)
+	req.Header.Set("Accept", "application/vnd.github+json")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusCreated {
+		message, _ := io.ReadAll(res.Body)
+		return "", fmt.Errorf("opening pull request on %s: %s: %s", ownerRepo, res.Status, message)
+	}
+
+	var pull struct {
+		HtmlUrl string `json:"html_url"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&pull)
+	if err != nil {
+		return "", err
+	}
+
+	return pull.HtmlUrl, nil
+}
@@ -0,0 +1,72 @@
+package handlers
+
+import (
+	"encoding/json"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestOpenFilesPullRequest(t *testing.T) {
+
+	t.Setenv("GITHUB", "{}")
+
+	var pulls []map[string]string
+	var pullsLock sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var pull map[string]string
+		json.NewDecoder(r.Body).Decode(&pull)
+
+		pullsLock.Lock()
+		pulls = append(pulls, pull)
+		pullsLock.Unlock()
+
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]string{"html_url": "https://github.com/acme/shop/pull/1"})
+	}))
+	defer server.Close()
+	t.Setenv("GITHUB_API", server.URL)
+
+	repo := skeletonRepo(t, map[string]string{"README.md": "# Shop\n"})
+	files := []RemoteFile{{Name: "main.tf", Path: "addons/redis/infra/aws-ecs", Data: []byte("# redis\n"), Perm: 0640}}
+
+	url, err := OpenFilesPullRequest(repo, "bones/addon-redis-infra", files, "Add Redis infrastructure")
+	if err != nil || url != "https://github.com/acme/shop/pull/1" {
+		t.Fatalf("expected the pull request got %q %v", url, err)
+	}
+
+	pullsLock.Lock()
+	defer pullsLock.Unlock()
+	if len(pulls) != 1 || pulls[0]["head"] != "bones/addon-redis-infra" || pulls[0]["base"] != "master" {
+		t.Errorf("expected a pull request into master got %v", pulls)
+	}
+
+	r, err := git.PlainOpen(repo)
+	if err != nil {
+		t.Fatalf("expected error to be nil got %v", err)
+	}
+
+	contents := func(ref plumbing.ReferenceName) string {
+		head, err := r.Reference(ref, true)
+		if err != nil {
+			t.Fatalf("expected error to be nil got %v", err)
+		}
+		commit, _ := r.CommitObject(head.Hash())
+		file, err := commit.File("addons/redis/infra/aws-ecs/main.tf")
+		if err != nil {
+			return ""
+		}
+		text, _ := file.Contents()
+		return text
+	}
+
+	if text := contents(plumbing.NewBranchReferenceName("bones/addon-redis-infra")); text != "# redis\n" {
+		t.Errorf("expected the file on the branch got %q", text)
+	}
+	if text := contents(plumbing.NewBranchReferenceName("master")); text != "" {
+		t.Errorf("expected the default branch to be left alone got %q", text)
+	}
+}
@@ -0,0 +1,654 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/bones/server/common"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	http2 "github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/go-git/go-git/v5/storage/memory"
+	"gopkg.in/yaml.v3"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The workspace cache keeps one pristine checkout per skeleton repo, commit
+// and path. Every caller gets its own copy, since handlers render templates
+// and run terraform init in place.
+
+const defaultSkeletonCacheSize = 32
+
+// A cachedSkeleton is held by users callers between cacheSkeleton and
+// release, under skeletonCacheLock, and only entries nobody holds are
+// evicted. lock serializes the fetch and the copies made from dir.
+type cachedSkeleton struct {
+	dir      string
+	lastUsed time.Time
+	users    int
+	lock     sync.Mutex
+}
+
+// release unlocks an entry returned by cacheSkeleton.
+func (cached *cachedSkeleton) release() {
+	cached.lock.Unlock()
+
+	skeletonCacheLock.Lock()
+	cached.users--
+	skeletonCacheLock.Unlock()
+}
+
+var skeletonCache = make(map[string]*cachedSkeleton)
+var skeletonCacheLock sync.Mutex
+
+var skeletonCacheHits int64
+var skeletonCacheMisses int64
+
+// CacheStats reports how many skeleton checkouts were served from the cache
+// and how many needed a fetch.
+func CacheStats() (hits int64, misses int64) {
+	return atomic.LoadInt64(&skeletonCacheHits), atomic.LoadInt64(&skeletonCacheMisses)
+}
+
+type pinnedKey struct{}
+
+// skeletonPins maps repo@ref to the commit every checkout in a run uses.
+// Refs first resolved during the run, such as those of includes, are added
+// as they are met.
+type skeletonPins struct {
+	lock sync.Mutex
+	shas map[string]string
+}
+
+func pinKey(repo string, ref string) string {
+	return repo + "@" + ref
+}
+
+// PinSkeleton returns a copy of ctx under which every checkout of repo uses
+// commit sha, so that all steps of a run see the same skeleton.
+func PinSkeleton(ctx context.Context, repo string, sha string) context.Context {
+	pins := &skeletonPins{shas: map[string]string{pinKey(repo, ""): sha}}
+	if parent, ok := ctx.Value(pinnedKey{}).(*skeletonPins); ok {
+		parent.lock.Lock()
+		for key, s := range parent.shas {
+			if _, ok := pins.shas[key]; !ok {
+				pins.shas[key] = s
+			}
+		}
+		parent.lock.Unlock()
+	}
+
+	return context.WithValue(ctx, pinnedKey{}, pins)
+}
+
+// resolveSkeleton returns the commit ref of repo is at, as pinned on ctx.
+func resolveSkeleton(ctx context.Context, repo string, ref string) (string, error) {
+	pins, _ := ctx.Value(pinnedKey{}).(*skeletonPins)
+	if pins != nil {
+		pins.lock.Lock()
+		sha, ok := pins.shas[pinKey(repo, ref)]
+		pins.lock.Unlock()
+		if ok {
+			return sha, nil
+		}
+	}
+
+	sha, err := ResolveRef(repo, ref)
+	if err != nil {
+		return "", err
+	}
+
+	if pins != nil {
+		pins.lock.Lock()
+		pins.shas[pinKey(repo, ref)] = sha
+		pins.lock.Unlock()
+	}
+
+	return sha, nil
+}
+
+// repoAuth returns the GitHub credentials for repo if it is on the host of
+// GITHUB_BASE. Any other repo, such as a skeleton a caller names, is
+// fetched without them, so that the token only goes to GitHub.
+func repoAuth(repo string) transport.AuthMethod {
+	githubCredsEnv := os.Getenv("GITHUB")
+
+	var githubCreds GithubCreds
+	err := json.Unmarshal([]byte(githubCredsEnv), &githubCreds)
+	if err != nil {
+		fmt.Printf("Can't parse github environment: %s\n", err)
+	}
+
+	base, err := url.Parse(githubCreds.GITHUB_BASE)
+	if err != nil || base.Host == "" {
+		return nil
+	}
+
+	target, err := url.Parse(repo)
+	if err != nil || target.Scheme != base.Scheme || !strings.EqualFold(target.Host, base.Host) {
+		return nil
+	}
+
+	return githubAuth()
+}
+
+func githubAuth() *http2.BasicAuth {
+	githubCredsEnv := os.Getenv("GITHUB")
+
+	var githubCreds GithubCreds
+	err := json.Unmarshal([]byte(githubCredsEnv), &githubCreds)
+	if err != nil {
+		fmt.Printf("Can't parse github environment: %s\n", err)
+	}
+
+	return &http2.BasicAuth{
+		Username: githubCreds.GITHUB_USER,
+		Password: githubCreds.GITHUB_TOKEN,
+	}
+}
+
+// ResolveHead returns the commit the default branch of repo points at,
+// without cloning it.
+func ResolveHead(repo string) (string, error) {
+	return ResolveRef(repo, "")
+}
+
+var commitHash = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+// ResolveRef returns the commit ref points at in repo, without cloning it.
+// Ref is a branch, a tag, a full ref name or a commit; empty means HEAD.
+func ResolveRef(repo string, ref string) (string, error) {
+	if commitHash.MatchString(ref) {
+		return ref, nil
+	}
+
+	remote := git.NewRemote(memory.NewStorage(), &config.RemoteConfig{
+		Name: "origin",
+		URLs: []string{repo},
+	})
+
+	refs, err := remote.List(&git.ListOptions{Auth: repoAuth(repo)})
+	if err != nil {
+		return "", err
+	}
+
+	byName := make(map[plumbing.ReferenceName]*plumbing.Reference)
+	for _, r := range refs {
+		byName[r.Name()] = r
+	}
+
+	candidates := []plumbing.ReferenceName{plumbing.HEAD}
+	if ref != "" {
+		candidates = []plumbing.ReferenceName{
+			plumbing.NewBranchReferenceName(ref),
+			plumbing.NewTagReferenceName(ref),
+			plumbing.ReferenceName(ref),
+		}
+	}
+
+	for _, name := range candidates {
+		head, ok := byName[name]
+		for ok && head.Type() == plumbing.SymbolicReference {
+			head, ok = byName[head.Target()]
+		}
+		if ok {
+			return head.Hash().String(), nil
+		}
+	}
+
+	if ref == "" {
+		ref = "HEAD"
+	}
+
+	return "", fmt.Errorf("can't resolve %s of %s", ref, repo)
+}
+
+// CheckoutSkeleton returns a private copy of path in repo, laid out like
+// DownloadRepo so that dir+path is the skeleton. The commit is the one pinned
+// on ctx with PinSkeleton, or the current HEAD. Skeletons it includes are
+// composed into the copy, see checkoutComposed. The caller removes dir.
+func CheckoutSkeleton(ctx context.Context, repo string, path string) (string, error) {
+	tempDir, err := os.MkdirTemp("", "skeleton")
+	if err != nil {
+		return "", err
+	}
+
+	err = checkoutComposed(ctx, repo, "", path, tempDir+path, nil)
+	if err != nil {
+		os.RemoveAll(tempDir)
+		return "", err
+	}
+
+	return tempDir, nil
+}
+
+// ReadManifest returns the manifest of the skeleton at path in repo as it is
+// written, before its includes are merged into it, or nil when it has none.
+// The commit is chosen as by CheckoutSkeleton.
+func ReadManifest(ctx context.Context, repo string, path string) ([]byte, error) {
+	sha, err := resolveSkeleton(ctx, repo, "")
+	if err != nil {
+		return nil, err
+	}
+
+	cached, err := cacheSkeleton(repo, sha, path)
+	if err != nil {
+		return nil, err
+	}
+	defer cached.release()
+
+	manifest, err := os.ReadFile(cached.dir + path + "/" + manifestFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	return manifest, err
+}
+
+const maxIncludeDepth = 8
+
+const manifestFile = ".skeleton/skeleton.yaml"
+
+// SkeletonInclude is an entry of a manifest's include list: another skeleton
+// whose files, inputs and steps this one builds on.
+//
+//	include:
+//	  - repo: https://github.com/acme/platform-skeletons
+//	    ref: v1.4.0
+//	    path: /standard-ecs
+type SkeletonInclude struct {
+	Repo string `yaml:"repo"`
+	Ref  string `yaml:"ref"`
+	Path string `yaml:"path"`
+}
+
+// CheckoutLocalSkeleton is CheckoutSkeleton for a skeleton in a local
+// directory, such as its author's working copy with uncommitted changes:
+// root+path is the skeleton. Includes that name no repo are read from root
+// too. The caller removes dir.
+func CheckoutLocalSkeleton(ctx context.Context, root string, path string) (string, error) {
+	tempDir, err := os.MkdirTemp("", "skeleton")
+	if err != nil {
+		return "", err
+	}
+
+	err = checkoutLocal(ctx, root, path, tempDir+path, nil)
+	if err != nil {
+		os.RemoveAll(tempDir)
+		return "", err
+	}
+
+	return tempDir, nil
+}
+
+// checkIncludes fails if the skeleton id is already being composed, or the
+// includes are nested too deep.
+func checkIncludes(id string, stack []string) error {
+	for _, s := range stack {
+		if s == id {
+			return fmt.Errorf("skeleton %s includes itself", id)
+		}
+	}
+	if len(stack) >= maxIncludeDepth {
+		return fmt.Errorf("skeleton %s is included more than %d levels deep", id, maxIncludeDepth)
+	}
+
+	return nil
+}
+
+// checkoutComposed writes the skeleton at repo, ref and path into dst. Its
+// includes are written first, in order, and each layer's files replace those
+// of the layers below. The manifests of all layers are merged by
+// mergeManifests into dst's manifest.
+func checkoutComposed(ctx context.Context, repo string, ref string, path string, dst string, stack []string) error {
+	sha, err := resolveSkeleton(ctx, repo, ref)
+	if err != nil {
+		return err
+	}
+
+	id := repo + "@" + sha + ":" + path
+	err = checkIncludes(id, stack)
+	if err != nil {
+		return err
+	}
+
+	cached, err := cacheSkeleton(repo, sha, path)
+	if err != nil {
+		return err
+	}
+	defer cached.release()
+
+	return composeLayer(cached.dir+path, id, dst, func(include SkeletonInclude) error {
+		if include.Repo == "" {
+			include.Repo = repo
+		}
+
+		return checkoutComposed(ctx, include.Repo, include.Ref, include.Path, dst, append(stack, id))
+	})
+}
+
+// checkoutLocal is checkoutComposed for the skeleton at root+path.
+func checkoutLocal(ctx context.Context, root string, path string, dst string, stack []string) error {
+	id := root + ":" + path
+	err := checkIncludes(id, stack)
+	if err != nil {
+		return err
+	}
+
+	return composeLayer(root+path, id, dst, func(include SkeletonInclude) error {
+		if include.Repo == "" {
+			return checkoutLocal(ctx, root, include.Path, dst, append(stack, id))
+		}
+
+		return checkoutComposed(ctx, include.Repo, include.Ref, include.Path, dst, append(stack, id))
+	})
+}
+
+// composeLayer writes the skeleton at src, known as id, into dst on top of
+// its includes, which checkout writes there first.
+func composeLayer(src string, id string, dst string, checkout func(include SkeletonInclude) error) error {
+	manifest, err := os.ReadFile(src + "/" + manifestFile)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	var own struct {
+		Include []SkeletonInclude `yaml:"include"`
+	}
+	err = yaml.Unmarshal(manifest, &own)
+	if err != nil {
+		return fmt.Errorf("parsing %s of %s: %w", manifestFile, id, err)
+	}
+
+	var manifests [][]byte
+	for _, include := range own.Include {
+		include.Path = "/" + strings.Trim(include.Path, "/")
+
+		// The manifests of earlier includes are kept in manifests already,
+		// and one left in dst isn't this include's.
+		err = os.Remove(dst + "/" + manifestFile)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		err = checkout(include)
+		if err != nil {
+			return err
+		}
+
+		included, err := os.ReadFile(dst + "/" + manifestFile)
+		if err == nil {
+			manifests = append(manifests, included)
+		}
+	}
+
+	// The tests of an included skeleton don't hold for this one.
+	err = os.RemoveAll(dst + "/" + common.TestsDir)
+	if err != nil {
+		return err
+	}
+
+	err = copySkeleton(src, dst)
+	if err != nil {
+		return err
+	}
+
+	if len(own.Include) == 0 {
+		return nil
+	}
+
+	merged, err := mergeManifests(append(manifests, manifest))
+	if err != nil {
+		return fmt.Errorf("merging includes of %s: %w", id, err)
+	}
+
+	return os.WriteFile(dst+"/"+manifestFile, merged, 0644)
+}
+
+// copySkeleton copies a cached checkout, leaving out the cache's own .git.
+func copySkeleton(src string, dst string) error {
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(dst, 0755)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if entry.Name() == ".git" {
+			continue
+		}
+
+		if entry.IsDir() {
+			err = common.Dir(filepath.Join(src, entry.Name()), filepath.Join(dst, entry.Name()))
+		} else {
+			err = common.File(filepath.Join(src, entry.Name()), filepath.Join(dst, entry.Name()))
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// cacheSkeleton returns the cache entry for repo at sha, fetching it first if
+// needed. The entry is returned held and locked, so that it can't be evicted
+// while it is being copied, and must be released.
+func cacheSkeleton(repo string, sha string, path string) (*cachedSkeleton, error) {
+	sum := sha256.Sum256([]byte(repo + "\x00" + path))
+	key := hex.EncodeToString(sum[:8]) + "-" + sha
+
+	skeletonCacheLock.Lock()
+	cached, ok := skeletonCache[key]
+	if !ok {
+		cached = &cachedSkeleton{}
+		skeletonCache[key] = cached
+	}
+	cached.lastUsed = time.Now()
+	cached.users++
+	skeletonCacheLock.Unlock()
+
+	cached.lock.Lock()
+
+	if cached.dir != "" {
+		atomic.AddInt64(&skeletonCacheHits, 1)
+		return cached, nil
+	}
+
+	atomic.AddInt64(&skeletonCacheMisses, 1)
+
+	dir := filepath.Join(os.TempDir(), "bones-skeletons", key)
+	os.RemoveAll(dir)
+
+	// A failed fetch leaves the entry empty for the next caller to retry.
+	err := fetchSkeleton(dir, repo, sha, path)
+	if err != nil {
+		os.RemoveAll(dir)
+		cached.release()
+
+		return nil, err
+	}
+
+	cached.dir = dir
+	evictSkeletons(key)
+
+	return cached, nil
+}
+
+// fetchSkeleton checks out only path of repo at sha into dir. A shallow clone
+// of the default branch is enough unless it has moved past sha since it was
+// resolved, in which case the full history is fetched.
+func fetchSkeleton(dir string, repo string, sha string, path string) error {
+	var sparse []string
+	if p := strings.Trim(path, "/"); p != "" {
+		sparse = []string{p}
+	}
+
+	r, err := git.PlainClone(dir, false, &git.CloneOptions{
+		URL:          repo,
+		Auth:         repoAuth(repo),
+		Depth:        1,
+		SingleBranch: true,
+		NoCheckout:   true,
+		Tags:         git.NoTags,
+	})
+	if err != nil {
+		return err
+	}
+
+	hash := plumbing.NewHash(sha)
+	if _, err = r.CommitObject(hash); errors.Is(err, plumbing.ErrObjectNotFound) {
+		fmt.Printf("Skeleton %s has %s outside its default branch, fetching full history\n", repo, sha)
+		err = r.Fetch(&git.FetchOptions{
+			Auth:     repoAuth(repo),
+			RefSpecs: []config.RefSpec{"+refs/heads/*:refs/remotes/origin/*", "+refs/tags/*:refs/tags/*"},
+		})
+		if err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
+			return err
+		}
+	}
+
+	// Annotated tags resolve to the tag object rather than the commit.
+	if tag, err := r.TagObject(hash); err == nil {
+		commit, err := tag.Commit()
+		if err != nil {
+			return err
+		}
+		hash = commit.Hash
+	}
+
+	w, err := r.Worktree()
+	if err != nil {
+		return err
+	}
+
+	return w.Checkout(&git.CheckoutOptions{
+		Hash:                      hash,
+		SparseCheckoutDirectories: sparse,
+	})
+}
+
+// evictSkeletons removes the least recently used entries beyond
+// SKELETON_CACHE_SIZE, keeping the entry that was just added and those in
+// use.
+func evictSkeletons(keep string) {
+	size := defaultSkeletonCacheSize
+	if value, err := strconv.Atoi(common.GetConfig("SKELETON_CACHE_SIZE")); err == nil && value > 0 {
+		size = value
+	}
+
+	skeletonCacheLock.Lock()
+	defer skeletonCacheLock.Unlock()
+
+	if len(skeletonCache) <= size {
+		return
+	}
+
+	keys := make([]string, 0, len(skeletonCache))
+	for key := range skeletonCache {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return skeletonCache[keys[i]].lastUsed.Before(skeletonCache[keys[j]].lastUsed)
+	})
+
+	for _, key := range keys[:len(keys)-size] {
+		cached := skeletonCache[key]
+		if key == keep || cached.users > 0 {
+			continue
+		}
+
+		if cached.dir != "" {
+			os.RemoveAll(cached.dir)
+		}
+		delete(skeletonCache, key)
+	}
+}
+
+// mergeManifests merges skeleton manifests, lowest layer first. Inputs,
+// actions and generate and destroy steps are merged by name: a later layer's entry
+// replaces an earlier one with the same name in place, and new entries are
+// appended. Any other key is taken from the last layer that sets it. The
+// merged manifest has no include list, as it is already composed.
+func mergeManifests(manifests [][]byte) ([]byte, error) {
+	merged := make(map[string]interface{})
+
+	for _, manifest := range manifests {
+		var layer map[string]interface{}
+		err := yaml.Unmarshal(manifest, &layer)
+		if err != nil {
+			return nil, err
+		}
+
+		for key, value := range layer {
+			switch key {
+			case "include":
+			case "inputs", "actions":
+				merged[key] = mergeByName(merged[key], value)
+			case "generate", "destroy":
+				base, _ := merged[key].(map[string]interface{})
+				section, _ := value.(map[string]interface{})
+
+				result := make(map[string]interface{})
+				for k, v := range base {
+					result[k] = v
+				}
+				for k, v := range section {
+					if k == "steps" {
+						v = mergeByName(base[k], v)
+					}
+					result[k] = v
+				}
+				merged[key] = result
+			default:
+				merged[key] = value
+			}
+		}
+	}
+
+	return yaml.Marshal(merged)
+}
+
+func mergeByName(base interface{}, layer interface{}) []interface{} {
+	result, _ := base.([]interface{})
+	result = append([]interface{}{}, result...)
+
+	entries, _ := layer.([]interface{})
+	for _, entry := range entries {
+		fields, _ := entry.(map[string]interface{})
+		name := fields["name"]
+
+		replaced := false
+		for i, existing := range result {
+			existingFields, _ := existing.(map[string]interface{})
+			if name != nil && existingFields["name"] == name {
+				result[i] = entry
+				replaced = true
+			}
+		}
+
+		if !replaced {
+			result = append(result, entry)
+		}
+	}
+
+	return result
+}
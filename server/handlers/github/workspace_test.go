@@ -0,0 +1,204 @@
+package handlers
+
+import (
+	"context"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// skeletonRepo commits files to a new repository in a temp dir.
+func skeletonRepo(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+
+	r, err := git.PlainInit(dir, false)
+	if err != nil {
+		t.Fatalf("expected error to be nil got %v", err)
+	}
+	w, _ := r.Worktree()
+
+	for name, content := range files {
+		os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755)
+		os.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+		w.Add(name)
+	}
+
+	_, err = w.Commit("Skeleton", &git.CommitOptions{Author: &object.Signature{Name: "test", When: time.Now()}})
+	if err != nil {
+		t.Fatalf("expected error to be nil got %v", err)
+	}
+
+	return dir
+}
+
+func cached(t *testing.T, repo string) *cachedSkeleton {
+	sha, err := ResolveHead(repo)
+	if err != nil {
+		t.Fatalf("expected error to be nil got %v", err)
+	}
+
+	entry, err := cacheSkeleton(repo, sha, "/app")
+	if err != nil {
+		t.Fatalf("expected error to be nil got %v", err)
+	}
+
+	return entry
+}
+
+func TestCacheSkeletonHitAndMiss(t *testing.T) {
+
+	repo := skeletonRepo(t, map[string]string{"app/README.md": "# App\n"})
+
+	hits, misses := CacheStats()
+
+	for i := 0; i < 2; i++ {
+		dir, err := CheckoutSkeleton(context.Background(), repo, "/app")
+		if err != nil {
+			t.Fatalf("expected error to be nil got %v", err)
+		}
+		defer os.RemoveAll(dir)
+
+		readme, _ := os.ReadFile(filepath.Join(dir, "app/README.md"))
+		if string(readme) != "# App\n" {
+			t.Errorf("expected the README got %q", readme)
+		}
+	}
+
+	h, m := CacheStats()
+	if h-hits != 1 || m-misses != 1 {
+		t.Errorf("expected 1 hit and 1 miss got %d and %d", h-hits, m-misses)
+	}
+}
+
+func TestCacheSkeletonEviction(t *testing.T) {
+
+	t.Setenv("SKELETON_CACHE_SIZE", "1")
+
+	first := skeletonRepo(t, map[string]string{"app/README.md": "first"})
+	second := skeletonRepo(t, map[string]string{"app/README.md": "second"})
+	third := skeletonRepo(t, map[string]string{"app/README.md": "third"})
+
+	// An entry in use survives eviction.
+	held := cached(t, first)
+	cached(t, second).release()
+
+	if _, err := os.Stat(held.dir); err != nil {
+		t.Errorf("expected the held entry to be kept got %v", err)
+	}
+	held.release()
+
+	last := cached(t, third)
+	last.release()
+
+	skeletonCacheLock.Lock()
+	size := len(skeletonCache)
+	skeletonCacheLock.Unlock()
+
+	if size != 1 {
+		t.Errorf("expected 1 entry got %d", size)
+	}
+	if _, err := os.Stat(held.dir); !os.IsNotExist(err) {
+		t.Errorf("expected the released entry to be removed got %v", err)
+	}
+
+	readme, _ := os.ReadFile(filepath.Join(last.dir, "app/README.md"))
+	if string(readme) != "third" {
+		t.Errorf("expected third got %q", readme)
+	}
+}
+
+func TestCacheSkeletonConcurrentEviction(t *testing.T) {
+
+	t.Setenv("SKELETON_CACHE_SIZE", "1")
+
+	var repos []string
+	for _, name := range []string{"a", "b", "c"} {
+		repos = append(repos, skeletonRepo(t, map[string]string{"app/README.md": name}))
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 12; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			repo := repos[i%len(repos)]
+			dir, err := CheckoutSkeleton(context.Background(), repo, "/app")
+			if err != nil {
+				t.Errorf("expected error to be nil got %v", err)
+				return
+			}
+			defer os.RemoveAll(dir)
+
+			readme, _ := os.ReadFile(filepath.Join(dir, "app/README.md"))
+			if string(readme) != []string{"a", "b", "c"}[i%len(repos)] {
+				t.Errorf("expected a checkout of %s got %q", repo, readme)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestCheckoutSkeletonIncludeWithoutManifest(t *testing.T) {
+
+	base := skeletonRepo(t, map[string]string{
+		"ecs/.skeleton/skeleton.yaml": "inputs:\n  - name: REPLICAS\ngenerate:\n  steps:\n    - name: Infra\n      handler: aws\n",
+		"docs/README.md":              "docs",
+	})
+
+	// The docs include has no manifest and a path without a leading slash.
+	app := skeletonRepo(t, map[string]string{
+		"app/.skeleton/skeleton.yaml": "include:\n  - repo: " + base + "\n    path: /ecs\n  - repo: " + base + "\n    path: docs/\ninputs:\n  - name: GO_VERSION\n",
+	})
+
+	dir, err := CheckoutSkeleton(context.Background(), app, "/app")
+	if err != nil {
+		t.Fatalf("expected error to be nil got %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	readme, _ := os.ReadFile(filepath.Join(dir, "app/README.md"))
+	if string(readme) != "docs" {
+		t.Errorf("expected the docs include got %q", readme)
+	}
+
+	manifest, _ := os.ReadFile(filepath.Join(dir, "app", manifestFile))
+
+	var merged struct {
+		Inputs   []map[string]interface{} `yaml:"inputs"`
+		Generate struct {
+			Steps []map[string]interface{} `yaml:"steps"`
+		} `yaml:"generate"`
+	}
+	err = yaml.Unmarshal(manifest, &merged)
+	if err != nil {
+		t.Fatalf("expected error to be nil got %v", err)
+	}
+
+	if len(merged.Inputs) != 2 || len(merged.Generate.Steps) != 1 {
+		t.Errorf("expected the ecs manifest once got %s", manifest)
+	}
+}
+
+func TestRepoAuth(t *testing.T) {
+
+	t.Setenv("GITHUB", `{"GITHUB_USER": "bones", "GITHUB_TOKEN": "secret", "GITHUB_BASE": "https://github.com/acme"}`)
+
+	for repo, expected := range map[string]bool{
+		"https://github.com/acme/shop":       true,
+		"https://GitHub.com/other/skeletons": true,
+		"https://evil.example.com/acme/shop": false,
+		"http://github.com/acme/shop":        false,
+		"https://github.com.evil.example/x":  false,
+		"/tmp/skeletons":                     false,
+	} {
+		if auth := repoAuth(repo); (auth != nil) != expected {
+			t.Errorf("%s: expected credentials %v got %v", repo, expected, auth)
+		}
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultPageSize = 50
+const maxPageSize = 500
+
+// ListResponse is a page of a listing. Next is the cursor of the following
+// page, passed back as ?cursor=, and is empty on the last page.
+type ListResponse struct {
+	Items interface{} `json:"items"`
+	Next  string      `json:"next,omitempty"`
+}
+
+// pageKey is what a listed item is sorted and paged by. Ties are broken by
+// Id, so that the order, and with it every cursor, is stable.
+type pageKey struct {
+	Sort string    `json:"s"`
+	Time time.Time `json:"t,omitempty"`
+	Name string    `json:"n,omitempty"`
+	Id   string    `json:"i"`
+}
+
+type listEntry struct {
+	key  pageKey
+	item interface{}
+}
+
+// listQuery is the sorting and paging of a listing:
+//
+//	?sort=-updated&limit=20&cursor=...
+//
+// Sort is created (the default), updated or name, with a leading - for
+// descending order.
+type listQuery struct {
+	param  string
+	sort   string
+	desc   bool
+	limit  int
+	cursor *pageKey
+}
+
+func parseListQuery(query url.Values) (listQuery, error) {
+	list := listQuery{sort: "created", limit: defaultPageSize}
+
+	list.param = query.Get("sort")
+	if s := list.param; s != "" {
+		list.desc = strings.HasPrefix(s, "-")
+		list.sort = strings.TrimPrefix(s, "-")
+	}
+
+	switch list.sort {
+	case "created", "updated", "name":
+	default:
+		return list, errors.New("sort must be created, updated or name")
+	}
+
+	if l := query.Get("limit"); l != "" {
+		limit, err := strconv.Atoi(l)
+		if err != nil || limit <= 0 {
+			return list, errors.New("limit must be a positive number")
+		}
+		if limit > maxPageSize {
+			limit = maxPageSize
+		}
+		list.limit = limit
+	}
+
+	if c := query.Get("cursor"); c != "" {
+		text, err := base64.RawURLEncoding.DecodeString(c)
+		if err == nil {
+			list.cursor = &pageKey{}
+			err = json.Unmarshal(text, list.cursor)
+		}
+		if err != nil || list.cursor.Sort != list.param {
+			return list, errors.New("cursor is not valid for this listing")
+		}
+	}
+
+	return list, nil
+}
+
+// key returns the page key of an item for the query's sort order.
+func (list listQuery) key(id string, name string, created time.Time, updated time.Time) pageKey {
+	key := pageKey{Sort: list.param, Id: id}
+
+	switch list.sort {
+	case "created":
+		key.Time = created
+	case "updated":
+		key.Time = updated
+	case "name":
+		key.Name = name
+	}
+
+	return key
+}
+
+func (list listQuery) less(a pageKey, b pageKey) bool {
+	if list.desc {
+		a, b = b, a
+	}
+
+	if !a.Time.Equal(b.Time) {
+		return a.Time.Before(b.Time)
+	}
+	if a.Name != b.Name {
+		return a.Name < b.Name
+	}
+
+	return a.Id < b.Id
+}
+
+// page sorts entries and returns the page after the query's cursor.
+func (list listQuery) page(entries []listEntry) ListResponse {
+	sort.Slice(entries, func(i, j int) bool {
+		return list.less(entries[i].key, entries[j].key)
+	})
+
+	start := 0
+	if list.cursor != nil {
+		start = sort.Search(len(entries), func(i int) bool {
+			return list.less(*list.cursor, entries[i].key)
+		})
+	}
+
+	items := []interface{}{}
+	response := ListResponse{}
+
+	for i := start; i < len(entries); i++ {
+		if len(items) == list.limit {
+			text, _ := json.Marshal(entries[i-1].key)
+			response.Next = base64.RawURLEncoding.EncodeToString(text)
+			break
+		}
+		items = append(items, entries[i].item)
+	}
+
+	response.Items = items
+	return response
+}
+
+// hasLabels reports whether labels has every label filter of the query, each
+// either key=value or a bare key that only needs to be set.
+func hasLabels(labels map[string]string, query url.Values) bool {
+	for _, filter := range query["label"] {
+		key, value, hasValue := strings.Cut(filter, "=")
+
+		actual, ok := labels[key]
+		if !ok || (hasValue && actual != value) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// matchProject applies the type, owner, status, label and name prefix filters
+// of GET /project. Status is that of the project's last run. The caller must
+// hold runsLock.
+func matchProject(project *Project, query url.Values) bool {
+	if t := query.Get("type"); t != "" && project.Type != t {
+		return false
+	}
+
+	if owner := query.Get("owner"); owner != "" {
+		owned := false
+		for _, o := range project.Owners {
+			owned = owned || o == owner
+		}
+		if !owned {
+			return false
+		}
+	}
+
+	if status := query.Get("status"); status != "" {
+		run, ok := Runs[project.LastRun]
+		if !ok || string(run.Status) != status {
+			return false
+		}
+	}
+
+	if name := query.Get("name"); name != "" && !strings.HasPrefix(project.Name, name) {
+		return false
+	}
+
+	return hasLabels(project.Labels, query)
+}
+
+// matchProjectType applies the name prefix and addon filters of GET /type.
+func matchProjectType(projectType ProjectType, query url.Values) bool {
+	if name := query.Get("name"); name != "" && !strings.HasPrefix(projectType.Name, name) {
+		return false
+	}
+
+	if addon := query.Get("addon"); addon != "" && strconv.FormatBool(projectType.Addon) != addon {
+		return false
+	}
+
+	return true
+}
+
+func returnAllProjects(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Endpoint Hit: returnAllProjects")
+
+	query := r.URL.Query()
+	list, err := parseListQuery(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	runsLock.Lock()
+	defer runsLock.Unlock()
+
+	var entries []listEntry
+	for _, project := range Projects {
+		if matchProject(project, query) {
+			key := list.key(project.Id, project.Name, project.CreatedAt, project.UpdatedAt)
+			entries = append(entries, listEntry{key: key, item: project})
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list.page(entries))
+}
+
+func returnAllProjectTypes(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	list, err := parseListQuery(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var entries []listEntry
+	projectTypesLock.RLock()
+	for _, projectType := range ProjectTypes {
+		if matchProjectType(projectType, query) {
+			key := list.key(projectType.Slug, projectType.Name, projectType.CreatedAt, projectType.CreatedAt)
+			entries = append(entries, listEntry{key: key, item: projectType})
+		}
+	}
+	projectTypesLock.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list.page(entries))
+}
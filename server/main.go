@@ -1,9 +1,12 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"github.com/bones/server/common"
 	aws "github.com/bones/server/handlers/aws"
 	circleci "github.com/bones/server/handlers/circleci"
 	github "github.com/bones/server/handlers/github"
@@ -13,7 +16,10 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 )
 
 var banner = `
@@ -28,12 +34,60 @@ Your skeleton army scaffolding service
 `
 
 type Project struct {
-	Id   string            `json:"Id"`
-	Name string            `json:"name"`
-	Type string            `json:"type"`
-	Desc string            `json:"desc"`
-	Repo string            `json:"repo"`
-	Data map[string]string `json:"data""`
+	Id   string      `json:"id"`
+	Name string      `json:"name"`
+	Type string      `json:"type"`
+	Desc string      `json:"desc"`
+	Repo string      `json:"repo"`
+	Data common.Data `json:"data"`
+
+	Owners       []string                `json:"owners,omitempty"`
+	Labels       map[string]string       `json:"labels,omitempty"`
+	CreatedAt    time.Time               `json:"createdAt"`
+	UpdatedAt    time.Time               `json:"updatedAt"`
+	SkeletonRef  string                  `json:"skeletonRef,omitempty"`
+	LastRun      string                  `json:"lastRun,omitempty"`
+	States       []ProjectState          `json:"states,omitempty"`
+	Resources    []common.Resource       `json:"resources,omitempty"`
+	Drift        *ProjectDrift           `json:"drift,omitempty"`
+	Environments map[string]*Environment `json:"environments,omitempty"`
+	Outputs      map[string]interface{}  `json:"outputs,omitempty"`
+	Addons       []*ProjectAddon         `json:"addons,omitempty"`
+}
+
+// ProjectState is a Terraform state applied on behalf of a project, together
+// with the handler, environment, for_each item and add-on needed to plan it
+// again.
+type ProjectState struct {
+	Handler     string      `json:"handler"`
+	Key         string      `json:"key"`
+	Environment string      `json:"environment,omitempty"`
+	Each        string      `json:"each,omitempty"`
+	EachValue   interface{} `json:"each_value,omitempty"`
+	EachIndex   int         `json:"each_index,omitempty"`
+	Addon       string      `json:"addon,omitempty"`
+
+	// Gated is set when the step that applied the state comes after an
+	// approval step, so that reconciling it waits for sign-off too.
+	Gated bool `json:"gated,omitempty"`
+}
+
+// context returns a copy of ctx for the for_each item and add-on the state
+// was applied for.
+func (state ProjectState) context(ctx context.Context) context.Context {
+	if state.Each != "" {
+		each := common.Each{Key: state.Each, Value: state.EachValue, Index: state.EachIndex}
+		if each.Value == nil {
+			// Recorded before item values were kept.
+			each.Value = state.Each
+		}
+		ctx = common.WithEach(ctx, each)
+	}
+	if state.Addon != "" {
+		ctx = common.WithAddon(ctx, state.Addon)
+	}
+
+	return ctx
 }
 
 type ProjectType struct {
@@ -42,17 +96,35 @@ type ProjectType struct {
 	Desc string `json:"desc"`
 	Repo string `json:"repo"`
 	Path string `json:"path"`
+
+	// Addon types are applied to existing projects rather than generating
+	// new ones.
+	Addon     bool                   `json:"addon,omitempty"`
+	Terraform common.TerraformBinary `json:"terraform"`
+	CreatedAt time.Time              `json:"createdAt"`
 }
 
 type ProjectCreateRequest struct {
-	Type string            `json:"type"`
-	Name string            `json:"name"`
-	Desc string            `json:"desc"`
-	Data map[string]string `json:"data""`
+	Type   string            `json:"type"`
+	Name   string            `json:"name"`
+	Desc   string            `json:"desc"`
+	Data   common.Data       `json:"data"`
+	Owners []string          `json:"owners"`
+	Labels map[string]string `json:"labels"`
+}
+
+// ProjectUpdateRequest changes the fields it sets. Owners and labels are
+// replaced as a whole. Data is merged into the project's data, and a key set
+// to null is removed.
+type ProjectUpdateRequest struct {
+	Desc   *string            `json:"desc"`
+	Data   common.Data        `json:"data"`
+	Owners *[]string          `json:"owners"`
+	Labels *map[string]string `json:"labels"`
 }
 
 type ProjectDeleteRequest struct {
-	Id string `json:"Id"`
+	Id string `json:"id"`
 }
 
 type ProjectTypeCreateRequest struct {
@@ -60,6 +132,9 @@ type ProjectTypeCreateRequest struct {
 	Desc string `json:"desc"`
 	Repo string `json:"repo"`
 	Path string `json:"path"`
+
+	Addon     bool                   `json:"addon"`
+	Terraform common.TerraformBinary `json:"terraform"`
 }
 
 type ProjectTypeDeleteRequest struct {
@@ -70,71 +145,288 @@ type ProjectTypeDeleteRequest struct {
 // correctly populate the data.
 
 type GenerateStep struct {
-	Name    string
-	Handler string
-	Path    string
-	Cmd     string
+	Name      string
+	Handler   string
+	Path      string
+	Cmd       string
+	When      string
+	ForEach   string   `yaml:"for_each"`
+	DependsOn []string `yaml:"depends_on"`
 }
 
 type DestroyStep struct {
-	Name    string
-	Handler string
-	Path    string
-	Cmd     string
+	Name      string
+	Handler   string
+	Path      string
+	Cmd       string
+	When      string
+	ForEach   string   `yaml:"for_each"`
+	DependsOn []string `yaml:"depends_on"`
 }
 
 type SkeletonYaml struct {
+	Inputs   []common.Input
 	Generate struct {
 		Steps []GenerateStep
 	}
 	Destroy struct {
 		Steps []DestroyStep
 	}
+	Actions []Action
 }
 
-// Globals
+// Globals. Projects is guarded by runsLock, like the runs, and ProjectTypes
+// by projectTypesLock.
 var Projects = make(map[string]*Project)
 var ProjectTypes = make(map[string]ProjectType)
-var SkeletonYAML = SkeletonYaml{}
+var projectTypesLock sync.RWMutex
 
-func returnAllProjects(w http.ResponseWriter, r *http.Request) {
-	fmt.Println("Endpoint Hit: returnAllProjects")
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(Projects)
+// lookupProjectType returns the project type with slug, under
+// projectTypesLock.
+func lookupProjectType(slug string) (ProjectType, bool) {
+	projectTypesLock.RLock()
+	defer projectTypesLock.RUnlock()
+
+	projectType, ok := ProjectTypes[slug]
+	return projectType, ok
 }
 
-func processGenerateSteps(step GenerateStep, project *Project, projectType ProjectType) error {
+func processGenerateSteps(ctx context.Context, step GenerateStep, project *Project, projectType ProjectType) error {
 	fmt.Printf("Running step: %s\n", step.Name)
 
 	switch step.Handler {
-	case "github":
-		project.Repo = github.CreateRepo(project.Name, projectType.Repo, projectType.Path, project.Data)
+	case "approval":
+		// Nothing to do yet: the plans of the following step wait for sign-off.
 		return nil
+	case "github":
+		repo, err := github.CreateRepo(ctx, project.Name, projectType.Repo, projectType.Path, project.Data)
+		project.Repo = repo
+		common.SetProject(ctx, "repo", repo)
+		return err
 	case "aws":
-		return aws.CreateAWSInfra(project.Name, project.Repo, projectType.Repo, projectType.Path, project.Data)
+		return aws.CreateAWSInfra(ctx, project.Name, project.Repo, projectType.Repo, projectType.Path, project.Data)
 	case "circleci":
-		return circleci.CreateProject(project.Name, project.Repo, projectType.Repo, projectType.Path, project.Data)
+		return circleci.CreateProject(ctx, project.Name, project.Repo, projectType.Repo, projectType.Path, project.Data)
 	}
 
 	return nil
 }
 
-func processDestroySteps(step DestroyStep, project *Project) error {
+func processDestroySteps(ctx context.Context, step DestroyStep, project *Project, env common.Environment) error {
 	fmt.Printf("Running step: %s\n", step.Name)
 
 	switch step.Handler {
 	case "github":
-		github.DestroyRepo(project.Repo)
-		return nil
+		return github.DestroyRepo(ctx, project.Repo)
 	case "aws":
-		return aws.DestroyAWSInfra(project.Name, project.Repo)
+		return aws.DestroyAWSInfra(ctx, project.Name, project.Repo, env)
 	case "circleci":
-		return circleci.DestroyProject(project.Name, project.Repo)
+		return circleci.DestroyProject(ctx, project.Name, project.Repo, env)
 	}
 
 	return nil
 }
 
+// readSkeletonYaml loads the bones manifest from a checked out skeleton or
+// project directory.
+func readSkeletonYaml(dir string) (SkeletonYaml, error) {
+	var skeleton SkeletonYaml
+
+	skeletonyaml, err := os.ReadFile(dir + "/.skeleton/skeleton.yaml")
+	if err != nil {
+		log.Print(err)
+		return skeleton, errors.New("project configuration not found (skeleton.yaml missing!)")
+	}
+
+	err = yaml.Unmarshal(skeletonyaml, &skeleton)
+	if err != nil {
+		log.Print(err)
+		return skeleton, errors.New("project configuration not formatted correctly (skeleton.yaml corrupted!)")
+	}
+
+	return skeleton, nil
+}
+
+// projectContext returns the context handed to the handlers when working on
+// project: it carries run, if any, is cancelled together with it, and selects
+// the Terraform binary configured by the project's type.
+func projectContext(project *Project, run *Run) context.Context {
+	ctx := context.Background()
+	if run != nil {
+		ctx = common.WithRun(run.ctx, run)
+	}
+
+	projectType, ok := lookupProjectType(project.Type)
+	if ok {
+		ctx = common.WithTerraformBinary(ctx, projectType.Terraform)
+	}
+
+	return common.WithTemplateContext(ctx, templateContext(project, projectType))
+}
+
+// templateContext describes the project to the templates rendered during
+// one of its runs.
+func templateContext(project *Project, projectType ProjectType) *common.TemplateContext {
+	serverName := common.GetConfig("SERVER_NAME")
+	if serverName == "" {
+		serverName = "bones"
+	}
+
+	tc := &common.TemplateContext{
+		Project: map[string]string{
+			"id":   project.Id,
+			"name": project.Name,
+			"slug": strings.ReplaceAll(strings.ToLower(project.Name), " ", "-"),
+			"desc": project.Desc,
+			"repo": project.Repo,
+		},
+		Type: map[string]string{
+			"slug": projectType.Slug,
+			"name": projectType.Name,
+			"desc": projectType.Desc,
+			"repo": projectType.Repo,
+			"path": projectType.Path,
+		},
+		Data: project.Data,
+		Server: map[string]string{
+			"name": serverName,
+			"url":  common.GetConfig("SERVER_URL"),
+			"time": time.Now().UTC().Format(time.RFC3339),
+		},
+	}
+
+	runsLock.Lock()
+	tc.SetOutputs(project.Outputs)
+	runsLock.Unlock()
+
+	return tc
+}
+
+// keepOutputs stores the outputs known to ctx's templates on the project, for
+// the add-ons applied to it later.
+func keepOutputs(ctx context.Context, project *Project) {
+	outputs := common.Outputs(ctx)
+
+	runsLock.Lock()
+	defer runsLock.Unlock()
+
+	if len(outputs) > 0 {
+		project.Outputs = outputs
+	}
+}
+
+func generateProject(run *Run, project *Project, projectType ProjectType) error {
+	// Every step checks out the skeleton again, so pin the commit it was at
+	// when the run started.
+	sha, err := github.ResolveHead(projectType.Repo)
+	if err != nil {
+		return err
+	}
+
+	runsLock.Lock()
+	project.SkeletonRef = sha
+	runsLock.Unlock()
+
+	ctx := github.PinSkeleton(projectContext(project, run), projectType.Repo, sha)
+
+	skeletonDir, err := github.CheckoutSkeleton(ctx, projectType.Repo, projectType.Path)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(skeletonDir)
+
+	skeleton, err := readSkeletonYaml(skeletonDir + projectType.Path)
+	if err != nil {
+		return err
+	}
+
+	runsLock.Lock()
+	err = common.ApplyInputs(skeleton.Inputs, project.Data)
+
+	//Setting standard values
+	slug := strings.ReplaceAll(strings.ToLower(project.Name), " ", "-")
+	project.Data["APP_NAME"] = slug
+	project.Data["SERVICE_NAME"] = slug + "-service"
+	runsLock.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	var steps []skeletonStep
+	for _, s := range skeleton.Generate.Steps {
+		s := s
+		steps = append(steps, skeletonStep{
+			Name: s.Name, Handler: s.Handler, When: s.When, ForEach: s.ForEach, DependsOn: s.DependsOn,
+			run: func(ctx context.Context) error {
+				return processGenerateSteps(ctx, s, project, projectType)
+			},
+		})
+	}
+
+	err = runSteps(ctx, run, project.Data, steps, false)
+	keepOutputs(ctx, project)
+
+	return err
+}
+
+// destroyProject destroys the project's add-ons and its environments, then
+// runs the destroy steps of its skeleton against the default environment.
+func destroyProject(run *Run, project *Project) error {
+	projectDir := github.DownloadRepo(project.Repo)
+	defer os.RemoveAll(projectDir)
+
+	skeleton, err := readSkeletonYaml(projectDir)
+	if err != nil {
+		return err
+	}
+
+	ctx := projectContext(project, run)
+
+	runsLock.Lock()
+	var addons []string
+	for _, addon := range project.Addons {
+		addons = append(addons, addon.Type)
+	}
+	var environments []common.Environment
+	for _, env := range project.Environments {
+		environments = append(environments, common.Environment{Name: env.Name, Vars: env.Vars})
+	}
+	runsLock.Unlock()
+
+	sort.Slice(environments, func(i, j int) bool {
+		return environments[i].Name < environments[j].Name
+	})
+
+	// Add-ons build on the project's infrastructure, so they go first.
+	for i := len(addons) - 1; i >= 0; i-- {
+		err = destroyAddon(ctx, run, project, addons[i])
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, env := range environments {
+		err = destroyEnvironmentSteps(ctx, run, project, skeleton, env)
+		if err != nil {
+			return err
+		}
+	}
+
+	var steps []skeletonStep
+	for _, s := range skeleton.Destroy.Steps {
+		s := s
+		steps = append(steps, skeletonStep{
+			Name: s.Name, Handler: s.Handler, When: s.When, ForEach: s.ForEach, DependsOn: s.DependsOn,
+			run: func(ctx context.Context) error {
+				return processDestroySteps(ctx, s, project, common.Environment{})
+			},
+		})
+	}
+
+	return runSteps(ctx, run, project.Data, steps, true)
+}
+
 func createNewProject(w http.ResponseWriter, r *http.Request) {
 
 	var projectRequest ProjectCreateRequest
@@ -144,12 +436,17 @@ func createNewProject(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	projectType, ok := ProjectTypes[projectRequest.Type]
+	projectType, ok := lookupProjectType(projectRequest.Type)
 	if !ok {
 		http.Error(w, "Project Type Not Found", http.StatusNotFound)
 		return
 	}
 
+	if projectType.Addon {
+		http.Error(w, "Add-on types are applied to existing projects", http.StatusBadRequest)
+		return
+	}
+
 	var project Project
 
 	id := uuid.New()
@@ -158,44 +455,67 @@ func createNewProject(w http.ResponseWriter, r *http.Request) {
 	project.Type = projectRequest.Type
 	project.Desc = projectRequest.Desc
 	project.Data = projectRequest.Data
+	if project.Data == nil {
+		project.Data = make(common.Data)
+	}
+	project.Owners = projectRequest.Owners
+	project.Labels = projectRequest.Labels
+	project.CreatedAt = time.Now()
+	project.UpdatedAt = project.CreatedAt
+
+	runsLock.Lock()
+	run := addRun(&project, "generate")
+	project.LastRun = run.Id
+	Projects[id.String()] = &project
+	runsLock.Unlock()
 
 	go func() {
+		run.finish(generateProject(run, &project, projectType))
+	}()
 
-		skeletonDir := github.DownloadRepo(projectType.Repo)
-		defer os.RemoveAll(skeletonDir)
+	runsLock.Lock()
+	defer runsLock.Unlock()
 
-		//get bones manifest
-		skeletonyaml, err := os.ReadFile(skeletonDir + projectType.Path + "/.skeleton/skeleton.yaml")
-		if err != nil {
-			http.Error(w, "Project configuration not found (skeleton.yaml missing!)", http.StatusFailedDependency)
-			log.Print(err)
-			return
-		}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(project)
+}
 
-		err = yaml.Unmarshal(skeletonyaml, &SkeletonYAML)
-		if err != nil {
-			http.Error(w, "Project configuration not formatted correctly (skeleton.yaml corrupted!)", http.StatusBadRequest)
-			log.Print(err)
-			return
-		}
+// destroyProjectById starts destroying the project. It is forgotten once
+// everything is destroyed; after a failure it is kept, so that the delete
+// can be retried.
+func destroyProjectById(w http.ResponseWriter, id string) {
+	runsLock.Lock()
+	defer runsLock.Unlock()
 
-		//Setting standard values
-		slug := strings.ReplaceAll(strings.ToLower(project.Name), " ", "-")
-		project.Data["APP_NAME"] = slug
-		project.Data["SERVICE_NAME"] = slug + "-service"
+	project, ok := Projects[id]
+	if !ok {
+		http.Error(w, "Project Not Found", http.StatusNotFound)
+		return
+	}
 
-		for _, s := range SkeletonYAML.Generate.Steps {
-			processGenerateSteps(s, &project, projectType)
-		}
+	run := startRun(project, "destroy")
+	if run == nil {
+		http.Error(w, "Project has a run in progress", http.StatusConflict)
+		return
+	}
+	project.LastRun = run.Id
 
+	go func() {
+		err := destroyProject(run, project)
+		if err == nil {
+			runsLock.Lock()
+			delete(Projects, id)
+			runsLock.Unlock()
+		}
+		run.finish(err)
 	}()
 
-	Projects[id.String()] = &project
-
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(project)
 }
 
+// deleteProject is DELETE /project, with the project's Id in the body. It is
+// kept for older clients; DELETE /project/{id} is the same.
 func deleteProject(w http.ResponseWriter, r *http.Request) {
 
 	var projectRequest ProjectDeleteRequest
@@ -205,48 +525,156 @@ func deleteProject(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	project, ok := Projects[projectRequest.Id]
+	destroyProjectById(w, projectRequest.Id)
+}
+
+func deleteSingleProject(w http.ResponseWriter, r *http.Request) {
+	destroyProjectById(w, mux.Vars(r)["id"])
+}
+
+func returnSingleProject(w http.ResponseWriter, r *http.Request) {
+	project, ok := lookupProject(mux.Vars(r)["id"])
 	if !ok {
 		http.Error(w, "Project Not Found", http.StatusNotFound)
 		return
 	}
 
-	go func() {
-		projectDir := github.DownloadRepo(project.Repo)
-		defer os.RemoveAll(projectDir)
+	runsLock.Lock()
+	defer runsLock.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(project)
+}
 
-		//get bones manifest
-		skeletonyaml, err := os.ReadFile(projectDir + "/.skeleton/skeleton.yaml")
+// dataUpdateHandlers are the generate step handlers re-applied when a
+// project's data changes: the ones that render data into the project's
+// configuration and apply it.
+var dataUpdateHandlers = map[string]bool{
+	"approval": true,
+	"aws":      true,
+	"circleci": true,
+}
+
+// updateProjectData re-applies the generate steps affected by a change of the
+// project's data, from the skeleton commit the project was generated from.
+func updateProjectData(run *Run, project *Project, projectType ProjectType, skeleton SkeletonYaml) error {
+	ctx := pinProjectSkeleton(projectContext(project, run), project, projectType)
+
+	var steps []skeletonStep
+	for _, s := range skeleton.Generate.Steps {
+		s := s
+		steps = append(steps, skeletonStep{
+			Name: s.Name, Handler: s.Handler, When: s.When, ForEach: s.ForEach, DependsOn: s.DependsOn,
+			leftOut: !dataUpdateHandlers[s.Handler],
+			run: func(ctx context.Context) error {
+				return processGenerateSteps(ctx, s, project, projectType)
+			},
+		})
+	}
+
+	err := runSteps(ctx, run, project.Data, steps, false)
+	keepOutputs(ctx, project)
+
+	return err
+}
+
+// updateProject changes a project's description, owners or data. A change of
+// data is checked against the skeleton's inputs and starts an update run.
+func updateProject(w http.ResponseWriter, r *http.Request) {
+	project, ok := lookupProject(mux.Vars(r)["id"])
+	if !ok {
+		http.Error(w, "Project Not Found", http.StatusNotFound)
+		return
+	}
+
+	var projectRequest ProjectUpdateRequest
+	err := json.NewDecoder(r.Body).Decode(&projectRequest)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var data common.Data
+	var skeleton SkeletonYaml
+	var projectType ProjectType
+
+	if len(projectRequest.Data) > 0 {
+		projectType, ok = lookupProjectType(project.Type)
+		if !ok {
+			http.Error(w, "Project Type Not Found", http.StatusNotFound)
+			return
+		}
+
+		skeleton, err = projectSkeleton(project, projectType)
 		if err != nil {
-			http.Error(w, "Project configuration not found (skeleton.yaml missing!)", http.StatusFailedDependency)
-			log.Print(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		err = yaml.Unmarshal(skeletonyaml, &SkeletonYAML)
+		runsLock.Lock()
+		data = make(common.Data)
+		for key, value := range project.Data {
+			data[key] = value
+		}
+		runsLock.Unlock()
+
+		for key, value := range projectRequest.Data {
+			if value == nil {
+				delete(data, key)
+			} else {
+				data[key] = value
+			}
+		}
+
+		err = common.ApplyInputs(skeleton.Inputs, data)
 		if err != nil {
-			http.Error(w, "Project configuration not formatted correctly (skeleton.yaml corrupted!)", http.StatusBadRequest)
-			log.Print(err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
+	}
 
-		for _, s := range SkeletonYAML.Destroy.Steps {
-			processDestroySteps(s, project)
+	runsLock.Lock()
+
+	// The data only changes together with the run that applies it.
+	var run *Run
+	if data != nil {
+		run = startRun(project, "update")
+		if run == nil {
+			runsLock.Unlock()
+			http.Error(w, "Project has a run in progress", http.StatusConflict)
+			return
 		}
+		project.LastRun = run.Id
+	}
 
-	}()
+	if projectRequest.Desc != nil {
+		project.Desc = *projectRequest.Desc
+	}
+	if projectRequest.Owners != nil {
+		project.Owners = *projectRequest.Owners
+	}
+	if projectRequest.Labels != nil {
+		project.Labels = *projectRequest.Labels
+	}
+	if data != nil {
+		project.Data = data
+	}
+	project.UpdatedAt = time.Now()
+	runsLock.Unlock()
+
+	if run != nil {
+		go func() {
+			run.finish(updateProjectData(run, project, projectType, skeleton))
+		}()
+	}
 
-	delete(Projects, projectRequest.Id)
+	runsLock.Lock()
+	defer runsLock.Unlock()
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(project)
 }
 
-func returnAllProjectTypes(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(ProjectTypes)
-}
-
 func returnHealth(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode("Alive")
@@ -262,18 +690,31 @@ func createNewProjectType(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	err = projectTypeRequest.Terraform.Validate()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	projectType.Name = projectTypeRequest.Name
 	projectType.Desc = projectTypeRequest.Desc
 	projectType.Repo = projectTypeRequest.Repo
 	projectType.Path = projectTypeRequest.Path
+	projectType.Addon = projectTypeRequest.Addon
+	projectType.Terraform = projectTypeRequest.Terraform
+	projectType.CreatedAt = time.Now()
 	projectType.Slug = strings.ReplaceAll(strings.ToLower(projectType.Name), " ", "-")
 
+	projectTypesLock.Lock()
 	ProjectTypes[projectType.Slug] = projectType
+	projectTypesLock.Unlock()
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(projectType)
 }
 
+// deleteProjectType is DELETE /type, with the type's slug in the body. It is
+// kept for older clients; DELETE /v1/type/{slug} is the same.
 func deleteProjectType(w http.ResponseWriter, r *http.Request) {
 
 	var projectTypeRequest ProjectTypeDeleteRequest
@@ -283,30 +724,65 @@ func deleteProjectType(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	projectType, ok := ProjectTypes[projectTypeRequest.Slug]
+	deleteProjectTypeBySlug(w, projectTypeRequest.Slug)
+}
+
+func deleteSingleProjectType(w http.ResponseWriter, r *http.Request) {
+	deleteProjectTypeBySlug(w, mux.Vars(r)["slug"])
+}
+
+func deleteProjectTypeBySlug(w http.ResponseWriter, slug string) {
+	projectTypesLock.Lock()
+	projectType, ok := ProjectTypes[slug]
+	delete(ProjectTypes, slug)
+	projectTypesLock.Unlock()
+
 	if !ok {
 		http.Error(w, "Project Type Not Found", http.StatusNotFound)
 		return
 	}
 
-	delete(ProjectTypes, projectTypeRequest.Slug)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(projectType)
+}
+
+func returnSingleProjectType(w http.ResponseWriter, r *http.Request) {
+	projectType, ok := lookupProjectType(mux.Vars(r)["slug"])
+	if !ok {
+		http.Error(w, "Project Type Not Found", http.StatusNotFound)
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(projectType)
 }
 
-func handleRequests() {
+// returnProjectTypeInputs returns the inputs of the skeleton at the head of
+// the type's repo, for clients that ask for a new project's data.
+func returnProjectTypeInputs(w http.ResponseWriter, r *http.Request) {
+	projectType, ok := lookupProjectType(mux.Vars(r)["slug"])
+	if !ok {
+		http.Error(w, "Project Type Not Found", http.StatusNotFound)
+		return
+	}
+
+	skeleton, err := projectSkeleton(&Project{Type: projectType.Slug}, projectType)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
-	myRouter := mux.NewRouter().StrictSlash(true)
+	inputs := skeleton.Inputs
+	if inputs == nil {
+		inputs = []common.Input{}
+	}
 
-	myRouter.HandleFunc("/", returnHealth)
-	myRouter.HandleFunc("/project", returnAllProjects).Methods("GET")
-	myRouter.HandleFunc("/project", createNewProject).Methods("POST")
-	myRouter.HandleFunc("/project", deleteProject).Methods("DELETE")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(inputs)
+}
 
-	myRouter.HandleFunc("/type", returnAllProjectTypes).Methods("GET")
-	myRouter.HandleFunc("/type", createNewProjectType).Methods("POST")
-	myRouter.HandleFunc("/type", deleteProjectType).Methods("DELETE")
+func handleRequests() {
+	myRouter := newRouter()
 
 	fmt.Println("Now online and ready")
 	log.Fatal(http.ListenAndServe(":8080", myRouter))
@@ -326,5 +802,8 @@ func main() {
 		os.Exit(0)
 	}
 
+	common.ConfigurePluginCache()
+	scheduleDriftDetection(driftInterval())
+
 	handleRequests()
 }
@@ -2,11 +2,27 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/bones/server/common"
+	aws "github.com/bones/server/handlers/aws"
+	github "github.com/bones/server/handlers/github"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/gorilla/mux"
+	tfjson "github.com/hashicorp/terraform-json"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestHealthCheck(t *testing.T) {
@@ -31,6 +47,8 @@ func TestHealthCheck(t *testing.T) {
 
 func TestCreateNewTypeHappy(t *testing.T) {
 
+	resetState(t)
+
 	var projectTypeCreateRequest ProjectTypeCreateRequest
 	projectTypeCreateRequest.Name = "go-app"
 
@@ -57,6 +75,8 @@ func TestCreateNewTypeHappy(t *testing.T) {
 
 func TestCreateNewTypeEmpty(t *testing.T) {
 
+	resetState(t)
+
 	req := httptest.NewRequest(http.MethodPost, "/", nil)
 	w := httptest.NewRecorder()
 	createNewProjectType(w, req)
@@ -71,6 +91,8 @@ func TestCreateNewTypeEmpty(t *testing.T) {
 
 func TestCreateNewTypeMalformed(t *testing.T) {
 
+	resetState(t)
+
 	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("garbage"))
 	w := httptest.NewRecorder()
 	createNewProjectType(w, req)
@@ -83,8 +105,62 @@ func TestCreateNewTypeMalformed(t *testing.T) {
 	}
 }
 
+func TestCreateNewTypeUnknownTool(t *testing.T) {
+
+	resetState(t)
+
+	var projectTypeCreateRequest ProjectTypeCreateRequest
+	projectTypeCreateRequest.Name = "tool-app"
+	projectTypeCreateRequest.Terraform.Tool = "terragrunt"
+
+	buf := new(bytes.Buffer)
+	json.NewEncoder(buf).Encode(projectTypeCreateRequest)
+
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(buf.String()))
+	w := httptest.NewRecorder()
+	createNewProjectType(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected bad status code got %v", res.StatusCode)
+	}
+	if _, ok := ProjectTypes["tool-app"]; ok {
+		t.Errorf("expected the type not to be created")
+	}
+}
+
+func TestProjectTypesConcurrentAccess(t *testing.T) {
+
+	resetState(t)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+
+			req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(fmt.Sprintf(`{"name": "concurrent-%d"}`, i)))
+			createNewProjectType(httptest.NewRecorder(), req)
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+
+			lookupProjectType(fmt.Sprintf("concurrent-%d", i))
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 0; i < 8; i++ {
+		deleteProjectTypeBySlug(httptest.NewRecorder(), fmt.Sprintf("concurrent-%d", i))
+	}
+}
+
 func TestCreateNewProjectEmpty(t *testing.T) {
 
+	resetState(t)
+
 	req := httptest.NewRequest(http.MethodPost, "/", nil)
 	w := httptest.NewRecorder()
 	createNewProject(w, req)
@@ -99,6 +175,8 @@ func TestCreateNewProjectEmpty(t *testing.T) {
 
 func TestCreateNewProjectMalformed(t *testing.T) {
 
+	resetState(t)
+
 	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("garbage"))
 	w := httptest.NewRecorder()
 	createNewProject(w, req)
@@ -110,3 +188,1198 @@ func TestCreateNewProjectMalformed(t *testing.T) {
 		t.Errorf("expected bad status code got %v", res.StatusCode)
 	}
 }
+
+func TestApproveUnknownRun(t *testing.T) {
+
+	resetState(t)
+
+	req := httptest.NewRequest(http.MethodPost, "/", nil)
+	req = mux.SetURLVars(req, map[string]string{"id": "missing", "run": "missing"})
+	w := httptest.NewRecorder()
+	approveProjectRun(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("expected not found status code got %v", res.StatusCode)
+	}
+}
+
+func TestApproveRunNotAwaitingApproval(t *testing.T) {
+
+	resetState(t)
+
+	run := newRun(&Project{Id: "project"}, "generate")
+
+	req := httptest.NewRequest(http.MethodPost, "/", nil)
+	req = mux.SetURLVars(req, map[string]string{"id": "project", "run": run.Id})
+	w := httptest.NewRecorder()
+	approveProjectRun(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusConflict {
+		t.Errorf("expected conflict status code got %v", res.StatusCode)
+	}
+}
+
+func TestApprovalGate(t *testing.T) {
+
+	resetState(t)
+
+	for _, approved := range []bool{true, false} {
+		run := newRun(&Project{Id: "project"}, "generate")
+		result := make(chan error)
+		go func() {
+			result <- run.runStep(run.ctx, "AWS", "aws", true, func(ctx context.Context) error {
+				return run.AwaitApproval(ctx, "app/infra/aws-ecs", &tfjson.Plan{})
+			})
+		}()
+
+		for {
+			runsLock.Lock()
+			status := run.Status
+			runsLock.Unlock()
+			if status == RunAwaitingApproval {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+
+		req := httptest.NewRequest(http.MethodPost, "/", nil)
+		req = mux.SetURLVars(req, map[string]string{"id": "project", "run": run.Id})
+		w := httptest.NewRecorder()
+		if approved {
+			approveProjectRun(w, req)
+		} else {
+			rejectProjectRun(w, req)
+		}
+
+		if w.Result().StatusCode != http.StatusOK {
+			t.Errorf("expected ok status code got %v", w.Result().StatusCode)
+		}
+
+		err := <-result
+		if approved && err != nil {
+			t.Errorf("expected error to be nil got %v", err)
+		}
+		if !approved && !errors.Is(err, errPlanRejected) {
+			t.Errorf("expected plan rejected got %v", err)
+		}
+	}
+}
+
+func TestApprovalHidesPlanVariables(t *testing.T) {
+
+	resetState(t)
+
+	project := &Project{Id: "secret-project"}
+	Projects["secret-project"] = project
+	defer delete(Projects, "secret-project")
+
+	run := newRun(project, "generate")
+	plan := &tfjson.Plan{
+		Variables:       map[string]*tfjson.PlanVariable{"aws_secret_key": {Value: "s3cr3t"}},
+		ResourceChanges: []*tfjson.ResourceChange{{Address: "aws_ecs_service.app", Change: &tfjson.Change{Actions: tfjson.Actions{tfjson.ActionCreate}}}},
+	}
+	result := make(chan error)
+	go func() {
+		result <- run.runStep(run.ctx, "AWS", "aws", true, func(ctx context.Context) error {
+			return run.AwaitApproval(ctx, "app/infra/aws-ecs", plan)
+		})
+	}()
+
+	for {
+		runsLock.Lock()
+		status := run.Status
+		runsLock.Unlock()
+		if status == RunAwaitingApproval {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req = mux.SetURLVars(req, map[string]string{"id": "secret-project", "run": run.Id})
+	w := httptest.NewRecorder()
+	returnProjectRun(w, req)
+
+	body := w.Body.String()
+	if strings.Contains(body, "s3cr3t") {
+		t.Errorf("expected the plan variables to be left out got %s", body)
+	}
+	if !strings.Contains(body, "aws_ecs_service.app") {
+		t.Errorf("expected the planned changes got %s", body)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/", nil)
+	req = mux.SetURLVars(req, map[string]string{"id": "secret-project", "run": run.Id})
+	rejectProjectRun(httptest.NewRecorder(), req)
+	<-result
+}
+
+func TestAppliedRecordsGating(t *testing.T) {
+
+	resetState(t)
+
+	project := &Project{Id: "gated-project"}
+	run := newRun(project, "generate")
+
+	for _, gated := range []bool{true, false} {
+		run.runStep(run.ctx, "AWS", "aws", gated, func(ctx context.Context) error {
+			run.Applied(ctx, "app/infra/aws-ecs", nil)
+			return nil
+		})
+
+		runsLock.Lock()
+		if len(project.States) != 1 || project.States[0].Gated != gated {
+			t.Errorf("expected one state gated %v got %+v", gated, project.States)
+		}
+		runsLock.Unlock()
+	}
+	run.finish(nil)
+}
+
+func TestUngatedRunDoesNotWait(t *testing.T) {
+
+	resetState(t)
+
+	run := newRun(&Project{Id: "project"}, "generate")
+	err := run.runStep(run.ctx, "AWS", "aws", false, func(ctx context.Context) error {
+		return run.AwaitApproval(ctx, "app/infra/aws-ecs", &tfjson.Plan{})
+	})
+	if err != nil {
+		t.Errorf("expected error to be nil got %v", err)
+	}
+}
+
+func TestProjectDriftNotChecked(t *testing.T) {
+
+	resetState(t)
+
+	Projects["drift-project"] = &Project{Id: "drift-project"}
+	defer delete(Projects, "drift-project")
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req = mux.SetURLVars(req, map[string]string{"id": "drift-project"})
+	w := httptest.NewRecorder()
+	returnProjectDrift(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+
+	var drift ProjectDrift
+	err := json.NewDecoder(res.Body).Decode(&drift)
+	if err != nil {
+		t.Errorf("expected error to be nil got %v", err)
+	}
+
+	if drift.Drifted || len(drift.States) != 0 {
+		t.Errorf("expected no drift got %v", drift)
+	}
+}
+
+func TestReconcileWithoutDrift(t *testing.T) {
+
+	resetState(t)
+
+	Projects["drift-project"] = &Project{Id: "drift-project"}
+	defer delete(Projects, "drift-project")
+
+	req := httptest.NewRequest(http.MethodPost, "/", nil)
+	req = mux.SetURLVars(req, map[string]string{"id": "drift-project"})
+	w := httptest.NewRecorder()
+	reconcileProjectDrift(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusConflict {
+		t.Errorf("expected conflict status code got %v", res.StatusCode)
+	}
+}
+
+func TestAppliedReplacesInventory(t *testing.T) {
+
+	resetState(t)
+
+	project := &Project{Id: "inventory-project"}
+	run := newRun(project, "generate")
+	run.runStep(run.ctx, "AWS", "aws", false, func(ctx context.Context) error {
+		run.Applied(ctx, "app/infra/aws-ecs", []common.Resource{
+			{StateKey: "app/infra/aws-ecs", Address: "aws_ecs_service.app", Type: "aws_ecs_service"},
+			{StateKey: "app/infra/aws-ecs", Address: "aws_lb.app", Type: "aws_lb"},
+		})
+		run.Applied(ctx, "app/infra/aws-ecs", []common.Resource{
+			{StateKey: "app/infra/aws-ecs", Address: "aws_ecs_service.app", Type: "aws_ecs_service"},
+		})
+		return nil
+	})
+
+	if len(project.Resources) != 1 {
+		t.Errorf("expected 1 resource got %v", len(project.Resources))
+	}
+
+	if len(project.States) != 1 || project.States[0].Handler != "aws" {
+		t.Errorf("expected 1 aws state got %v", project.States)
+	}
+}
+
+func TestSearchResources(t *testing.T) {
+
+	resetState(t)
+
+	Projects["inventory-project"] = &Project{Id: "inventory-project", Resources: []common.Resource{
+		{Address: "aws_ecs_service.app", Type: "aws_ecs_service", Arn: "arn:aws:ecs:service/app"},
+		{Address: "aws_lb.app", Type: "aws_lb"},
+	}}
+	defer delete(Projects, "inventory-project")
+
+	req := httptest.NewRequest(http.MethodGet, "/resources?id=arn:aws:ecs:service/app", nil)
+	w := httptest.NewRecorder()
+	searchResources(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+
+	var resources []ProjectResource
+	err := json.NewDecoder(res.Body).Decode(&resources)
+	if err != nil {
+		t.Errorf("expected error to be nil got %v", err)
+	}
+
+	if len(resources) != 1 || resources[0].Project != "inventory-project" || resources[0].Type != "aws_ecs_service" {
+		t.Errorf("expected the ecs service got %v", resources)
+	}
+}
+
+func TestCreateEnvironmentInvalidName(t *testing.T) {
+
+	resetState(t)
+
+	Projects["env-project"] = &Project{Id: "env-project"}
+	defer delete(Projects, "env-project")
+
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"name": "Prod Env"}`))
+	req = mux.SetURLVars(req, map[string]string{"id": "env-project"})
+	w := httptest.NewRecorder()
+	createProjectEnvironment(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected bad status code got %v", res.StatusCode)
+	}
+}
+
+func TestCreateEnvironmentFailureForgetsEnvironment(t *testing.T) {
+
+	resetState(t)
+
+	t.Setenv("GITHUB", "{}")
+
+	// The project repo has no infra/aws-ecs for its aws step to apply.
+	project := &Project{
+		Id:   "failed-env-project",
+		Repo: skeletonRepo(t, map[string]string{".skeleton/skeleton.yaml": "generate:\n  steps:\n    - name: AWS\n      handler: aws\n"}),
+		Data: common.Data{},
+	}
+	Projects[project.Id] = project
+
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"name": "staging"}`))
+		req = mux.SetURLVars(req, map[string]string{"id": project.Id})
+		w := httptest.NewRecorder()
+		createProjectEnvironment(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected OK creating the environment again got %v", w.Code)
+		}
+		waitForRuns(t)
+	}
+
+	runsLock.Lock()
+	defer runsLock.Unlock()
+
+	for _, run := range Runs {
+		if run.Status != RunFailed {
+			t.Errorf("expected the runs to fail got %v", run.Status)
+		}
+	}
+	if _, ok := project.Environments["staging"]; ok {
+		t.Errorf("expected the failed environment to be forgotten")
+	}
+}
+
+func TestDestroyedForgetsEnvironmentState(t *testing.T) {
+
+	resetState(t)
+
+	project := &Project{Id: "env-project"}
+	run := newRun(project, "create-environment")
+	run.environment = "staging"
+
+	key := common.Environment{Name: "staging"}.StateKey("app", "infra/aws-ecs")
+	if key != "app/staging/infra/aws-ecs" {
+		t.Errorf("expected app/staging/infra/aws-ecs got %v", key)
+	}
+
+	run.runStep(run.ctx, "AWS", "aws", false, func(ctx context.Context) error {
+		run.Applied(ctx, key, []common.Resource{{StateKey: key, Address: "aws_lb.app"}})
+		return nil
+	})
+	if len(project.States) != 1 || project.States[0].Environment != "staging" {
+		t.Errorf("expected 1 staging state got %v", project.States)
+	}
+
+	run.Destroyed(key)
+	if len(project.States) != 0 || len(project.Resources) != 0 {
+		t.Errorf("expected no state left got %v %v", project.States, project.Resources)
+	}
+}
+
+func TestCancelRunAwaitingApproval(t *testing.T) {
+
+	resetState(t)
+
+	run := newRun(&Project{Id: "project"}, "generate")
+	result := make(chan error)
+	go func() {
+		result <- run.runStep(run.ctx, "AWS", "aws", true, func(ctx context.Context) error {
+			return run.AwaitApproval(ctx, "app/infra/aws-ecs", &tfjson.Plan{})
+		})
+	}()
+
+	req := httptest.NewRequest(http.MethodPost, "/", nil)
+	req = mux.SetURLVars(req, map[string]string{"id": "project", "run": run.Id})
+	w := httptest.NewRecorder()
+	cancelProjectRun(w, req)
+
+	if w.Result().StatusCode != http.StatusOK {
+		t.Errorf("expected ok status code got %v", w.Result().StatusCode)
+	}
+
+	err := <-result
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context canceled got %v", err)
+	}
+
+	run.finish(err)
+	if run.Status != RunCancelled {
+		t.Errorf("expected cancelled got %v", run.Status)
+	}
+}
+
+func TestRunLogFromOffset(t *testing.T) {
+
+	resetState(t)
+
+	run := newRun(&Project{Id: "project"}, "generate")
+	run.Log().Write([]byte("terraform init\nterraform plan\n"))
+
+	req := httptest.NewRequest(http.MethodGet, "/?offset=15", nil)
+	req = mux.SetURLVars(req, map[string]string{"id": "project", "run": run.Id})
+	w := httptest.NewRecorder()
+	returnProjectRunLog(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+
+	body := new(bytes.Buffer)
+	body.ReadFrom(res.Body)
+
+	if body.String() != "terraform plan\n" {
+		t.Errorf("expected terraform plan got %q", body.String())
+	}
+
+	if res.Header.Get("X-Run-Status") != string(RunRunning) {
+		t.Errorf("expected running got %v", res.Header.Get("X-Run-Status"))
+	}
+}
+
+func TestMetrics(t *testing.T) {
+
+	hits, misses := github.CacheStats()
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	w := httptest.NewRecorder()
+	returnMetrics(w, req)
+
+	res := w.Result()
+	defer res.Body.Close()
+
+	body := new(bytes.Buffer)
+	body.ReadFrom(res.Body)
+
+	for _, metric := range []string{fmt.Sprintf("bones_skeleton_cache_hits_total %d", hits), fmt.Sprintf("bones_skeleton_cache_misses_total %d", misses), "bones_plugin_cache_providers"} {
+		if !strings.Contains(body.String(), metric) {
+			t.Errorf("expected %s in %q", metric, body.String())
+		}
+	}
+}
+
+func TestRunStepsDuplicateEachKeys(t *testing.T) {
+
+	resetState(t)
+
+	project := &Project{Id: "project", Data: common.Data{"REGIONS": []interface{}{"us east", "us-east"}}}
+	run := newRun(project, "generate")
+
+	ran := false
+	steps := []skeletonStep{
+		{Name: "repo", Handler: "test", run: func(ctx context.Context) error {
+			ran = true
+			return nil
+		}},
+		{Name: "infra", Handler: "test", ForEach: "REGIONS", run: func(ctx context.Context) error { return nil }},
+	}
+
+	err := runSteps(run.ctx, run, project.Data, steps, false)
+	if err == nil || !strings.Contains(err.Error(), "both named us-east") {
+		t.Errorf("expected duplicate keys to be an error got %v", err)
+	}
+	if ran {
+		t.Errorf("expected no step to run")
+	}
+}
+
+func TestProjectStateEach(t *testing.T) {
+
+	resetState(t)
+
+	project := &Project{Id: "project"}
+	run := newRun(project, "generate")
+
+	item := map[string]interface{}{"region": "eu-west-1", "replicas": float64(2)}
+	ctx := common.WithEach(run.ctx, common.Each{Key: "1", Value: item, Index: 1})
+	run.Applied(ctx, "app/infra/aws-ecs/1", nil)
+
+	buf := new(bytes.Buffer)
+	json.NewEncoder(buf).Encode(project.States)
+
+	var states []ProjectState
+	json.NewDecoder(buf).Decode(&states)
+	if len(states) != 1 {
+		t.Fatalf("expected 1 state got %v", states)
+	}
+
+	each, ok := common.EachFromContext(states[0].context(context.Background()))
+	if !ok || each.Key != "1" || each.Index != 1 || !reflect.DeepEqual(each.Value, item) {
+		t.Errorf("expected the item to be restored got %+v", each)
+	}
+}
+
+func TestRenderFilesForEach(t *testing.T) {
+
+	dir := t.TempDir()
+	os.MkdirAll(dir+"/infra/aws-ecs", 0755)
+	os.WriteFile(dir+"/infra/aws-ecs/main.tf", []byte("# {{ .each.value }}\n"), 0644)
+
+	for _, region := range []string{"us-east-1", "eu-west-1"} {
+		ctx := common.WithEach(context.Background(), common.Each{Key: region, Value: region})
+		files, err := aws.RenderFiles(ctx, dir, common.Data{})
+		if err != nil {
+			t.Fatalf("expected error to be nil got %v", err)
+		}
+
+		if len(files) != 1 || files[0].Path != "infra/aws-ecs/"+region || string(files[0].Data) != "# "+region+"\n" {
+			t.Errorf("expected %s under its own directory got %+v", region, files)
+		}
+
+		// RenderFiles renders in place.
+		os.WriteFile(dir+"/infra/aws-ecs/main.tf", []byte("# {{ .each.value }}\n"), 0644)
+	}
+}
+
+func TestRunSkeletonStepWhenAndForEach(t *testing.T) {
+
+	resetState(t)
+
+	project := &Project{Id: "project", Data: common.Data{"REGIONS": []interface{}{"us-east-1", "eu-west-1"}}}
+	run := newRun(project, "generate")
+
+	var keys []string
+	step := skeletonStep{
+		Name:    "infra",
+		Handler: "aws",
+		When:    `{{ ne .each.value "eu-west-1" }}`,
+		ForEach: "REGIONS",
+		run: func(ctx context.Context) error {
+			each, _ := common.EachFromContext(ctx)
+			keys = append(keys, each.Key)
+			return nil
+		},
+	}
+
+	err := runSkeletonStep(run.ctx, run, project.Data, step, false)
+	if err != nil {
+		t.Errorf("expected error to be nil got %v", err)
+	}
+
+	if strings.Join(keys, ",") != "us-east-1" {
+		t.Errorf("expected us-east-1 got %v", keys)
+	}
+
+	if len(run.Steps) != 2 {
+		t.Fatalf("expected 2 steps got %v", len(run.Steps))
+	}
+
+	if run.Steps[0].Name != "infra [us-east-1]" || run.Steps[1].Status != RunSkipped {
+		t.Errorf("expected a succeeded and a skipped step got %+v %+v", run.Steps[0], run.Steps[1])
+	}
+}
+
+func TestRunStepsDependencies(t *testing.T) {
+
+	resetState(t)
+
+	project := &Project{Id: "project"}
+	run := newRun(project, "generate")
+
+	var order []string
+	var orderLock sync.Mutex
+	step := func(name string, dependsOn ...string) skeletonStep {
+		return skeletonStep{Name: name, Handler: "test", DependsOn: dependsOn, run: func(ctx context.Context) error {
+			orderLock.Lock()
+			order = append(order, name)
+			orderLock.Unlock()
+			return nil
+		}}
+	}
+
+	// repo first, then aws and circleci in parallel, then deploy.
+	steps := []skeletonStep{step("repo"), step("aws", "repo"), step("circleci", "repo"), step("deploy", "aws", "circleci")}
+
+	err := runSteps(run.ctx, run, project.Data, steps, false)
+	if err != nil {
+		t.Errorf("expected error to be nil got %v", err)
+	}
+	if len(order) != 4 || order[0] != "repo" || order[3] != "deploy" {
+		t.Errorf("expected repo first and deploy last got %v", order)
+	}
+
+	// Destroy reverses the dependencies.
+	order = nil
+	err = runSteps(run.ctx, run, project.Data, steps, true)
+	if err != nil {
+		t.Errorf("expected error to be nil got %v", err)
+	}
+	if len(order) != 4 || order[0] != "deploy" || order[3] != "repo" {
+		t.Errorf("expected deploy first and repo last got %v", order)
+	}
+
+	// Without depends_on, destroy runs the steps in reverse order.
+	order = nil
+	err = runSteps(run.ctx, run, project.Data, []skeletonStep{step("repo"), step("aws"), step("circleci")}, true)
+	if err != nil {
+		t.Errorf("expected error to be nil got %v", err)
+	}
+	if strings.Join(order, ",") != "circleci,aws,repo" {
+		t.Errorf("expected circleci,aws,repo got %v", order)
+	}
+
+	_, err = stepDependencies([]skeletonStep{step("a", "b"), step("b", "a")}, false)
+	if err == nil {
+		t.Errorf("expected an error for a dependency cycle")
+	}
+}
+
+func TestStartRunOnePerProject(t *testing.T) {
+
+	resetState(t)
+
+	project := &Project{Id: "busy"}
+
+	var started int32
+	var wg sync.WaitGroup
+	runs := make(chan *Run, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			runsLock.Lock()
+			run := startRun(project, "update")
+			runsLock.Unlock()
+
+			if run != nil {
+				atomic.AddInt32(&started, 1)
+				runs <- run
+			}
+		}()
+	}
+	wg.Wait()
+
+	if started != 1 {
+		t.Fatalf("expected 1 run to start got %d", started)
+	}
+	run := <-runs
+
+	// A project with a run in progress isn't destroyed either.
+	runsLock.Lock()
+	Projects[project.Id] = project
+	runsLock.Unlock()
+
+	w := httptest.NewRecorder()
+	destroyProjectById(w, project.Id)
+	if w.Code != http.StatusConflict {
+		t.Errorf("expected conflict got %v", w.Code)
+	}
+
+	run.finish(nil)
+
+	runsLock.Lock()
+	_, ok := Projects[project.Id]
+	delete(Projects, project.Id)
+	runsLock.Unlock()
+
+	if !ok {
+		t.Errorf("expected the project to be kept")
+	}
+}
+
+func TestDestroyUnmergedAddon(t *testing.T) {
+
+	resetState(t)
+
+	t.Setenv("GITHUB", "{}")
+	t.Setenv("AWS", "{}")
+	t.Setenv("TERRAFORM_PATH", "/nonexistent")
+
+	skeleton := skeletonRepo(t, map[string]string{
+		"redis/infra/aws-ecs/main.tf": "variable \"CACHE_SIZE\" {}\n# {{ .CACHE_SIZE }}\n",
+	})
+	sha, err := github.ResolveHead(skeleton)
+	if err != nil {
+		t.Fatalf("expected error to be nil got %v", err)
+	}
+
+	ProjectTypes["unmerged-redis"] = ProjectType{Slug: "unmerged-redis", Name: "Redis", Repo: skeleton, Path: "/redis", Addon: true}
+	defer delete(ProjectTypes, "unmerged-redis")
+
+	// The add-on's pull request was never merged: the project repo doesn't
+	// have its configuration.
+	project := &Project{
+		Id:     "unmerged-addon",
+		Name:   "Shop",
+		Repo:   skeletonRepo(t, map[string]string{"README.md": "# Shop\n"}),
+		Data:   common.Data{},
+		States: []ProjectState{{Handler: "aws", Key: "shop/addons/unmerged-redis/infra/aws-ecs", Addon: "unmerged-redis"}},
+		Addons: []*ProjectAddon{{Type: "unmerged-redis", Data: common.Data{"CACHE_SIZE": 2}, SkeletonRef: sha}},
+	}
+
+	run := newRun(project, "remove-addon")
+	err = destroyAddon(run.ctx, run, project, "unmerged-redis")
+	run.finish(err)
+
+	// The configuration is rendered from the add-on skeleton, and only
+	// Terraform, which can't run here, is missing.
+	if err == nil || !strings.Contains(err.Error(), "/nonexistent") {
+		t.Errorf("expected the destroy to get as far as Terraform got %v", err)
+	}
+}
+
+func TestDestroyProjectEnvironments(t *testing.T) {
+
+	resetState(t)
+
+	t.Setenv("GITHUB", "{}")
+
+	repo := skeletonRepo(t, map[string]string{".skeleton/skeleton.yaml": "destroy:\n  steps:\n    - name: sign-off\n      handler: approval\n"})
+
+	project := &Project{
+		Id:           "destroy-environments",
+		Name:         "Destroy",
+		Repo:         repo,
+		Data:         common.Data{},
+		Environments: map[string]*Environment{"staging": {Name: "staging", Vars: map[string]string{}}},
+		Addons:       []*ProjectAddon{{Type: "redis"}},
+	}
+
+	runsLock.Lock()
+	Projects[project.Id] = project
+	runsLock.Unlock()
+
+	w := httptest.NewRecorder()
+	destroyProjectById(w, project.Id)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected OK got %v", w.Code)
+	}
+
+	runsLock.Lock()
+	defer runsLock.Unlock()
+
+	run := Runs[project.LastRun]
+	for i := 0; i < 200 && run.Finished == nil; i++ {
+		runsLock.Unlock()
+		time.Sleep(50 * time.Millisecond)
+		runsLock.Lock()
+	}
+
+	if run.Status != RunSucceeded {
+		t.Errorf("expected the destroy to succeed got %v", run.Status)
+	}
+
+	// The destroy steps run for staging, then for the default environment.
+	if len(run.Steps) != 2 {
+		t.Errorf("expected 2 steps got %+v", run.Steps)
+	}
+	if len(project.Environments) != 0 || len(project.Addons) != 0 {
+		t.Errorf("expected the environments and add-ons to be destroyed got %v %v", project.Environments, project.Addons)
+	}
+	if _, ok := Projects[project.Id]; ok {
+		t.Errorf("expected the project to be forgotten")
+	}
+}
+
+func TestApprovalGated(t *testing.T) {
+
+	steps := []skeletonStep{
+		{Name: "repo"},
+		{Name: "sign-off", Handler: "approval", DependsOn: []string{"repo"}},
+		{Name: "aws", DependsOn: []string{"sign-off"}},
+		{Name: "deploy", DependsOn: []string{"aws"}},
+		{Name: "docs", DependsOn: []string{"repo"}},
+	}
+
+	waits, err := stepDependencies(steps, false)
+	if err != nil {
+		t.Fatalf("expected error to be nil got %v", err)
+	}
+
+	gated := approvalGated(steps, waits)
+	expected := []bool{false, false, true, true, false}
+	for i := range steps {
+		if gated[i] != expected[i] {
+			t.Errorf("%s: expected gated to be %v got %v", steps[i].Name, expected[i], gated[i])
+		}
+	}
+}
+
+func TestRunStepsConcurrencyLimit(t *testing.T) {
+
+	resetState(t)
+
+	t.Setenv("STEP_CONCURRENCY", "2")
+
+	project := &Project{Id: "project"}
+	run := newRun(project, "generate")
+
+	var running, most int32
+	var steps []skeletonStep
+	for _, name := range []string{"a", "b", "c", "d", "e", "f"} {
+		steps = append(steps, skeletonStep{Name: name, Handler: "test", DependsOn: []string{}, run: func(ctx context.Context) error {
+			now := atomic.AddInt32(&running, 1)
+			for {
+				seen := atomic.LoadInt32(&most)
+				if now <= seen || atomic.CompareAndSwapInt32(&most, seen, now) {
+					break
+				}
+			}
+
+			time.Sleep(20 * time.Millisecond)
+			atomic.AddInt32(&running, -1)
+			return nil
+		}})
+	}
+
+	err := runSteps(run.ctx, run, project.Data, steps, false)
+	if err != nil {
+		t.Errorf("expected error to be nil got %v", err)
+	}
+	if most != 2 {
+		t.Errorf("expected at most 2 steps at a time got %d", most)
+	}
+	if len(run.Steps) != 6 {
+		t.Errorf("expected 6 steps got %d", len(run.Steps))
+	}
+}
+
+// skeletonRepo commits files to a new repository in a temp dir.
+// resetState gives the test empty Runs, Projects and ProjectTypes, and
+// cancels the runs it leaves unfinished once it is done, so that tests don't
+// see each other's runs.
+func resetState(t *testing.T) {
+	reset := func() {
+		runsLock.Lock()
+		for _, run := range Runs {
+			if run.Finished == nil {
+				run.cancel()
+			}
+		}
+		Runs = make(map[string]*Run)
+		Projects = make(map[string]*Project)
+		runsLock.Unlock()
+
+		projectTypesLock.Lock()
+		ProjectTypes = make(map[string]ProjectType)
+		projectTypesLock.Unlock()
+	}
+
+	reset()
+	t.Cleanup(reset)
+}
+
+func skeletonRepo(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+
+	r, err := git.PlainInit(dir, false)
+	if err != nil {
+		t.Fatalf("expected error to be nil got %v", err)
+	}
+	w, _ := r.Worktree()
+
+	for name, content := range files {
+		os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755)
+		os.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+		w.Add(name)
+	}
+
+	_, err = w.Commit("Skeleton", &git.CommitOptions{Author: &object.Signature{Name: "test", When: time.Now()}})
+	if err != nil {
+		t.Fatalf("expected error to be nil got %v", err)
+	}
+
+	return dir
+}
+
+func TestCheckoutSkeletonIncludes(t *testing.T) {
+
+	base := skeletonRepo(t, map[string]string{
+		"ecs/.skeleton/skeleton.yaml": `inputs:
+  - name: REPLICAS
+    type: number
+generate:
+  steps:
+    - name: Repo
+      handler: github
+    - name: Infra
+      handler: aws
+`,
+		"ecs/infra/aws-ecs/main.tf": "base",
+		"ecs/README.md":             "base",
+	})
+
+	app := skeletonRepo(t, map[string]string{
+		"go/.skeleton/skeleton.yaml": `include:
+  - repo: ` + base + `
+    path: /ecs
+inputs:
+  - name: GO_VERSION
+generate:
+  steps:
+    - name: Infra
+      handler: aws
+      when: "{{ .data.INFRA }}"
+    - name: CI
+      handler: circleci
+`,
+		"go/README.md": "app",
+		"go/main.go":   "package main",
+	})
+
+	dir, err := github.CheckoutSkeleton(context.Background(), app, "/go")
+	if err != nil {
+		t.Fatalf("expected error to be nil got %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, expected := range map[string]string{"README.md": "app", "main.go": "package main", "infra/aws-ecs/main.tf": "base"} {
+		content, _ := os.ReadFile(filepath.Join(dir, "go", name))
+		if string(content) != expected {
+			t.Errorf("%s: expected %q got %q", name, expected, content)
+		}
+	}
+
+	skeleton, err := readSkeletonYaml(dir + "/go")
+	if err != nil {
+		t.Fatalf("expected error to be nil got %v", err)
+	}
+
+	var steps []string
+	for _, s := range skeleton.Generate.Steps {
+		steps = append(steps, s.Name+":"+s.When)
+	}
+	if strings.Join(steps, ",") != "Repo:,Infra:{{ .data.INFRA }},CI:" {
+		t.Errorf("expected merged steps got %v", steps)
+	}
+
+	if len(skeleton.Inputs) != 2 {
+		t.Errorf("expected 2 inputs got %v", skeleton.Inputs)
+	}
+}
+
+func TestRunProjectActionInputs(t *testing.T) {
+
+	resetState(t)
+
+	repo := skeletonRepo(t, map[string]string{
+		"app/.skeleton/skeleton.yaml": `actions:
+  - name: add-worker
+    inputs:
+      - name: WORKER_NAME
+        required: true
+    steps:
+      - name: Worker code
+        handler: github
+        path: /actions/worker
+`,
+	})
+
+	ProjectTypes["action-type"] = ProjectType{Slug: "action-type", Repo: repo, Path: "/app"}
+	defer delete(ProjectTypes, "action-type")
+	Projects["action-project"] = &Project{Id: "action-project", Type: "action-type", Data: common.Data{}}
+	defer delete(Projects, "action-project")
+
+	for name, expected := range map[string]int{"add-worker": http.StatusBadRequest, "add-queue": http.StatusNotFound} {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"data": {}}`))
+		req = mux.SetURLVars(req, map[string]string{"id": "action-project", "name": name})
+		w := httptest.NewRecorder()
+		runProjectAction(w, req)
+
+		if w.Result().StatusCode != expected {
+			t.Errorf("%s: expected status %v got %v", name, expected, w.Result().StatusCode)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req = mux.SetURLVars(req, map[string]string{"id": "action-project"})
+	w := httptest.NewRecorder()
+	returnProjectActions(w, req)
+
+	var actions []Action
+	json.NewDecoder(w.Result().Body).Decode(&actions)
+	if len(actions) != 1 || actions[0].Name != "add-worker" || !actions[0].Inputs[0].Required {
+		t.Errorf("expected the add-worker action got %v", actions)
+	}
+}
+
+func TestProcessActionStepsRendersInputs(t *testing.T) {
+
+	resetState(t)
+
+	t.Setenv("GITHUB", "{}")
+	t.Setenv("AWS", "{}")
+	// Terraform can't run here: the action's configuration is committed
+	// before it is applied.
+	t.Setenv("TERRAFORM_PATH", "/nonexistent")
+
+	skeleton := skeletonRepo(t, map[string]string{
+		"app/actions/worker/README.md":               "# Worker {{ .WORKER_NAME }}\n",
+		"app/actions/worker/infra/aws-ecs/worker.tf": "variable \"WORKER_NAME\" {}\n# worker {{ .WORKER_NAME }}\n",
+	})
+
+	repo := t.TempDir()
+	_, err := git.PlainClone(repo, true, &git.CloneOptions{URL: skeletonRepo(t, map[string]string{
+		"infra/aws-ecs/main.tf": "variable \"REPLICAS\" {}\n",
+	})})
+	if err != nil {
+		t.Fatalf("expected error to be nil got %v", err)
+	}
+
+	project := &Project{Id: "render-project", Name: "Shop", Repo: repo, Data: common.Data{"REPLICAS": 2}}
+	projectType := ProjectType{Slug: "render-type", Repo: skeleton, Path: "/app"}
+	data := common.Data{"REPLICAS": 2, "WORKER_NAME": "mailer"}
+
+	err = processActionSteps(context.Background(), "add-worker", GenerateStep{Name: "Worker code", Handler: "github", Path: "/actions/worker"}, project, projectType, data)
+	if err != nil {
+		t.Fatalf("expected error to be nil got %v", err)
+	}
+
+	err = processActionSteps(context.Background(), "add-worker", GenerateStep{Name: "Worker infra", Handler: "aws", Path: "/actions/worker"}, project, projectType, data)
+	if err == nil {
+		t.Errorf("expected the apply to fail without terraform")
+	}
+
+	r, err := git.PlainOpen(repo)
+	if err != nil {
+		t.Fatalf("expected error to be nil got %v", err)
+	}
+	head, _ := r.Head()
+	commit, err := r.CommitObject(head.Hash())
+	if err != nil {
+		t.Fatalf("expected error to be nil got %v", err)
+	}
+
+	contents := func(name string) string {
+		file, err := commit.File(name)
+		if err != nil {
+			t.Errorf("expected %s to be committed got %v", name, err)
+			return ""
+		}
+		text, _ := file.Contents()
+		return text
+	}
+
+	if text := contents("README.md"); text != "# Worker mailer\n" {
+		t.Errorf("expected the rendered README got %q", text)
+	}
+	if text := contents("infra/aws-ecs/worker.tf"); !strings.Contains(text, "# worker mailer") {
+		t.Errorf("expected the rendered worker configuration got %q", text)
+	}
+
+	var vars map[string]interface{}
+	json.Unmarshal([]byte(contents("infra/aws-ecs/"+common.DataVarsFile)), &vars)
+	if vars["WORKER_NAME"] != "mailer" || vars["REPLICAS"] != float64(2) {
+		t.Errorf("expected the action and project inputs in the data vars got %v", vars)
+	}
+}
+
+func TestAddonTypes(t *testing.T) {
+
+	resetState(t)
+
+	ProjectTypes["service"] = ProjectType{Slug: "service"}
+	defer delete(ProjectTypes, "service")
+	ProjectTypes["redis"] = ProjectType{Slug: "redis", Addon: true}
+	defer delete(ProjectTypes, "redis")
+	Projects["addon-project"] = &Project{Id: "addon-project", Type: "service"}
+	defer delete(Projects, "addon-project")
+
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"type": "service"}`))
+	req = mux.SetURLVars(req, map[string]string{"id": "addon-project"})
+	w := httptest.NewRecorder()
+	applyProjectAddon(w, req)
+
+	if w.Result().StatusCode != http.StatusBadRequest {
+		t.Errorf("expected bad status code applying a project type got %v", w.Result().StatusCode)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"type": "redis", "name": "cache"}`))
+	w = httptest.NewRecorder()
+	createNewProject(w, req)
+
+	if w.Result().StatusCode != http.StatusBadRequest {
+		t.Errorf("expected bad status code generating an add-on got %v", w.Result().StatusCode)
+	}
+}
+
+func TestUpdateProject(t *testing.T) {
+
+	resetState(t)
+
+	repo := skeletonRepo(t, map[string]string{
+		"app/.skeleton/skeleton.yaml": `inputs:
+  - name: REPLICAS
+    type: number
+`,
+	})
+
+	ProjectTypes["update-type"] = ProjectType{Slug: "update-type", Repo: repo, Path: "/app"}
+	defer delete(ProjectTypes, "update-type")
+	Projects["update-project"] = &Project{Id: "update-project", Type: "update-type", Desc: "old", Data: common.Data{"REPLICAS": 2.0}}
+	defer delete(Projects, "update-project")
+
+	req := httptest.NewRequest(http.MethodPatch, "/", strings.NewReader(`{"desc": "new", "owners": ["team-a"]}`))
+	req = mux.SetURLVars(req, map[string]string{"id": "update-project"})
+	w := httptest.NewRecorder()
+	updateProject(w, req)
+
+	project := Projects["update-project"]
+	if w.Result().StatusCode != http.StatusOK || project.Desc != "new" || len(project.Owners) != 1 || project.LastRun != "" {
+		t.Errorf("expected desc and owners to change without a run got %v %v", w.Result().StatusCode, project)
+	}
+
+	req = httptest.NewRequest(http.MethodPatch, "/", strings.NewReader(`{"data": {"REPLICAS": "many"}}`))
+	req = mux.SetURLVars(req, map[string]string{"id": "update-project"})
+	w = httptest.NewRecorder()
+	updateProject(w, req)
+
+	if w.Result().StatusCode != http.StatusBadRequest || project.Data["REPLICAS"] != 2.0 {
+		t.Errorf("expected invalid data to be refused got %v %v", w.Result().StatusCode, project.Data)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req = mux.SetURLVars(req, map[string]string{"id": "missing"})
+	w = httptest.NewRecorder()
+	returnSingleProject(w, req)
+
+	if w.Result().StatusCode != http.StatusNotFound {
+		t.Errorf("expected not found status code got %v", w.Result().StatusCode)
+	}
+}
+
+func TestListProjectsPaginated(t *testing.T) {
+
+	resetState(t)
+
+	start := time.Now()
+	for i, name := range []string{"api-a", "api-b", "web", "api-c"} {
+		Projects["list-"+name] = &Project{Id: "list-" + name, Name: name, Type: "list-type", CreatedAt: start.Add(time.Duration(i) * time.Second)}
+		defer delete(Projects, "list-"+name)
+	}
+
+	var names []string
+	cursor := ""
+	for page := 0; page < 3; page++ {
+		req := httptest.NewRequest(http.MethodGet, "/project?type=list-type&name=api-&sort=-created&limit=2&cursor="+cursor, nil)
+		w := httptest.NewRecorder()
+		returnAllProjects(w, req)
+
+		var list struct {
+			Items []Project
+			Next  string
+		}
+		json.NewDecoder(w.Result().Body).Decode(&list)
+
+		for _, project := range list.Items {
+			names = append(names, project.Name)
+		}
+
+		cursor = list.Next
+		if cursor == "" {
+			break
+		}
+	}
+
+	if strings.Join(names, ",") != "api-c,api-b,api-a" {
+		t.Errorf("expected api-c,api-b,api-a got %v", names)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/project?sort=size", nil)
+	w := httptest.NewRecorder()
+	returnAllProjects(w, req)
+
+	if w.Result().StatusCode != http.StatusBadRequest {
+		t.Errorf("expected bad status code got %v", w.Result().StatusCode)
+	}
+}
+
+func TestValidateSkeleton(t *testing.T) {
+
+	resetState(t)
+
+	t.Setenv("GITHUB", "{}")
+
+	repo := skeletonRepo(t, map[string]string{
+		"app/.skeleton/skeleton.yaml": "generate:\n  steps:\n    - name: infra\n      handler: aws\n      dependson: [repo]\n",
+		"app/infra/aws-ecs/main.tf":   "# {{ .APP_NAME }}\n",
+	})
+
+	body := fmt.Sprintf(`{"repo": %q, "path": "/app"}`, repo)
+	req := httptest.NewRequest(http.MethodPost, "/v1/type/validate", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	newRouter().ServeHTTP(w, req)
+
+	var validation SkeletonValidation
+	json.NewDecoder(w.Body).Decode(&validation)
+
+	if w.Result().StatusCode != http.StatusOK || validation.Valid || len(validation.Problems) != 1 {
+		t.Fatalf("expected one problem got %v %+v", w.Result().StatusCode, validation)
+	}
+	if p := validation.Problems[0]; p.String() != ".skeleton/skeleton.yaml:5:7: generate.steps[0].dependson: unknown field" {
+		t.Errorf("expected the unknown field got %v", p)
+	}
+
+	body = fmt.Sprintf(`{"repo": %q, "path": "/app", "ref": "no-such-branch"}`, repo)
+	req = httptest.NewRequest(http.MethodPost, "/v1/type/validate", strings.NewReader(body))
+	w = httptest.NewRecorder()
+	newRouter().ServeHTTP(w, req)
+
+	if w.Result().StatusCode != http.StatusBadRequest {
+		t.Errorf("expected bad status code got %v", w.Result().StatusCode)
+	}
+}
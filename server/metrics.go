@@ -0,0 +1,25 @@
+package main
+
+import (
+	"fmt"
+	"github.com/bones/server/common"
+	github "github.com/bones/server/handlers/github"
+	"net/http"
+)
+
+// returnMetrics exposes the workspace caches in the Prometheus text format.
+func returnMetrics(w http.ResponseWriter, r *http.Request) {
+	hits, misses := github.CacheStats()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	fmt.Fprintln(w, "# HELP bones_skeleton_cache_hits_total Skeleton checkouts served from the clone cache.")
+	fmt.Fprintln(w, "# TYPE bones_skeleton_cache_hits_total counter")
+	fmt.Fprintf(w, "bones_skeleton_cache_hits_total %d\n", hits)
+	fmt.Fprintln(w, "# HELP bones_skeleton_cache_misses_total Skeleton checkouts that needed a fetch.")
+	fmt.Fprintln(w, "# TYPE bones_skeleton_cache_misses_total counter")
+	fmt.Fprintf(w, "bones_skeleton_cache_misses_total %d\n", misses)
+	fmt.Fprintln(w, "# HELP bones_plugin_cache_providers Provider binaries in the shared plugin cache.")
+	fmt.Fprintln(w, "# TYPE bones_plugin_cache_providers gauge")
+	fmt.Fprintf(w, "bones_plugin_cache_providers %d\n", common.PluginCacheEntries())
+}
@@ -0,0 +1,237 @@
+// Package render renders a skeleton into a local directory the way the
+// generate steps of a run would, without creating repos or running
+// Terraform:
+//
+//	ctx, skeleton, err := render.Open(ctx, ".", "/", "")
+//	err = skeleton.Render(ctx, dst, render.Options{Name: "My Shop", Data: data})
+//
+// Steps run with stand-ins for their handlers. The github step copies the
+// skeleton, the aws and circleci steps render the files they would commit,
+// and approval steps, which have nothing to render, are skipped.
+package render
+
+import (
+	"context"
+	"fmt"
+	"github.com/bones/server/common"
+	aws "github.com/bones/server/handlers/aws"
+	circleci "github.com/bones/server/handlers/circleci"
+	github "github.com/bones/server/handlers/github"
+	"gopkg.in/yaml.v3"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Options are what a skeleton is rendered with.
+type Options struct {
+	// Name is the project's name. Its slug is APP_NAME.
+	Name string
+
+	// Data are the input values, before the skeleton's defaults and types
+	// are applied.
+	Data common.Data
+
+	// Outputs are the Terraform outputs templates see, since none are
+	// applied.
+	Outputs map[string]interface{}
+
+	// Time is the time the run started, now by default.
+	Time time.Time
+
+	// Out is where progress is written, nowhere by default.
+	Out io.Writer
+}
+
+// step is the part of a generate step of a manifest that rendering needs.
+type step struct {
+	Name    string
+	Handler string
+	When    string
+	ForEach string `yaml:"for_each"`
+}
+
+type manifest struct {
+	Inputs   []common.Input
+	Generate struct {
+		Steps []step
+	}
+}
+
+// handlers stand in for the step handlers of a run: each writes the files
+// its handler would write to the project repo into dst. The skeleton is
+// checked out at dir.
+var handlers = map[string]func(ctx context.Context, dir string, dst string, data common.Data) error{
+	"github":   common.CopyTree,
+	"aws":      writeFiles(aws.RenderFiles),
+	"circleci": writeFiles(circleci.RenderFiles),
+}
+
+func writeFiles(render func(ctx context.Context, dir string, data common.Data) ([]github.RemoteFile, error)) func(ctx context.Context, dir string, dst string, data common.Data) error {
+	return func(ctx context.Context, dir string, dst string, data common.Data) error {
+		files, err := render(ctx, dir, data)
+		if err != nil {
+			return err
+		}
+
+		for _, file := range files {
+			err = os.MkdirAll(filepath.Join(dst, file.Path), 0755)
+			if err != nil {
+				return err
+			}
+
+			err = os.WriteFile(filepath.Join(dst, file.Path, file.Name), file.Data, file.Perm)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+}
+
+// renderer renders the steps of one skeleton into dst.
+type renderer struct {
+	skeleton *Skeleton
+	dst      string
+	out      io.Writer
+}
+
+func (r *renderer) readManifest(ctx context.Context) (manifest, error) {
+	var m manifest
+
+	dir, err := r.skeleton.Checkout(ctx)
+	if err != nil {
+		return m, err
+	}
+	defer os.RemoveAll(dir)
+
+	text, err := os.ReadFile(filepath.Join(dir+r.skeleton.Path, ".skeleton", "skeleton.yaml"))
+	if err != nil {
+		return m, err
+	}
+
+	err = yaml.Unmarshal(text, &m)
+	if err != nil {
+		return m, fmt.Errorf("skeleton.yaml: %v", err)
+	}
+
+	return m, nil
+}
+
+// step renders the files that step's handler would write to the project
+// repo. Every step checks out the skeleton again, as in a run.
+func (r *renderer) step(ctx context.Context, name string, s step, data common.Data) error {
+	handler, ok := handlers[s.Handler]
+	if !ok {
+		fmt.Fprintf(r.out, "Skipping step %s: %s has nothing to render\n", name, s.Handler)
+		return nil
+	}
+
+	dir, err := r.skeleton.Checkout(ctx)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	fmt.Fprintf(r.out, "Rendering step %s (%s)\n", name, s.Handler)
+
+	return handler(ctx, dir+r.skeleton.Path, r.dst, data)
+}
+
+// steps renders the generate steps in order, with their for_each and when
+// applied as in a run.
+func (r *renderer) steps(ctx context.Context, steps []step, data common.Data) error {
+	for _, s := range steps {
+		if s.ForEach == "" {
+			err := r.conditionalStep(ctx, s.Name, s, data)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		items, ok := data[s.ForEach].([]interface{})
+		if !ok && data[s.ForEach] != nil {
+			return fmt.Errorf("step %s: for_each input %s is not a list", s.Name, s.ForEach)
+		}
+
+		for i, item := range items {
+			each := common.Each{Key: common.EachKey(i, item), Value: item, Index: i}
+
+			err := r.conditionalStep(common.WithEach(ctx, each), fmt.Sprintf("%s [%s]", s.Name, each.Key), s, data)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (r *renderer) conditionalStep(ctx context.Context, name string, s step, data common.Data) error {
+	if s.When != "" {
+		ok, err := common.Condition(ctx, s.When, data)
+		if err != nil {
+			return fmt.Errorf("step %s: when: %w", name, err)
+		}
+
+		if !ok {
+			fmt.Fprintf(r.out, "Skipping step %s: when %s is false\n", name, s.When)
+			return nil
+		}
+	}
+
+	return r.step(ctx, name, s, data)
+}
+
+// Render renders the skeleton into dst, which is created if needed.
+// Templates see the project with no id or repo.
+func (s *Skeleton) Render(ctx context.Context, dst string, options Options) error {
+	r := &renderer{skeleton: s, dst: dst, out: options.Out}
+	if r.out == nil {
+		r.out = io.Discard
+	}
+
+	m, err := r.readManifest(ctx)
+	if err != nil {
+		return err
+	}
+
+	data := common.Data{}
+	for key, value := range options.Data {
+		data[key] = value
+	}
+
+	err = common.ApplyInputs(m.Inputs, data)
+	if err != nil {
+		return err
+	}
+
+	slug := strings.ReplaceAll(strings.ToLower(options.Name), " ", "-")
+	data["APP_NAME"] = slug
+	data["SERVICE_NAME"] = slug + "-service"
+
+	started := options.Time
+	if started.IsZero() {
+		started = time.Now()
+	}
+
+	tc := &common.TemplateContext{
+		Project: map[string]string{"id": "", "name": options.Name, "slug": slug, "desc": "", "repo": ""},
+		Type:    map[string]string{"slug": "", "name": "", "desc": "", "repo": s.Source(), "path": s.Path},
+		Data:    data,
+		Server:  map[string]string{"name": "bones", "url": "", "time": started.UTC().Format(time.RFC3339)},
+	}
+	tc.SetOutputs(options.Outputs)
+	ctx = common.WithTemplateContext(ctx, tc)
+
+	err = os.MkdirAll(dst, 0755)
+	if err != nil {
+		return err
+	}
+
+	return r.steps(ctx, m.Generate.Steps, data)
+}
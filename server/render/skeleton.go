@@ -0,0 +1,76 @@
+package render
+
+import (
+	"context"
+	github "github.com/bones/server/handlers/github"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Skeleton is a skeleton to render: a local directory, such as its author's
+// working copy, or a repo.
+type Skeleton struct {
+	Root string
+	Repo string
+
+	// Path is the skeleton's path in Root or Repo, "" for the top.
+	Path string
+}
+
+// Open resolves a skeleton named on the command line, a directory or a repo,
+// and its path and ref. A repo is pinned to the commit ref resolves to on the
+// returned context, so that every checkout sees the same skeleton, as in a
+// run.
+func Open(ctx context.Context, skeleton string, path string, ref string) (context.Context, *Skeleton, error) {
+	s := &Skeleton{Path: "/" + strings.Trim(path, "/")}
+	if s.Path == "/" {
+		s.Path = ""
+	}
+
+	if info, err := os.Stat(skeleton); err == nil && info.IsDir() {
+		s.Root, err = filepath.Abs(skeleton)
+		return ctx, s, err
+	}
+
+	sha, err := github.ResolveRef(skeleton, ref)
+	if err != nil {
+		return ctx, nil, err
+	}
+	s.Repo = skeleton
+
+	return github.PinSkeleton(ctx, skeleton, sha), s, nil
+}
+
+// Checkout returns a fresh copy of the skeleton with its includes composed;
+// dir+Path is the skeleton. The caller removes dir.
+func (s *Skeleton) Checkout(ctx context.Context) (string, error) {
+	if s.Root != "" {
+		return github.CheckoutLocalSkeleton(ctx, s.Root, s.Path)
+	}
+
+	return github.CheckoutSkeleton(ctx, s.Repo, s.Path)
+}
+
+// Manifest returns the skeleton's own manifest, or nil when it has none.
+func (s *Skeleton) Manifest(ctx context.Context) ([]byte, error) {
+	if s.Root == "" {
+		return github.ReadManifest(ctx, s.Repo, s.Path)
+	}
+
+	text, err := os.ReadFile(filepath.Join(s.Root+s.Path, ".skeleton", "skeleton.yaml"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	return text, err
+}
+
+// Source is how the skeleton is named to templates as .type.repo.
+func (s *Skeleton) Source() string {
+	if s.Root != "" {
+		return s.Root
+	}
+
+	return s.Repo
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/bones/server/common"
+	"github.com/gorilla/mux"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// ProjectResource is an inventory entry tagged with the project that owns it.
+type ProjectResource struct {
+	Project string `json:"project"`
+	common.Resource
+}
+
+// matchResource applies the type, provider, name and id query filters. The
+// name filter matches any part of the resource address; id matches either
+// the resource ID or its ARN.
+func matchResource(resource common.Resource, query url.Values) bool {
+	if t := query.Get("type"); t != "" && resource.Type != t {
+		return false
+	}
+
+	if provider := query.Get("provider"); provider != "" && !strings.HasSuffix(resource.Provider, provider) {
+		return false
+	}
+
+	if name := query.Get("name"); name != "" && !strings.Contains(resource.Address, name) {
+		return false
+	}
+
+	if id := query.Get("id"); id != "" && resource.Id != id && resource.Arn != id {
+		return false
+	}
+
+	return true
+}
+
+func returnProjectResources(w http.ResponseWriter, r *http.Request) {
+	project, ok := lookupProject(mux.Vars(r)["id"])
+	if !ok {
+		http.Error(w, "Project Not Found", http.StatusNotFound)
+		return
+	}
+
+	runsLock.Lock()
+	defer runsLock.Unlock()
+
+	resources := []common.Resource{}
+	for _, resource := range project.Resources {
+		if matchResource(resource, r.URL.Query()) {
+			resources = append(resources, resource)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resources)
+}
+
+func searchResources(w http.ResponseWriter, r *http.Request) {
+	runsLock.Lock()
+	defer runsLock.Unlock()
+
+	resources := []ProjectResource{}
+	for _, project := range Projects {
+		for _, resource := range project.Resources {
+			if matchResource(resource, r.URL.Query()) {
+				resources = append(resources, ProjectResource{Project: project.Id, Resource: resource})
+			}
+		}
+	}
+
+	sort.Slice(resources, func(i, j int) bool {
+		if resources[i].Project != resources[j].Project {
+			return resources[i].Project < resources[j].Project
+		}
+		return resources[i].Address < resources[j].Address
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resources)
+}
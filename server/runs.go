@@ -0,0 +1,533 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/bones/server/common"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	tfjson "github.com/hashicorp/terraform-json"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type RunStatus string
+
+const (
+	RunRunning          RunStatus = "running"
+	RunAwaitingApproval RunStatus = "awaiting_approval"
+	RunSucceeded        RunStatus = "succeeded"
+	RunFailed           RunStatus = "failed"
+	RunRejected         RunStatus = "rejected"
+	RunCancelled        RunStatus = "cancelled"
+	RunSkipped          RunStatus = "skipped"
+)
+
+var errPlanRejected = errors.New("plan rejected")
+
+type RunStep struct {
+	Name    string    `json:"name"`
+	Handler string    `json:"handler"`
+	Status  RunStatus `json:"status"`
+	Error   string    `json:"error,omitempty"`
+	Reason  string    `json:"reason,omitempty"`
+}
+
+// Approval describes a Terraform plan that is waiting for sign-off. Plan is
+// the saved plan file that will be applied as-is once approved. It stays on
+// the server, since its variables hold the credentials passed to Terraform.
+type Approval struct {
+	Step     string       `json:"step"`
+	StateKey string       `json:"stateKey"`
+	Changes  []string     `json:"changes"`
+	Plan     *tfjson.Plan `json:"-"`
+	Decision string       `json:"decision,omitempty"`
+}
+
+// Run tracks a single execution of a skeleton's generate or destroy steps.
+// All fields are guarded by runsLock, as are the States, Resources, Drift,
+// Environments, Outputs and Addons of the project the run belongs to.
+type Run struct {
+	Id        string     `json:"id"`
+	ProjectId string     `json:"project"`
+	Action    string     `json:"action"`
+	Status    RunStatus  `json:"status"`
+	Steps     []*RunStep `json:"steps"`
+	Approval  *Approval  `json:"approval,omitempty"`
+	Error     string     `json:"error,omitempty"`
+	Started   time.Time  `json:"started"`
+	Finished  *time.Time `json:"finished,omitempty"`
+
+	// approval is held by the step whose plan is waiting for a decision, so
+	// that steps running in parallel ask for sign-off one at a time.
+	approval chan struct{}
+	decision chan bool
+	project  *Project
+
+	// environment is the project environment the run applies to, empty for
+	// the default one.
+	environment string
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	log    *runLog
+}
+
+// runLog is the output of a run, kept in memory so that it can be tailed.
+type runLog struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (l *runLog) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.buf.Write(p)
+}
+
+// since returns the output written after the first offset bytes.
+func (l *runLog) since(offset int) []byte {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if offset < 0 || offset > l.buf.Len() {
+		offset = l.buf.Len()
+	}
+
+	return append([]byte{}, l.buf.Bytes()[offset:]...)
+}
+
+var Runs = make(map[string]*Run)
+var runsLock sync.Mutex
+
+// lookupProject returns the project with id, under runsLock.
+func lookupProject(id string) (*Project, bool) {
+	runsLock.Lock()
+	defer runsLock.Unlock()
+
+	project, ok := Projects[id]
+	return project, ok
+}
+
+func newRun(project *Project, action string) *Run {
+	runsLock.Lock()
+	defer runsLock.Unlock()
+
+	return addRun(project, action)
+}
+
+// startRun starts a run of action on project, or returns nil if the project
+// has a run in progress. The caller must hold runsLock, so that no other run
+// can start between the check and the new run.
+func startRun(project *Project, action string) *Run {
+	if projectBusy(project.Id) {
+		return nil
+	}
+
+	return addRun(project, action)
+}
+
+// addRun registers a new run of action on project. The caller must hold
+// runsLock.
+func addRun(project *Project, action string) *Run {
+	run := &Run{
+		Id:        uuid.New().String(),
+		ProjectId: project.Id,
+		Action:    action,
+		Status:    RunRunning,
+		Steps:     []*RunStep{},
+		Started:   time.Now(),
+		project:   project,
+		approval:  make(chan struct{}, 1),
+		log:       &runLog{},
+	}
+	run.ctx, run.cancel = context.WithCancel(context.Background())
+
+	Runs[run.Id] = run
+
+	return run
+}
+
+type stepKey struct{}
+
+// runningStep travels on the context of a running step, so that the
+// Terraform calls its handler makes can be traced back to it.
+type runningStep struct {
+	step *RunStep
+
+	// gated is set for steps that come after an approval step: every plan
+	// they make waits for a decision before it is applied.
+	gated bool
+}
+
+func stepFromContext(ctx context.Context) *runningStep {
+	current, _ := ctx.Value(stepKey{}).(*runningStep)
+	return current
+}
+
+// runStep runs fn as the named step, unless ctx has been cancelled.
+func (run *Run) runStep(ctx context.Context, name string, handler string, gated bool, fn func(ctx context.Context) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	step := run.startStep(name, handler)
+	err := fn(context.WithValue(ctx, stepKey{}, &runningStep{step: step, gated: gated}))
+	run.finishStep(step, err)
+
+	return err
+}
+
+func (run *Run) startStep(name string, handler string) *RunStep {
+	runsLock.Lock()
+	defer runsLock.Unlock()
+
+	step := &RunStep{Name: name, Handler: handler, Status: RunRunning}
+	run.Steps = append(run.Steps, step)
+
+	fmt.Fprintf(run.log, "==> %s (%s)\n", name, handler)
+
+	return step
+}
+
+// skipStep records a step that did not run, and why.
+func (run *Run) skipStep(name string, handler string, reason string) {
+	runsLock.Lock()
+	defer runsLock.Unlock()
+
+	run.Steps = append(run.Steps, &RunStep{Name: name, Handler: handler, Status: RunSkipped, Reason: reason})
+
+	fmt.Fprintf(run.log, "==> %s (%s) skipped: %s\n", name, handler, reason)
+}
+
+// finishStep records the outcome of step.
+func (run *Run) finishStep(step *RunStep, err error) {
+	runsLock.Lock()
+	defer runsLock.Unlock()
+
+	switch {
+	case errors.Is(err, errPlanRejected):
+		step.Status = RunRejected
+	case errors.Is(err, context.Canceled):
+		step.Status = RunCancelled
+	case err != nil:
+		step.Status = RunFailed
+	default:
+		step.Status = RunSucceeded
+	}
+	if err != nil {
+		step.Error = err.Error()
+	}
+}
+
+func (run *Run) finish(err error) {
+	runsLock.Lock()
+	defer runsLock.Unlock()
+
+	now := time.Now()
+	run.Finished = &now
+	run.project.UpdatedAt = now
+	run.cancel()
+
+	switch {
+	case errors.Is(err, errPlanRejected):
+		run.Status = RunRejected
+	case errors.Is(err, context.Canceled):
+		run.Status = RunCancelled
+	case err != nil:
+		run.Status = RunFailed
+	default:
+		run.Status = RunSucceeded
+	}
+	if err != nil {
+		run.Error = err.Error()
+		fmt.Printf("Run %s %s: %s\n", run.Id, run.Status, err)
+	}
+
+	fmt.Fprintf(run.log, "==> Run %s\n", run.Status)
+}
+
+// AwaitApproval implements common.Run. Plans are only held for steps that
+// depend on an approval step.
+func (run *Run) AwaitApproval(ctx context.Context, statefileDir string, plan *tfjson.Plan) error {
+	current := stepFromContext(ctx)
+	if current == nil || !current.gated {
+		return nil
+	}
+
+	select {
+	case run.approval <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-run.approval }()
+
+	runsLock.Lock()
+
+	var changes []string
+	for _, c := range plan.ResourceChanges {
+		changes = append(changes, fmt.Sprintf("%s %s", c.Change.Actions, c.Address))
+	}
+
+	decision := make(chan bool, 1)
+	run.decision = decision
+	run.Status = RunAwaitingApproval
+	run.Approval = &Approval{
+		Step:     current.step.Name,
+		StateKey: statefileDir,
+		Changes:  changes,
+		Plan:     plan,
+	}
+	runsLock.Unlock()
+
+	fmt.Fprintf(run.log, "Waiting for approval of %s\n", statefileDir)
+
+	var approved bool
+	select {
+	case approved = <-decision:
+	case <-ctx.Done():
+	}
+
+	runsLock.Lock()
+	defer runsLock.Unlock()
+
+	run.Status = RunRunning
+	run.decision = nil
+
+	if !approved {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return errPlanRejected
+	}
+
+	return nil
+}
+
+// Log implements common.Run.
+func (run *Run) Log() io.Writer {
+	return run.log
+}
+
+// Applied implements common.Run by remembering the state key on the project,
+// so that drift detection can plan it again later, and by replacing the
+// project's inventory of the resources held in that state.
+func (run *Run) Applied(ctx context.Context, statefileDir string, resources []common.Resource) {
+	runsLock.Lock()
+	defer runsLock.Unlock()
+
+	project := run.project
+
+	inventory := []common.Resource{}
+	for _, resource := range project.Resources {
+		if resource.StateKey != statefileDir {
+			inventory = append(inventory, resource)
+		}
+	}
+	project.Resources = append(inventory, resources...)
+
+	handler, gated := "", false
+	if current := stepFromContext(ctx); current != nil {
+		handler, gated = current.step.Handler, current.gated
+	}
+
+	for i, state := range project.States {
+		if state.Key == statefileDir {
+			project.States[i].Gated = gated
+			return
+		}
+	}
+
+	state := ProjectState{
+		Handler:     handler,
+		Key:         statefileDir,
+		Environment: run.environment,
+		Gated:       gated,
+	}
+	if each, ok := common.EachFromContext(ctx); ok {
+		state.Each = each.Key
+		state.EachValue = each.Value
+		state.EachIndex = each.Index
+	}
+	if addon, ok := common.AddonFromContext(ctx); ok {
+		state.Addon = addon
+	}
+
+	project.States = append(project.States, state)
+}
+
+// Destroyed implements common.Run by forgetting the state and its resources.
+func (run *Run) Destroyed(statefileDir string) {
+	runsLock.Lock()
+	defer runsLock.Unlock()
+
+	project := run.project
+
+	states := []ProjectState{}
+	for _, state := range project.States {
+		if state.Key != statefileDir {
+			states = append(states, state)
+		}
+	}
+	project.States = states
+
+	inventory := []common.Resource{}
+	for _, resource := range project.Resources {
+		if resource.StateKey != statefileDir {
+			inventory = append(inventory, resource)
+		}
+	}
+	project.Resources = inventory
+}
+
+// projectBusy reports whether a run for the project is still in progress.
+// The caller must hold runsLock.
+func projectBusy(projectId string) bool {
+	for _, run := range Runs {
+		if run.ProjectId == projectId && run.Finished == nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+func findRun(w http.ResponseWriter, r *http.Request) *Run {
+	vars := mux.Vars(r)
+
+	run, ok := Runs[vars["run"]]
+	if !ok || run.ProjectId != vars["id"] {
+		http.Error(w, "Run Not Found", http.StatusNotFound)
+		return nil
+	}
+
+	return run
+}
+
+func returnProjectRuns(w http.ResponseWriter, r *http.Request) {
+	runsLock.Lock()
+	defer runsLock.Unlock()
+
+	id := mux.Vars(r)["id"]
+
+	runs := []*Run{}
+	for _, run := range Runs {
+		if run.ProjectId == id {
+			runs = append(runs, run)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(runs)
+}
+
+func returnProjectRun(w http.ResponseWriter, r *http.Request) {
+	runsLock.Lock()
+	defer runsLock.Unlock()
+
+	run := findRun(w, r)
+	if run == nil {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(run)
+}
+
+func decideRun(w http.ResponseWriter, r *http.Request, approved bool) {
+	runsLock.Lock()
+	defer runsLock.Unlock()
+
+	run := findRun(w, r)
+	if run == nil {
+		return
+	}
+
+	if run.decision == nil {
+		http.Error(w, "Run is not awaiting approval", http.StatusConflict)
+		return
+	}
+
+	if approved {
+		run.Approval.Decision = "approved"
+	} else {
+		run.Approval.Decision = "rejected"
+	}
+
+	run.decision <- approved
+	run.decision = nil
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(run)
+}
+
+func approveProjectRun(w http.ResponseWriter, r *http.Request) {
+	decideRun(w, r, true)
+}
+
+func rejectProjectRun(w http.ResponseWriter, r *http.Request) {
+	decideRun(w, r, false)
+}
+
+func cancelProjectRun(w http.ResponseWriter, r *http.Request) {
+	runsLock.Lock()
+	defer runsLock.Unlock()
+
+	run := findRun(w, r)
+	if run == nil {
+		return
+	}
+
+	if run.Finished != nil {
+		http.Error(w, "Run has already finished", http.StatusConflict)
+		return
+	}
+
+	// Commands that write state finish before the run stops; see
+	// common.ExecuteTerraform.
+	fmt.Fprintln(run.log, "==> Cancel requested")
+	run.cancel()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(run)
+}
+
+// returnProjectRunLog returns the run's output from the byte offset given
+// by ?offset=. Clients tail a run by polling with the offset advanced by the
+// length of each response until X-Run-Status is a terminal status:
+// succeeded, failed, rejected or cancelled. A run that is awaiting_approval
+// hasn't finished; it goes on once its plan is approved.
+func returnProjectRunLog(w http.ResponseWriter, r *http.Request) {
+	runsLock.Lock()
+	run := findRun(w, r)
+	var status RunStatus
+	if run != nil {
+		status = run.Status
+	}
+	runsLock.Unlock()
+
+	if run == nil {
+		return
+	}
+
+	offset := 0
+	if value := r.URL.Query().Get("offset"); value != "" {
+		var err error
+		offset, err = strconv.Atoi(value)
+		if err != nil {
+			http.Error(w, "offset must be a number", http.StatusBadRequest)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Run-Status", string(status))
+	w.Write(run.log.since(offset))
+}
@@ -0,0 +1,346 @@
+// Package skeletontest runs the tests a skeleton ships in .skeleton/tests.
+// A test is a YAML file of sample inputs and what they should render to:
+//
+//	# .skeleton/tests/with-database.yaml
+//	project: My Shop
+//	data:
+//	  ENABLE_DATABASE: true
+//	outputs:
+//	  cluster_name: main
+//	files:
+//	  infra/aws-ecs/database.tf: |
+//	    ...
+//	absent:
+//	  - .circleci
+//
+// The skeleton is rendered by package render, with stand-ins for the step
+// handlers, and outputs as the Terraform outputs. Every file the test renders
+// is compared to its golden directory, .skeleton/tests/with-database/, when
+// there is one, and files and absent are checked besides. Updating writes
+// the golden directories instead of comparing them.
+//
+// Templates see the time as Time, so that golden files don't change with
+// it. From a Go test:
+//
+//	func TestSkeleton(t *testing.T) {
+//		skeletontest.Test(t, &render.Skeleton{Root: "."}, *update)
+//	}
+package skeletontest
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/bones/server/common"
+	"gopkg.in/yaml.v3"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"skeletonarmydev/bones/render"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Time is the time of the runs tests render.
+var Time = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// Case is a test of a skeleton.
+type Case struct {
+	// Name is that of the test's file, without .yaml.
+	Name string `yaml:"-"`
+
+	// Project is the project's name, the test's name by default.
+	Project string                 `yaml:"project"`
+	Data    common.Data            `yaml:"data"`
+	Outputs map[string]interface{} `yaml:"outputs"`
+
+	// Files are the expected contents of some of the rendered files, and
+	// Absent paths that must not be rendered.
+	Files  map[string]string `yaml:"files"`
+	Absent []string          `yaml:"absent"`
+}
+
+// Result is the outcome of a test. Failures describe how the rendered files
+// differ from those expected.
+type Result struct {
+	Name     string
+	Failures []string
+	Updated  bool
+}
+
+// Failed reports whether the test failed.
+func (r Result) Failed() bool {
+	return len(r.Failures) > 0
+}
+
+// Options select the tests to run and how.
+type Options struct {
+	// Run selects the tests to run by name, all by default.
+	Run *regexp.Regexp
+
+	// Update writes the golden directories of a local skeleton from what its
+	// tests render.
+	Update bool
+}
+
+// Run runs the tests of skeleton, in name order.
+func Run(ctx context.Context, skeleton *render.Skeleton, options Options) ([]Result, error) {
+	if options.Update && skeleton.Root == "" {
+		return nil, fmt.Errorf("golden files can only be updated in a local skeleton")
+	}
+
+	// The tests of included skeletons are left out of the checkout.
+	dir, err := skeleton.Checkout(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	tests := filepath.Join(dir+skeleton.Path, common.TestsDir)
+
+	cases, err := readCases(tests)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []Result
+	for _, c := range cases {
+		if options.Run != nil && !options.Run.MatchString(c.Name) {
+			continue
+		}
+
+		result, err := runCase(ctx, skeleton, c, tests, options.Update)
+		if err != nil {
+			return results, err
+		}
+		results = append(results, result)
+	}
+
+	return results, nil
+}
+
+func readCases(dir string) ([]Case, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.yaml"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+
+	var cases []Case
+	for _, file := range files {
+		text, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+
+		c := Case{Name: strings.TrimSuffix(filepath.Base(file), ".yaml")}
+		err = yaml.Unmarshal(text, &c)
+		if err != nil {
+			return nil, fmt.Errorf("%s/%s: %v", common.TestsDir, filepath.Base(file), err)
+		}
+		if c.Project == "" {
+			c.Project = c.Name
+		}
+
+		cases = append(cases, c)
+	}
+
+	return cases, nil
+}
+
+func runCase(ctx context.Context, skeleton *render.Skeleton, c Case, tests string, update bool) (Result, error) {
+	result := Result{Name: c.Name}
+
+	dst, err := os.MkdirTemp("", "skeletontest")
+	if err != nil {
+		return result, err
+	}
+	defer os.RemoveAll(dst)
+
+	err = skeleton.Render(ctx, dst, render.Options{Name: c.Project, Data: c.Data, Outputs: c.Outputs, Time: Time})
+	if err != nil {
+		result.Failures = append(result.Failures, err.Error())
+		return result, nil
+	}
+
+	rendered, err := readTree(dst)
+	if err != nil {
+		return result, err
+	}
+
+	golden := filepath.Join(tests, c.Name)
+	switch {
+	case update:
+		err = writeGolden(filepath.Join(skeleton.Root+skeleton.Path, common.TestsDir, c.Name), dst)
+		if err != nil {
+			return result, err
+		}
+		result.Updated = true
+	case isDir(golden):
+		expected, err := readTree(golden)
+		if err != nil {
+			return result, err
+		}
+		result.Failures = append(result.Failures, compare(expected, rendered)...)
+	case len(c.Files) == 0 && len(c.Absent) == 0:
+		result.Failures = append(result.Failures, "no golden files, update the tests to write them")
+	}
+
+	var names []string
+	for name := range c.Files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		got, ok := rendered[name]
+		if !ok {
+			result.Failures = append(result.Failures, fmt.Sprintf("%s: not rendered", name))
+			continue
+		}
+		if failure := diff(name, []byte(c.Files[name]), got); failure != "" {
+			result.Failures = append(result.Failures, failure)
+		}
+	}
+
+	for _, path := range c.Absent {
+		if _, err := os.Stat(filepath.Join(dst, path)); err == nil {
+			result.Failures = append(result.Failures, fmt.Sprintf("%s: rendered, expected absent", path))
+		}
+	}
+
+	return result, nil
+}
+
+func isDir(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
+
+// readTree returns the contents of the files in dir by slash-separated path.
+func readTree(dir string) (map[string][]byte, error) {
+	files := make(map[string][]byte)
+
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+
+		files[filepath.ToSlash(rel)], err = os.ReadFile(path)
+		return err
+	})
+
+	return files, err
+}
+
+// writeGolden replaces the golden directory with the rendered files.
+func writeGolden(golden string, rendered string) error {
+	err := os.RemoveAll(golden)
+	if err != nil {
+		return err
+	}
+
+	return common.Dir(rendered, golden)
+}
+
+// compare describes how the rendered files differ from the golden ones.
+func compare(expected map[string][]byte, rendered map[string][]byte) []string {
+	names := make(map[string]bool)
+	for name := range expected {
+		names[name] = true
+	}
+	for name := range rendered {
+		names[name] = true
+	}
+
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	var failures []string
+	for _, name := range sorted {
+		want, inGolden := expected[name]
+		got, isRendered := rendered[name]
+
+		switch {
+		case !isRendered:
+			failures = append(failures, fmt.Sprintf("%s: not rendered", name))
+		case !inGolden:
+			failures = append(failures, fmt.Sprintf("%s: rendered, not in the golden files", name))
+		default:
+			if failure := diff(name, want, got); failure != "" {
+				failures = append(failures, failure)
+			}
+		}
+	}
+
+	return failures
+}
+
+// diff describes the first line where got differs from expected, or returns
+// "" if they are the same.
+func diff(name string, expected []byte, got []byte) string {
+	if bytes.Equal(expected, got) {
+		return ""
+	}
+
+	want := strings.SplitAfter(string(expected), "\n")
+	have := strings.SplitAfter(string(got), "\n")
+
+	line := func(lines []string, i int) string {
+		if i >= len(lines) || (i == len(lines)-1 && lines[i] == "") {
+			return "end of file"
+		}
+		return fmt.Sprintf("%q", lines[i])
+	}
+
+	for i := 0; ; i++ {
+		if i >= len(want) || i >= len(have) || want[i] != have[i] {
+			return fmt.Sprintf("%s:%d: expected %s got %s", name, i+1, line(want, i), line(have, i))
+		}
+	}
+}
+
+// WriteFiles writes files, by slash-separated path, under dir. It lays out
+// skeletons for tests.
+func WriteFiles(t testing.TB, dir string, files map[string]string) {
+	t.Helper()
+
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(path), 0755)
+
+		err := os.WriteFile(path, []byte(content), 0644)
+		if err != nil {
+			t.Fatalf("expected error to be nil got %v", err)
+		}
+	}
+}
+
+// Test runs the tests of skeleton as subtests of t, updating their golden
+// directories if update is set.
+func Test(t *testing.T, skeleton *render.Skeleton, update bool) {
+	results, err := Run(context.Background(), skeleton, Options{Update: update})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, result := range results {
+		result := result
+		t.Run(result.Name, func(t *testing.T) {
+			for _, failure := range result.Failures {
+				t.Error(failure)
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package skeletontest
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"skeletonarmydev/bones/render"
+	"strings"
+	"testing"
+)
+
+func TestRun(t *testing.T) {
+
+	root := t.TempDir()
+	WriteFiles(t, root, map[string]string{
+		"base/.skeleton/skeleton.yaml":   "generate:\n  steps:\n    - name: repo\n      handler: github\n",
+		"base/.skeleton/tests/base.yaml": "absent: [nothing]\n",
+		"app/.skeleton/skeleton.yaml": `include:
+  - path: /base
+inputs:
+  - name: REPLICAS
+    type: number
+    default: 1
+generate:
+  steps:
+    - name: infra
+      handler: aws
+`,
+		"app/infra/aws-ecs/main.tf": "variable \"REPLICAS\" {}\n# {{ .project.slug }} in {{ .outputs.cluster }} at {{ .server.time }}\n",
+		"app/README.md":             "# Shop\n",
+		"app/.skeleton/tests/three.yaml": `project: My Shop
+data:
+  REPLICAS: 3
+outputs:
+  cluster: main
+files:
+  README.md: "# Shop\n"
+absent:
+  - .circleci
+`,
+		"app/.skeleton/tests/default.yaml": "project: Other\n",
+	})
+
+	skeleton := &render.Skeleton{Root: root, Path: "/app"}
+
+	results, err := Run(context.Background(), skeleton, Options{})
+	if err != nil {
+		t.Fatalf("expected error to be nil got %v", err)
+	}
+
+	// The included skeleton's tests don't run, and without golden files
+	// only the test with files and absent passes.
+	if len(results) != 2 || results[0].Name != "default" || !results[0].Failed() || results[1].Failed() {
+		t.Fatalf("expected default to fail and three to pass got %+v", results)
+	}
+
+	results, err = Run(context.Background(), skeleton, Options{Update: true})
+	if err != nil || len(results) != 2 || !results[0].Updated || results[0].Failed() {
+		t.Fatalf("expected the golden files to be updated got %+v %v", results, err)
+	}
+
+	main, err := os.ReadFile(filepath.Join(root, "app/.skeleton/tests/three/infra/aws-ecs/main.tf"))
+	if err != nil || !strings.Contains(string(main), "# my-shop in main at 2000-01-01T00:00:00Z") {
+		t.Errorf("expected the golden main.tf got %q %v", main, err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "app/.skeleton/tests/three/.skeleton/tests")); !os.IsNotExist(err) {
+		t.Errorf("expected the tests to be left out of the golden files got %v", err)
+	}
+
+	results, err = Run(context.Background(), skeleton, Options{})
+	if err != nil || len(results) != 2 || results[0].Failed() || results[1].Failed() {
+		t.Fatalf("expected the tests to pass got %+v %v", results, err)
+	}
+
+	WriteFiles(t, root, map[string]string{"app/infra/aws-ecs/main.tf": "variable \"REPLICAS\" {}\n# {{ .project.name }}\n"})
+
+	results, err = Run(context.Background(), skeleton, Options{})
+	if err != nil {
+		t.Fatalf("expected error to be nil got %v", err)
+	}
+
+	expected := `infra/aws-ecs/main.tf:2: expected "# my-shop in main at 2000-01-01T00:00:00Z\n" got "# My Shop\n"`
+	if len(results) != 2 || len(results[1].Failures) != 1 || results[1].Failures[0] != expected {
+		t.Errorf("expected %s got %+v", expected, results)
+	}
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/bones/server/common"
+	"strconv"
+)
+
+const defaultStepConcurrency = 1
+
+// skeletonStep is a generate or destroy step of a skeleton manifest, ready
+// to run. Steps left out of a run, such as the project-wide steps of an
+// environment, keep their place in the graph so that dependencies on them
+// still resolve.
+type skeletonStep struct {
+	Name      string
+	Handler   string
+	When      string
+	ForEach   string
+	DependsOn []string
+
+	leftOut bool
+	run     func(ctx context.Context) error
+}
+
+// stepConcurrency reads STEP_CONCURRENCY, the most steps of a run that may
+// run at the same time. Steps run one at a time unless it is set.
+func stepConcurrency() int {
+	limit, err := strconv.Atoi(common.GetConfig("STEP_CONCURRENCY"))
+	if err != nil || limit <= 0 {
+		return defaultStepConcurrency
+	}
+
+	return limit
+}
+
+// stepDependencies returns, for every step, the steps that must finish
+// before it starts. A step without depends_on waits for the one listed
+// before it, so manifests that don't use depends_on keep running in order.
+// For destroy, every dependency is reversed, whether explicit or implied by
+// the order: a step is destroyed before the steps it depends on.
+func stepDependencies(steps []skeletonStep, destroy bool) ([][]int, error) {
+	index := make(map[string]int)
+	for i, step := range steps {
+		if _, ok := index[step.Name]; ok {
+			return nil, fmt.Errorf("step %s is defined twice", step.Name)
+		}
+		index[step.Name] = i
+	}
+
+	waits := make([][]int, len(steps))
+	dependsOn := func(i int, j int) {
+		if destroy {
+			waits[j] = append(waits[j], i)
+		} else {
+			waits[i] = append(waits[i], j)
+		}
+	}
+
+	for i, step := range steps {
+		if step.DependsOn == nil {
+			if i > 0 {
+				dependsOn(i, i-1)
+			}
+			continue
+		}
+
+		for _, name := range step.DependsOn {
+			j, ok := index[name]
+			if !ok {
+				return nil, fmt.Errorf("step %s depends on unknown step %s", step.Name, name)
+			}
+
+			dependsOn(i, j)
+		}
+	}
+
+	// Kahn's algorithm: if not every step can be ordered, there is a cycle.
+	pending := make([]int, len(steps))
+	next := make([][]int, len(steps))
+	for i := range steps {
+		pending[i] = len(waits[i])
+		for _, j := range waits[i] {
+			next[j] = append(next[j], i)
+		}
+	}
+
+	var ready []int
+	for i := range steps {
+		if pending[i] == 0 {
+			ready = append(ready, i)
+		}
+	}
+
+	ordered := 0
+	for len(ready) > 0 {
+		i := ready[0]
+		ready = ready[1:]
+		ordered++
+
+		for _, j := range next[i] {
+			pending[j]--
+			if pending[j] == 0 {
+				ready = append(ready, j)
+			}
+		}
+	}
+
+	if ordered != len(steps) {
+		return nil, fmt.Errorf("step dependencies form a cycle")
+	}
+
+	return waits, nil
+}
+
+// approvalGated returns, for every step, whether it comes after an approval
+// step, directly or through the steps it waits for.
+func approvalGated(steps []skeletonStep, waits [][]int) []bool {
+	gated := make([]bool, len(steps))
+	visited := make([]bool, len(steps))
+
+	var visit func(i int) bool
+	visit = func(i int) bool {
+		if !visited[i] {
+			visited[i] = true
+			for _, j := range waits[i] {
+				if steps[j].Handler == "approval" || visit(j) {
+					gated[i] = true
+				}
+			}
+		}
+		return gated[i]
+	}
+
+	for i := range steps {
+		visit(i)
+	}
+
+	return gated
+}
+
+type stepResult struct {
+	index int
+	err   error
+}
+
+// runSteps runs steps as a graph, starting every step whose dependencies
+// have finished, up to STEP_CONCURRENCY at a time. A step that comes after an
+// approval step, directly or not, has its plans held for sign-off. After a failure no new
+// steps start; the first error is returned once the running ones finish.
+func runSteps(ctx context.Context, run *Run, data common.Data, steps []skeletonStep, destroy bool) error {
+	waits, err := stepDependencies(steps, destroy)
+	if err != nil {
+		return err
+	}
+
+	// Every for_each item needs its own state key and directory.
+	for _, step := range steps {
+		if step.ForEach != "" && !step.leftOut {
+			_, err := eachItems(step, data)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	gated := approvalGated(steps, waits)
+	limit := stepConcurrency()
+	started := make([]bool, len(steps))
+	done := make([]bool, len(steps))
+	results := make(chan stepResult)
+	running := 0
+
+	ready := func(i int) bool {
+		for _, j := range waits[i] {
+			if !done[j] {
+				return false
+			}
+		}
+		return true
+	}
+
+	var firstErr error
+	for {
+		for i, step := range steps {
+			if firstErr != nil || running >= limit {
+				break
+			}
+			if started[i] || !ready(i) {
+				continue
+			}
+
+			started[i] = true
+			running++
+
+			go func(i int, step skeletonStep) {
+				if step.leftOut {
+					results <- stepResult{index: i}
+					return
+				}
+				results <- stepResult{index: i, err: runSkeletonStep(ctx, run, data, step, gated[i])}
+			}(i, step)
+		}
+
+		if running == 0 {
+			break
+		}
+
+		result := <-results
+		running--
+		done[result.index] = true
+
+		if result.err != nil && firstErr == nil {
+			firstErr = result.err
+		}
+	}
+
+	return firstErr
+}
+
+// runSkeletonStep runs one step of a skeleton manifest with the inputs in
+// data. A step with for_each runs once per item of that list input, as
+// "name [key]", and a step with when only runs while its condition renders
+// true:
+//
+//	steps:
+//	  - name: Regional infra
+//	    handler: aws
+//	    for_each: REGIONS
+//	    when: '{{ ne .each.value "us-gov-west-1" }}'
+//
+// Skipped steps and iterations are recorded on the run with the reason.
+func runSkeletonStep(ctx context.Context, run *Run, data common.Data, step skeletonStep, gated bool) error {
+	if step.ForEach == "" {
+		return runConditionalStep(ctx, run, data, step.Name, step, gated)
+	}
+
+	items, err := eachItems(step, data)
+	if err != nil {
+		return err
+	}
+
+	if len(items) == 0 {
+		run.skipStep(step.Name, step.Handler, fmt.Sprintf("for_each input %s is empty", step.ForEach))
+		return nil
+	}
+
+	for _, each := range items {
+		err := runConditionalStep(common.WithEach(ctx, each), run, data, fmt.Sprintf("%s [%s]", step.Name, each.Key), step, gated)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// eachItems returns the items of a for_each step's list input. Items whose
+// keys are the same, such as "us east" and "us-east", are an error.
+func eachItems(step skeletonStep, data common.Data) ([]common.Each, error) {
+	var items []interface{}
+	switch value := data[step.ForEach].(type) {
+	case nil:
+	case []interface{}:
+		items = value
+	default:
+		return nil, fmt.Errorf("step %s: for_each input %s is not a list", step.Name, step.ForEach)
+	}
+
+	var each []common.Each
+	seen := make(map[string]int)
+	for i, item := range items {
+		key := common.EachKey(i, item)
+		if j, ok := seen[key]; ok {
+			return nil, fmt.Errorf("step %s: for_each items %d and %d of %s are both named %s", step.Name, j, i, step.ForEach, key)
+		}
+		seen[key] = i
+
+		each = append(each, common.Each{Key: key, Value: item, Index: i})
+	}
+
+	return each, nil
+}
+
+func runConditionalStep(ctx context.Context, run *Run, data common.Data, name string, step skeletonStep, gated bool) error {
+	if step.When != "" {
+		ok, err := common.Condition(ctx, step.When, data)
+		if err != nil {
+			return fmt.Errorf("step %s: when: %w", name, err)
+		}
+
+		if !ok {
+			run.skipStep(name, step.Handler, fmt.Sprintf("when %s is false", step.When))
+			return nil
+		}
+	}
+
+	return run.runStep(ctx, name, step.Handler, gated, step.run)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/bones/server/common"
+	github "github.com/bones/server/handlers/github"
+	"net/http"
+	"os"
+)
+
+// SkeletonValidateRequest names a skeleton to validate, as a project type
+// would, at ref or HEAD.
+type SkeletonValidateRequest struct {
+	Repo  string `json:"repo"`
+	Path  string `json:"path"`
+	Ref   string `json:"ref"`
+	Addon bool   `json:"addon"`
+}
+
+type SkeletonValidation struct {
+	Valid    bool             `json:"valid"`
+	Problems []common.Problem `json:"problems"`
+}
+
+// validateSkeleton is POST /type/validate. It checks a skeleton with
+// common.LintSkeleton before it is added as a type, so that a broken
+// manifest isn't only found by a run. A skeleton that can't be checked out
+// is a bad request, unless that is because of a problem in its manifest.
+// Skeletons off the GITHUB_BASE host are fetched without the server's
+// GitHub credentials.
+func validateSkeleton(w http.ResponseWriter, r *http.Request) {
+	var request SkeletonValidateRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if request.Repo == "" {
+		http.Error(w, "repo is required", http.StatusBadRequest)
+		return
+	}
+
+	sha, err := github.ResolveRef(request.Repo, request.Ref)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ctx := github.PinSkeleton(context.Background(), request.Repo, sha)
+
+	own, err := github.ReadManifest(ctx, request.Repo, request.Path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	options := common.LintOptions{Addon: request.Addon}
+
+	var problems []common.Problem
+	dir, err := github.CheckoutSkeleton(ctx, request.Repo, request.Path)
+	if err != nil {
+		problems = common.LintSkeleton("", own, options)
+		if len(problems) == 0 {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else {
+		defer os.RemoveAll(dir)
+		problems = common.LintSkeleton(dir+request.Path, own, options)
+	}
+
+	if problems == nil {
+		problems = []common.Problem{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(SkeletonValidation{Valid: len(problems) == 0, Problems: problems})
+}